@@ -5,13 +5,22 @@ import (
 	"arc/lifecycle"
 )
 
-func Run(roots []string, lc *lifecycle.Lifecycle, fsys fs.FS) {
+type Options struct {
+	CheckMetadata bool // flag copies whose metadata differs while the content matches
+	DryRun        bool // show plans without ever executing them
+	Conflicts     ConflictPolicy
+}
+
+func Run(roots []string, lc *lifecycle.Lifecycle, fsys fs.FS, opts Options) {
 	screen := initUi()
 	defer deinitUi(screen)
 
 	app := &appState{
-		lc: lc,
-		fs: fsys,
+		lc:             lc,
+		fs:             fsys,
+		checkMetadata:  opts.CheckMetadata,
+		dryRun:         opts.DryRun,
+		conflictPolicy: opts.Conflicts,
 	}
 	uiEvents := newUiEvents()
 
@@ -28,6 +37,7 @@ func Run(roots []string, lc *lifecycle.Lifecycle, fsys fs.FS) {
 			rootPath:   root,
 			rootFolder: rootFolder,
 			curFolder:  rootFolder,
+			free:       -1,
 		}
 		rootFolder.archive = archive
 		app.archives = append(app.archives, archive)
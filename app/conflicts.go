@@ -0,0 +1,282 @@
+package app
+
+import (
+	"arc/fs"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// ConflictPolicy decides what happens to a file in the way of a resolution:
+// a file with other content at the path the resolution needs, or at a folder
+// on the way to it.
+type ConflictPolicy int
+
+const (
+	SuffixPolicy ConflictPolicy = iota // rename it to name`1.ext
+	FolderPolicy                       // move it to the archive's conflicts folder
+	NewerPolicy                        // keep the newer of the two, the older goes to the trash
+	AskPolicy                          // ask each time
+)
+
+var conflictPolicies = []ConflictPolicy{SuffixPolicy, FolderPolicy, NewerPolicy, AskPolicy}
+
+// conflictsFolderFormat names the folders FolderPolicy moves files into. The
+// milliseconds keep two resolutions within the same second apart.
+const conflictsFolderFormat = "2006-01-02T15-04-05.000"
+
+func ParseConflictPolicy(name string) (ConflictPolicy, error) {
+	for _, policy := range conflictPolicies {
+		if policy.String() == name {
+			return policy, nil
+		}
+	}
+	return SuffixPolicy, fmt.Errorf("unknown conflict policy %q", name)
+}
+
+func (policy ConflictPolicy) String() string {
+	switch policy {
+	case SuffixPolicy:
+		return "suffix"
+	case FolderPolicy:
+		return "folder"
+	case NewerPolicy:
+		return "newer"
+	case AskPolicy:
+		return "ask"
+	}
+	return fmt.Sprintf("ConflictPolicy(%d)", int(policy))
+}
+
+type (
+	// conflict is a file a resolution moved out of its way, or kept.
+	conflict struct {
+		root    string
+		path    string
+		policy  ConflictPolicy
+		outcome string
+	}
+
+	// question is a conflict waiting for the user to pick a policy.
+	question struct {
+		occupant *file
+		incoming *file
+	}
+)
+
+func conflictKey(root string, path []string) string {
+	return root + "\x00" + strings.Join(path, "/")
+}
+
+// clearPath makes room for the source at its path in the archive. It reports
+// whether the path is free now.
+func (app *appState) clearPath(archive *archive, source *file) bool {
+	path := source.fullPath()
+	folder := archive.rootFolder
+	var occupant *file
+	for _, name := range path {
+		child := folder.findChild(name)
+		if child == nil {
+			return true
+		}
+		if child.folder == nil {
+			occupant = child
+			break
+		}
+		folder = child
+		occupant = child
+	}
+	if occupant == nil {
+		return true
+	}
+
+	policy := app.conflictPolicy
+	if decision, ok := app.decisions[conflictKey(archive.rootPath, occupant.fullPath())]; ok {
+		policy = decision
+	}
+	if policy == AskPolicy && app.planning != nil {
+		app.planning.questions = append(app.planning.questions, question{occupant: occupant, incoming: source})
+		return false
+	}
+	// Keeping the newer one only makes sense for two versions of a file.
+	if policy == NewerPolicy && (occupant.folder != nil || len(occupant.fullPath()) != len(path)) {
+		policy = SuffixPolicy
+	}
+
+	occupantPath := filepath.Join(occupant.fullPath()...)
+	parent := occupant.parent
+	record := conflict{root: archive.rootPath, path: occupantPath, policy: policy}
+	switch policy {
+	case FolderPolicy:
+		at := time.Now()
+		if app.planning != nil {
+			at = app.planning.at
+		}
+		target := filepath.Join(fs.ConflictsDir, at.Format(conflictsFolderFormat), occupantPath)
+		app.rename(archive.rootPath, occupantPath, target, occupant.size)
+		parent.deleteFile(occupant)
+		record.outcome = "moved to " + target
+
+	case NewerPolicy:
+		if occupant.modTime.After(source.modTime) {
+			record.outcome = "kept, newer than the copy in " + source.archive.rootPath
+			app.recordConflict(record)
+			return false
+		}
+		app.remove(archive.rootPath, occupantPath, occupant.size)
+		parent.deleteFile(occupant)
+		record.outcome = "moved to the trash, older than the copy in " + source.archive.rootPath
+
+	default:
+		newName := parent.uniqueName(occupant.name)
+		newPath := slices.Clone(occupant.fullPath())
+		newPath[len(newPath)-1] = newName
+		app.rename(archive.rootPath, occupantPath, filepath.Join(newPath...), occupant.size)
+		parent.deleteFile(occupant)
+		occupant.name = newName
+		parent.addChild(occupant)
+		record.policy = SuffixPolicy
+		record.outcome = "renamed to " + newName
+	}
+	app.recordConflict(record)
+	return true
+}
+
+func (app *appState) recordConflict(record conflict) {
+	if app.planning != nil {
+		app.planning.conflicts = append(app.planning.conflicts, record)
+		return
+	}
+	app.conflicts = append(app.conflicts, record)
+}
+
+func (app *appState) handleQuestionKey(event *tcell.EventKey) {
+	plan := app.plan
+	question := plan.questions[0]
+	decision := map[string]ConflictPolicy{"Rune[s]": SuffixPolicy, "Rune[f]": FolderPolicy, "Rune[n]": NewerPolicy}
+	switch event.Name() {
+	case "Rune[s]", "Rune[f]", "Rune[n]":
+		if app.decisions == nil {
+			app.decisions = map[string]ConflictPolicy{}
+		}
+		occupant := question.occupant
+		app.decisions[conflictKey(occupant.archive.rootPath, occupant.fullPath())] = decision[event.Name()]
+		app.plan = app.buildPlan(plan.archive, plan.path, plan.action)
+	case "Esc":
+		app.plan = nil
+		app.decisions = nil
+	case "Ctrl+C":
+		app.fs.Quit()
+	}
+}
+
+func (app *appState) questionView(b *builder) {
+	question := app.plan.questions[0]
+	occupant, incoming := question.occupant, question.incoming
+	lines := app.screenHeight - 4
+
+	b.style(styleBreadcrumbs)
+	b.text(" Conflict in "+occupant.archive.rootPath, flex(1))
+	b.newLine()
+
+	b.style(styleFolderHeader)
+	b.text(" ", width(11))
+	b.text("   Document", width(20), flex(1))
+	b.text("   Date Modified", width(22))
+	b.text(fmt.Sprintf("%19s", "Size"))
+	b.text(" ")
+	b.newLine()
+
+	rows := 0
+	for _, row := range []struct {
+		label string
+		file  *file
+	}{{" Existing", occupant}, {" Incoming", incoming}} {
+		b.style(stylePlanLine)
+		b.text(row.label, width(11))
+		b.text("   "+filepath.Join(row.file.fullPath()...), width(20), flex(1))
+		b.text(row.file.modTime.Format(modTimeFormat))
+		b.text(formatSize(row.file.size))
+		b.text(" ")
+		b.newLine()
+		rows++
+	}
+	b.style(styleDefault)
+	for ; rows < lines; rows++ {
+		b.text("", flex(1))
+		b.newLine()
+	}
+}
+
+func (app *appState) questionStatusLine(b *builder) {
+	defer b.newLine()
+
+	b.style(styleArchive)
+	b.text(fmt.Sprintf(" Conflicts to decide: %d", len(app.plan.questions)), flex(1))
+	b.text(" S Suffix  F Conflicts Folder  N Keep Newer  Esc Cancel ")
+}
+
+func (app *appState) handleConflictsKey(event *tcell.EventKey) {
+	lines := app.screenHeight - 4
+	switch event.Name() {
+	case "Up":
+		app.conflictsOffset--
+	case "Down":
+		app.conflictsOffset++
+	case "PgUp":
+		app.conflictsOffset -= lines
+	case "PgDn":
+		app.conflictsOffset += lines
+	case "Rune[p]":
+		idx := slices.Index(conflictPolicies, app.conflictPolicy)
+		app.conflictPolicy = conflictPolicies[(idx+1)%len(conflictPolicies)]
+	case "Esc", "Ctrl+K":
+		app.viewingConflicts = false
+	case "Ctrl+C":
+		app.fs.Quit()
+	}
+}
+
+func (app *appState) conflictsView(b *builder) {
+	lines := app.screenHeight - 4
+	app.conflictsOffset = max(min(app.conflictsOffset, len(app.conflicts)-lines), 0)
+
+	b.style(styleBreadcrumbs)
+	b.text(" Conflicts", flex(1))
+	b.newLine()
+
+	b.style(styleFolderHeader)
+	b.text(" Policy", width(8))
+	b.text(" Document", width(20), flex(1))
+	b.text(" Outcome", width(20), flex(1))
+	b.newLine()
+
+	rows := 0
+	for i := len(app.conflicts) - 1 - app.conflictsOffset; i >= 0 && rows < lines; i-- {
+		conflict := app.conflicts[i]
+		b.style(stylePlanLine)
+		b.text(" "+conflict.policy.String(), width(8))
+		b.text(" "+filepath.Join(conflict.root, conflict.path), width(20), flex(1))
+		b.text(" "+conflict.outcome, width(20), flex(1))
+		b.newLine()
+		rows++
+	}
+	b.style(styleDefault)
+	for ; rows < lines; rows++ {
+		b.text("", flex(1))
+		b.newLine()
+	}
+}
+
+func (app *appState) conflictsStatusLine(b *builder) {
+	defer b.newLine()
+
+	b.style(styleArchive)
+	b.text(" Policy: ")
+	b.text(app.conflictPolicy.String(), flex(1))
+	b.text(" P Change Policy  Esc Back ")
+}
@@ -0,0 +1,81 @@
+package app
+
+import (
+	"arc/fs"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// addFile adds a regular file at the slash separated path of the archive.
+func addFile(arc *archive, path string, modTime time.Time) *file {
+	dir, name := parseName(path)
+	folder := arc.getFile(dir)
+	file := &file{archive: arc, name: name, kind: fs.RegularFile, modTime: modTime, hash: path, parent: folder}
+	folder.addChild(file)
+	return file
+}
+
+func TestClearPath(t *testing.T) {
+	older, newer := time.Now().Add(-time.Hour), time.Now()
+	tests := []struct {
+		name     string
+		policy   ConflictPolicy
+		decision *ConflictPolicy
+		occupant string // path in the target archive, empty for none
+		modTime  time.Time
+		cleared  bool
+		calls    []string // <time> stands for the conflicts folder name
+	}{
+		{"free path", SuffixPolicy, nil, "", older, true, nil},
+		{"suffix", SuffixPolicy, nil, "docs/x", older, true, []string{"rename /b docs/x docs/x`1"}},
+		{"suffix on the way", SuffixPolicy, nil, "docs", older, true, []string{"rename /b docs docs`1"}},
+		{"folder", FolderPolicy, nil, "docs/x", older, true, []string{"rename /b docs/x .arc-conflicts/<time>/docs/x"}},
+		{"newer replaces older", NewerPolicy, nil, "docs/x", older, true, []string{"delete /b docs/x"}},
+		{"newer keeps newer", NewerPolicy, nil, "docs/x", newer.Add(time.Hour), false, nil},
+		{"newer on the way", NewerPolicy, nil, "docs", older, true, []string{"rename /b docs docs`1"}},
+		{"ask", AskPolicy, nil, "docs/x", older, false, nil},
+		{"asked", AskPolicy, ptr(FolderPolicy), "docs/x", older, true, []string{"rename /b docs/x .arc-conflicts/<time>/docs/x"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := &recordingFS{}
+			source, target := &archive{rootPath: "/a"}, &archive{rootPath: "/b"}
+			app := &appState{fs: recorder, archives: []*archive{source, target}, conflictPolicy: test.policy}
+			for _, arc := range app.archives {
+				arc.rootFolder = &file{archive: arc, kind: fs.Directory, folder: &folder{}}
+			}
+			incoming := addFile(source, "docs/x", newer)
+			if test.occupant != "" {
+				addFile(target, test.occupant, test.modTime)
+			}
+			if test.decision != nil {
+				app.decisions = map[string]ConflictPolicy{conflictKey("/b", parsePath(test.occupant)): *test.decision}
+			}
+			if test.policy == AskPolicy && test.decision == nil {
+				app.planning = &plan{}
+			}
+
+			if cleared := app.clearPath(target, incoming); cleared != test.cleared {
+				t.Errorf("cleared %v, expected %v", cleared, test.cleared)
+			}
+			if len(recorder.calls) != len(test.calls) {
+				t.Fatalf("calls %q, expected %q", recorder.calls, test.calls)
+			}
+			for i, call := range test.calls {
+				pattern := strings.ReplaceAll(regexp.QuoteMeta(call), "<time>", `\d{4}-\d\d-\d\dT\d\d-\d\d-\d\d\.\d{3}`)
+				if !regexp.MustCompile("^" + pattern + "$").MatchString(recorder.calls[i]) {
+					t.Errorf("call %q, expected %q", recorder.calls[i], call)
+				}
+			}
+			if asked := app.planning != nil && len(app.planning.questions) > 0; asked != (test.policy == AskPolicy && test.decision == nil) {
+				t.Errorf("asked %v", asked)
+			}
+		})
+	}
+}
+
+func ptr[T any](value T) *T {
+	return &value
+}
@@ -0,0 +1,42 @@
+package app
+
+import (
+	"arc/fs"
+	"slices"
+	"testing"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+func TestDryRun(t *testing.T) {
+	tests := []struct {
+		name   string
+		key    *tcell.EventKey
+		plan   bool
+		dryRun bool
+		calls  []string
+	}{
+		{"confirm", tcell.NewEventKey(tcell.KeyEnter, 0, tcell.ModNone), true, false, []string{"batch", "copy /a x /b"}},
+		{"confirm in a dry run", tcell.NewEventKey(tcell.KeyEnter, 0, tcell.ModNone), true, true, nil},
+		{"scrub", tcell.NewEventKey(tcell.KeyCtrlS, 0, tcell.ModCtrl), false, false, []string{"scrub /a"}},
+		{"scrub in a dry run", tcell.NewEventKey(tcell.KeyCtrlS, 0, tcell.ModCtrl), false, true, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := &recordingFS{}
+			arc := &archive{rootPath: "/a", archiveState: archiveHashed}
+			app := &appState{fs: recorder, archives: []*archive{arc}, curArchive: arc, dryRun: test.dryRun}
+			root := &file{archive: arc, kind: fs.Directory, folder: &folder{}}
+			arc.rootFolder, arc.curFolder = root, root
+			if test.plan {
+				app.plan = app.buildPlan(arc, nil, func(*file) {
+					app.issue(&operation{kind: copyOperation, root: "/a", path: "x", hash: "h", toRoots: []string{"/b"}})
+				})
+			}
+			app.handleKeyEvent(test.key)
+			if !slices.Equal(recorder.calls, test.calls) {
+				t.Errorf("calls %q, expected %q", recorder.calls, test.calls)
+			}
+		})
+	}
+}
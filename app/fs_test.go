@@ -0,0 +1,49 @@
+package app
+
+import (
+	"arc/fs"
+	"arc/log"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	log.SetLogger(filepath.Join(os.TempDir(), "arc-test-app.log"))
+	os.Exit(m.Run())
+}
+
+// recordingFS records the commands the app issues.
+type recordingFS struct {
+	calls []string
+}
+
+func (fs *recordingFS) record(format string, args ...any) {
+	fs.calls = append(fs.calls, fmt.Sprintf(format, args...))
+}
+
+func (fs *recordingFS) Events() <-chan fs.Event { return nil }
+func (fs *recordingFS) Scan(root string)        { fs.record("scan %s", root) }
+func (fs *recordingFS) Copy(path, hash, fromRoot string, toRoots ...string) {
+	fs.record("copy %s %s %s", fromRoot, path, strings.Join(toRoots, " "))
+}
+func (fs *recordingFS) Rename(root, sourcePath, targetPath string) {
+	fs.record("rename %s %s %s", root, sourcePath, targetPath)
+}
+func (fs *recordingFS) Delete(root, path string) { fs.record("delete %s %s", root, path) }
+func (fs *recordingFS) Scrub(root string)        { fs.record("scrub %s", root) }
+func (fs *recordingFS) Verify(root, path string) { fs.record("verify %s %s", root, path) }
+func (fs *recordingFS) Trash(root string)        { fs.record("trash %s", root) }
+func (fs *recordingFS) Restore(root, batch, path string) {
+	fs.record("restore %s %s %s", root, batch, path)
+}
+func (fs *recordingFS) Purge(root, batch, path string) {
+	fs.record("purge %s %s %s", root, batch, path)
+}
+func (fs *recordingFS) Batch() { fs.record("batch") }
+func (fs *recordingFS) Recover(root, batch string, forward bool) {
+	fs.record("recover %s %s %v", root, batch, forward)
+}
+func (fs *recordingFS) Quit() { fs.record("quit") }
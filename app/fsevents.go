@@ -6,49 +6,147 @@ import (
 )
 
 func (app *appState) handleFsEvent(event fs.Event) {
+	app.invalidatePlan(event)
 	switch event := event.(type) {
 	case fs.FileMeta:
 		archive := app.archive(event.Root)
 		path, name := parseName(event.Path)
-		incoming := &file{
-			archive: archive,
-			name:    name,
-			size:    event.Size,
-			modTime: event.ModTime,
-			hash:    event.Hash,
-			state:   scanned,
+		folder := archive.getFile(path)
+		incoming := folder.findChild(name)
+		if incoming == nil {
+			incoming = &file{
+				archive: archive,
+				name:    name,
+				parent:  folder,
+			}
+			folder.addChild(incoming)
 		}
+		incoming.kind = event.Kind
+		incoming.target = event.Target
+		incoming.inode = event.Inode
+		incoming.links = event.Links
+		incoming.size = event.Size
+		incoming.modTime = event.ModTime
+		incoming.mode = event.Mode
+		incoming.uid = event.UID
+		incoming.gid = event.GID
+		incoming.xattrs = event.Xattrs
+		incoming.hash = event.Hash
+		incoming.state = scanned
 		if event.Hash != "" {
 			incoming.state = hashed
 		}
-		folder := archive.getFile(path)
-		folder.children = append(folder.children, incoming)
-		incoming.parent = folder
+		archive.hashMode = event.HashMode
+		archive.algorithm = event.Algorithm
 		folder.sorted = false
 
 	case fs.FileHashed:
-		file := app.archive(event.Root).findFile(parsePath(event.Path))
+		archive := app.archive(event.Root)
+		file := archive.findFile(parsePath(event.Path))
+		if file == nil {
+			return
+		}
 		file.hash = event.Hash
 		file.state = hashed
-		app.archive(event.Root).archiveState = archiveScanned
+		archive.hashMode = event.HashMode
+		archive.algorithm = event.Algorithm
+		if archive.archiveState == archiveStarted {
+			archive.archiveState = archiveScanned
+		}
+		// The initial hashing is analyzed once, on ArchiveHashed.
+		if archive.archiveState == archiveHashed {
+			app.analyze()
+		}
 
 	case fs.ArchiveHashed:
 		app.archive(event.Root).archiveState = archiveHashed
 		app.analyze()
 
 	case fs.CopyProgress:
-		file := app.archive(event.Root).findFile(parsePath(event.Path))
+		// Copies rolled forward by a recovery may come from roots that are
+		// not open.
+		archive := app.archive(event.Root)
+		if archive == nil || archive.findFile(parsePath(event.Path)) == nil {
+			return
+		}
+		file := archive.findFile(parsePath(event.Path))
 		file.state = copying
 		file.copied = event.Copyed
 
+	case fs.CopyFailed:
+		// A failed repair leaves the corrupted file in place.
+		archive := app.archive(event.Root)
+		if file := archive.findFile(parsePath(event.Path)); file != nil && !file.corrupted {
+			archive.deleteFile(file)
+		}
+
 	case fs.Copied:
-		file := app.archive(event.FromRoot).findFile(parsePath(event.Path))
+		// Copies that failed verification are gone from their archives by now,
+		// so the file counts as copied only if every copy is still there.
+		path := parsePath(event.Path)
+		fromArchive := app.archive(event.FromRoot)
+		if fromArchive == nil || fromArchive.findFile(path) == nil {
+			app.analyze()
+			return
+		}
+		file := fromArchive.findFile(path)
 		file.state = copied
 		file.copied = file.size
+		for _, root := range event.ToRoots {
+			archive := app.archive(root)
+			archive.needed = max(archive.needed-file.size, 0)
+		}
+		for _, root := range event.ToRoots {
+			if app.archive(root).findFile(path) == nil {
+				file.state = hashed
+				file.copying = 0
+				file.copied = 0
+				break
+			}
+		}
+		app.analyze()
+
+	case fs.Corrupted:
+		archive := app.archive(event.Root)
+		if file := archive.findFile(parsePath(event.Path)); file != nil {
+			file.corrupted = true
+			file.state = corrupted
+		}
 		app.analyze()
 
-	case fs.Renamed, fs.Deleted:
+	case fs.FileVerified:
+		archive := app.archive(event.Root)
+		if file := archive.findFile(parsePath(event.Path)); file != nil && file.corrupted {
+			file.corrupted = false
+			file.unrepaired = false
+			app.analyze()
+		}
+
+	case fs.ArchiveScrubbed:
+		app.archive(event.Root).scrubbing = false
+
+	case fs.DiskSpace:
+		app.archive(event.Root).free = event.Free
+
+	case fs.Renamed:
+		app.archive(event.Root).moveFile(parsePath(event.SourcePath), parsePath(event.TargetPath))
 		app.analyze()
+
+	case fs.Deleted:
+		if event.Batch != "" {
+			app.journal.trashed(event.Root, event.Path, event.Batch)
+		}
+		archive := app.archive(event.Root)
+		if file := archive.findFile(parsePath(event.Path)); file != nil {
+			archive.deleteFile(file)
+		}
+		app.analyze()
+
+	case fs.TrashEntry, fs.TrashListed, fs.Restored, fs.Purged:
+		app.handleTrashEvent(event)
+
+	case fs.IncompleteBatch, fs.BatchRecovered:
+		app.handleRecoveryEvent(event)
 	}
 }
 
@@ -59,10 +157,17 @@ func (app *appState) analyze() {
 		}
 	}
 
+	// Hard links to the same inode take no extra space and are counted once.
+	type link struct {
+		archive int
+		inode   uint64
+	}
+	countedLinks := map[link]bool{}
 	countsByHash := map[string][]int{}
 	copyingInProgress := false
 	for i, arc := range app.archives {
 		arc.nDivergents = 0
+		arc.nMetaDiffers = 0
 		arc.rootFolder.walk(func(_ int, file *file) handleResult {
 			if file.state == pending || file.state == copying {
 				copyingInProgress = true
@@ -75,21 +180,35 @@ func (app *appState) analyze() {
 				}
 			}
 			path := file.fullPath()
+			metaDiffer := false
 			for j, otherArc := range app.archives {
 				if i == j {
 					continue
 				}
 				otherFile := otherArc.findFile(path)
-				if otherFile == nil || otherFile.hash != file.hash {
+				if otherFile == nil || otherFile.hash != file.hash || otherFile.kind != file.kind {
 					file.state = divergent
 					arc.nDivergents++
 					break
 				}
+				if app.checkMetadata && !file.sameMetadata(otherFile) {
+					metaDiffer = true
+				}
+			}
+			if metaDiffer && file.state != divergent && file.state != pending {
+				file.state = metaDiffers
+				arc.nMetaDiffers++
 			}
-			file.counts = countsByHash[file.hash]
+			file.counts = countsByHash[file.countsKey()]
 			if file.counts == nil {
 				file.counts = make([]int, len(app.archives))
-				countsByHash[file.hash] = file.counts
+				countsByHash[file.countsKey()] = file.counts
+			}
+			if file.links > 1 {
+				if countedLinks[link{i, file.inode}] {
+					return advance
+				}
+				countedLinks[link{i, file.inode}] = true
 			}
 			file.counts[i]++
 			return advance
@@ -97,18 +216,30 @@ func (app *appState) analyze() {
 	}
 
 	for i, arc := range app.archives {
+		arc.nCorrupted = 0
+		arc.nUnrepaired = 0
 		arc.rootFolder.walk(func(_ int, file *file) handleResult {
 			if !copyingInProgress && file.state == copied {
 				file.state = hashed
 				file.copying = 0
 				file.copied = 0
 			}
+			if file.corrupted {
+				file.state = corrupted
+				arc.nCorrupted++
+				if file.unrepaired {
+					arc.nUnrepaired++
+				}
+				return advance
+			}
 			if file.state == divergent {
 				return advance
 			}
-			counts := countsByHash[file.hash][i]
+			counts := countsByHash[file.countsKey()][i]
 			if counts > 1 {
 				file.state = duplicate
+			} else if file.links > 1 && file.state == hashed {
+				file.state = linked
 			}
 			return advance
 		})
@@ -0,0 +1,78 @@
+package app
+
+import (
+	"arc/fs"
+	"os"
+	"testing"
+)
+
+func TestSymlinkDivergence(t *testing.T) {
+	tests := []struct {
+		name             string
+		targetA, targetB string
+		divergent        bool
+	}{
+		{"same target", "x", "x", false},
+		{"other target", "x", "y", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			app := &appState{}
+			for _, root := range []string{"/a", "/b"} {
+				arc := &archive{rootPath: root}
+				arc.rootFolder = &file{archive: arc, kind: fs.Directory, folder: &folder{}}
+				arc.curFolder = arc.rootFolder
+				app.archives = append(app.archives, arc)
+			}
+			for i, target := range []string{test.targetA, test.targetB} {
+				root := app.archives[i].rootPath
+				app.handleFsEvent(fs.FileMeta{Root: root, Path: "link", Kind: fs.Symlink, Target: target, Hash: "symlink:" + target})
+				app.handleFsEvent(fs.ArchiveHashed{Root: root})
+			}
+			for _, arc := range app.archives {
+				link := arc.findFile([]string{"link"})
+				if divergent := link.state == divergent; divergent != test.divergent {
+					t.Errorf("%s: divergent %v, expected %v", arc.rootPath, divergent, test.divergent)
+				}
+			}
+		})
+	}
+}
+
+func TestMetadataDivergence(t *testing.T) {
+	tests := []struct {
+		name         string
+		check        bool
+		modeB        os.FileMode
+		xattrsB      string
+		metaDiffers  bool
+		nMetaDiffers int
+	}{
+		{"same metadata", true, 0644, "", false, 0},
+		{"other mode", true, 0600, "", true, 1},
+		{"other xattrs", true, 0644, "x", true, 1},
+		{"not checked", false, 0600, "x", false, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			app := &appState{checkMetadata: test.check}
+			for _, root := range []string{"/a", "/b"} {
+				arc := &archive{rootPath: root}
+				arc.rootFolder = &file{archive: arc, kind: fs.Directory, folder: &folder{}}
+				arc.curFolder = arc.rootFolder
+				app.archives = append(app.archives, arc)
+			}
+			app.handleFsEvent(fs.FileMeta{Root: "/a", Path: "x", Size: 1, Mode: 0644, Hash: "h"})
+			app.handleFsEvent(fs.FileMeta{Root: "/b", Path: "x", Size: 1, Mode: test.modeB, Xattrs: test.xattrsB, Hash: "h"})
+			for _, arc := range app.archives {
+				app.handleFsEvent(fs.ArchiveHashed{Root: arc.rootPath})
+			}
+			for _, arc := range app.archives {
+				x := arc.findFile([]string{"x"})
+				if differs := x.state == metaDiffers; differs != test.metaDiffers || arc.nMetaDiffers != test.nMetaDiffers {
+					t.Errorf("%s: state %v with %d differing, expected metadata differing %v with %d", arc.rootPath, x.state, arc.nMetaDiffers, test.metaDiffers, test.nMetaDiffers)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package app
+
+import (
+	"arc/log"
+	"slices"
+)
+
+// journal records the operations issued during the session, grouped in
+// batches by the user action that issued them, so the latest batch can be
+// undone. The tree is not touched by an undo: the events of the inverse
+// operations bring it up to date the same way they do for changes made
+// outside of arc.
+type journal struct {
+	batches [][]*operation
+}
+
+type (
+	operation struct {
+		kind       operationKind
+		root       string
+		path       string
+		targetPath string   // rename
+		hash       string   // copy and repair
+		toRoots    []string // copy and repair
+		size       int
+		batch      string // delete: the trash batch holding the file, once reported
+	}
+
+	operationKind int
+)
+
+const (
+	renameOperation operationKind = iota
+	copyOperation
+	deleteOperation
+	repairOperation
+)
+
+func (op *operation) same(other *operation) bool {
+	return op.kind == other.kind && op.root == other.root && op.path == other.path && op.targetPath == other.targetPath &&
+		op.hash == other.hash && slices.Equal(op.toRoots, other.toRoots) && op.size == other.size
+}
+
+// begin starts a new batch. Batches left empty are dropped.
+func (journal *journal) begin() {
+	if n := len(journal.batches); n > 0 && len(journal.batches[n-1]) == 0 {
+		return
+	}
+	journal.batches = append(journal.batches, nil)
+}
+
+func (journal *journal) record(op *operation) {
+	if len(journal.batches) == 0 {
+		journal.begin()
+	}
+	n := len(journal.batches) - 1
+	journal.batches[n] = append(journal.batches[n], op)
+}
+
+// trashed remembers the trash batch of the latest delete of the path.
+func (journal *journal) trashed(root, path, batch string) {
+	for i := len(journal.batches) - 1; i >= 0; i-- {
+		for j := len(journal.batches[i]) - 1; j >= 0; j-- {
+			op := journal.batches[i][j]
+			if op.kind == deleteOperation && op.root == root && op.path == path && op.batch == "" {
+				op.batch = batch
+				return
+			}
+		}
+	}
+}
+
+func (journal *journal) pop() []*operation {
+	for len(journal.batches) > 0 {
+		n := len(journal.batches) - 1
+		batch := journal.batches[n]
+		journal.batches = journal.batches[:n]
+		if len(batch) > 0 {
+			return batch
+		}
+	}
+	return nil
+}
+
+func (app *appState) rename(root, sourcePath, targetPath string, size int) {
+	app.issue(&operation{kind: renameOperation, root: root, path: sourcePath, targetPath: targetPath, size: size})
+}
+
+func (app *appState) copy(path, hash, fromRoot string, size int, toRoots ...string) {
+	app.issue(&operation{kind: copyOperation, root: fromRoot, path: path, hash: hash, size: size, toRoots: slices.Clone(toRoots)})
+}
+
+func (app *appState) remove(root, path string, size int) {
+	app.issue(&operation{kind: deleteOperation, root: root, path: path, size: size})
+}
+
+// issue adds the operation to the plan being built or, outside of planning,
+// executes it right away.
+func (app *appState) issue(op *operation) {
+	if app.planning != nil {
+		app.planning.ops = append(app.planning.ops, op)
+		return
+	}
+	app.execute(op)
+}
+
+// execute is the only place operations reach the file system. Repairs are not
+// journaled: there is nothing worth getting back in the corrupted file.
+func (app *appState) execute(op *operation) {
+	switch op.kind {
+	case renameOperation:
+		app.fs.Rename(op.root, op.path, op.targetPath)
+	case copyOperation:
+		app.fs.Copy(op.path, op.hash, op.root, op.toRoots...)
+	case deleteOperation:
+		app.fs.Delete(op.root, op.path)
+	case repairOperation:
+		app.fs.Copy(op.path, op.hash, op.root, op.toRoots...)
+		for _, root := range op.toRoots {
+			app.fs.Verify(root, op.path)
+		}
+		return
+	}
+	app.journal.record(op)
+}
+
+// undo issues the inverse operations of the latest batch in reverse order.
+// Copies are undone by moving them to the trash.
+func (app *appState) undo() {
+	batch := app.journal.pop()
+	if len(batch) > 0 {
+		app.fs.Batch()
+	}
+	for i := len(batch) - 1; i >= 0; i-- {
+		op := batch[i]
+		switch op.kind {
+		case renameOperation:
+			app.fs.Rename(op.root, op.targetPath, op.path)
+		case copyOperation:
+			for _, root := range op.toRoots {
+				app.fs.Delete(root, op.path)
+			}
+		case deleteOperation:
+			if op.batch == "" {
+				log.Debug("undo: delete not confirmed", "root", op.root, "path", op.path)
+				continue
+			}
+			app.fs.Restore(op.root, op.batch, op.path)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package app
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestUndo(t *testing.T) {
+	tests := []struct {
+		name   string
+		issue  func(app *appState)
+		undone []string
+	}{
+		{"nothing to undo", func(app *appState) {}, nil},
+		{"reverse order", func(app *appState) {
+			app.journal.begin()
+			app.rename("/a", "x", "y", 1)
+			app.copy("y", "h", "/a", 1, "/b", "/c")
+		}, []string{"batch", "delete /b y", "delete /c y", "rename /a y x"}},
+		{"latest batch only", func(app *appState) {
+			app.journal.begin()
+			app.rename("/a", "x", "y", 1)
+			app.journal.begin()
+			app.rename("/a", "z", "w", 1)
+		}, []string{"batch", "rename /a w z"}},
+		{"empty batches dropped", func(app *appState) {
+			app.journal.begin()
+			app.rename("/a", "x", "y", 1)
+			app.journal.begin()
+			app.journal.begin()
+		}, []string{"batch", "rename /a y x"}},
+		{"trashed delete", func(app *appState) {
+			app.journal.begin()
+			app.remove("/a", "x", 1)
+			app.journal.trashed("/a", "x", "t1")
+		}, []string{"batch", "restore /a t1 x"}},
+		{"unconfirmed delete", func(app *appState) {
+			app.journal.begin()
+			app.remove("/a", "x", 1)
+		}, []string{"batch"}},
+		{"repeated delete", func(app *appState) {
+			app.journal.begin()
+			app.remove("/a", "x", 1)
+			app.journal.trashed("/a", "x", "t1")
+			app.journal.begin()
+			app.remove("/a", "x", 1)
+			app.journal.trashed("/a", "x", "t2")
+		}, []string{"batch", "restore /a t2 x"}},
+		{"repair not journaled", func(app *appState) {
+			app.journal.begin()
+			app.execute(&operation{kind: repairOperation, root: "/a", path: "x", hash: "h", toRoots: []string{"/b"}})
+		}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := &recordingFS{}
+			app := &appState{fs: recorder}
+			test.issue(app)
+			recorder.calls = nil
+			app.undo()
+			if !slices.Equal(recorder.calls, test.undone) {
+				t.Errorf("undone with %q, expected %q", recorder.calls, test.undone)
+			}
+		})
+	}
+}
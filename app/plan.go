@@ -0,0 +1,407 @@
+package app
+
+import (
+	"arc/fs"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// plan holds the operations an action would issue and the tree they would
+// leave behind. The action runs against a copy of the tree, so nothing
+// changes until the plan is confirmed. On confirmation it runs again against
+// a fresh copy, which keeps the changes that arrived meanwhile, and that copy
+// replaces the tree.
+type plan struct {
+	archive *archive // where the action started
+	path    []string // what the action was started on
+	action  func(source *file)
+	at      time.Time // when the action was started, which names its conflicts folder
+	ops     []*operation
+	trees   []plannedTree
+	lines   []planLine
+	stale   bool // the archives changed since the plan was built
+	offset  int
+
+	touched []plannedPath   // what the plan reads or writes
+	hashes  map[string]bool // the contents it copies
+
+	conflicts []conflict // files the operations move out of the way, or keep
+	questions []question // conflicts waiting for a policy
+}
+
+type plannedTree struct {
+	rootFolder *file
+	curFolder  *file
+	needed     int
+	refused    int
+}
+
+// plannedPath is a path the plan depends on in the root, or in every archive
+// if root is empty. An empty path stands for the whole archive.
+type plannedPath struct {
+	root string
+	path string
+}
+
+type planLine struct {
+	text   string
+	size   int
+	header bool
+}
+
+var (
+	stylePlanHeader = tcell.StyleDefault.Foreground(tcell.Color226).Background(tcell.Color17).Bold(true)
+	stylePlanLine   = tcell.StyleDefault.Foreground(tcell.Color250).Background(tcell.Color17)
+)
+
+// propose plans the action on the source. A plan with no operations and
+// nothing to ask is applied right away, otherwise it waits for the user.
+func (app *appState) propose(source *file, action func(source *file)) {
+	if source == nil {
+		return
+	}
+	var path []string
+	if source.parent != nil {
+		path = source.fullPath()
+	}
+	plan := app.buildPlan(source.archive, path, action)
+	if len(plan.ops) == 0 && len(plan.questions) == 0 && !app.dryRun {
+		app.adopt(plan)
+		return
+	}
+	app.plan = plan
+}
+
+func (app *appState) buildPlan(archive *archive, path []string, action func(source *file)) *plan {
+	return app.runPlan(&plan{archive: archive, path: path, action: action, at: time.Now()})
+}
+
+// runPlan runs the action of the plan against a copy of the current tree.
+func (app *appState) runPlan(plan *plan) *plan {
+	saved := make([]plannedTree, len(app.archives))
+	copies := map[*file]*file{}
+	counts := map[*int][]int{}
+	for i, arc := range app.archives {
+		saved[i] = plannedTree{rootFolder: arc.rootFolder, curFolder: arc.curFolder, needed: arc.needed, refused: arc.refused}
+		arc.rootFolder = arc.rootFolder.cloneTree(arc, nil, copies, counts)
+		arc.curFolder = copies[arc.curFolder]
+	}
+
+	app.planning = plan
+	if source := plan.archive.findFile(plan.path); source != nil {
+		plan.action(source)
+	}
+	app.planning = nil
+
+	plan.trees = make([]plannedTree, len(app.archives))
+	for i, arc := range app.archives {
+		plan.trees[i] = plannedTree{rootFolder: arc.rootFolder, curFolder: arc.curFolder, needed: arc.needed, refused: arc.refused}
+		arc.rootFolder, arc.curFolder, arc.needed, arc.refused = saved[i].rootFolder, saved[i].curFolder, saved[i].needed, saved[i].refused
+	}
+	plan.lines = app.planLines(plan.ops)
+	plan.dependencies()
+	return plan
+}
+
+// dependencies records what the plan was built from: the subtree the action
+// started on in every archive, the paths its operations and conflicts name
+// and the contents it copies, which a file hashed later could provide
+// without a copy.
+func (plan *plan) dependencies() {
+	plan.touched = []plannedPath{{path: filepath.Join(plan.path...)}}
+	plan.hashes = map[string]bool{}
+	for _, op := range plan.ops {
+		plan.touched = append(plan.touched, plannedPath{op.root, op.path})
+		switch op.kind {
+		case renameOperation:
+			plan.touched = append(plan.touched, plannedPath{op.root, op.targetPath})
+		case copyOperation, repairOperation:
+			for _, root := range op.toRoots {
+				plan.touched = append(plan.touched, plannedPath{root, op.path})
+			}
+			plan.hashes[op.hash] = true
+		}
+	}
+	for _, conflict := range plan.conflicts {
+		plan.touched = append(plan.touched, plannedPath{conflict.root, conflict.path})
+	}
+	for _, question := range plan.questions {
+		occupant := question.occupant
+		plan.touched = append(plan.touched, plannedPath{occupant.archive.rootPath, filepath.Join(occupant.fullPath()...)})
+	}
+}
+
+// touches reports whether the plan depends on the path in the root. A path
+// depends on the folders above it and everything below it.
+func (plan *plan) touches(root string, paths ...string) bool {
+	for _, touched := range plan.touched {
+		if touched.root != "" && touched.root != root {
+			continue
+		}
+		for _, path := range paths {
+			if touched.path == "" || related(touched.path, path) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func related(a, b string) bool {
+	sep := string(filepath.Separator)
+	return a == b || strings.HasPrefix(a, b+sep) || strings.HasPrefix(b, a+sep)
+}
+
+// confirm runs the action again against the tree as it is now and, if it
+// issues the operations the user reviewed, adopts the result. A stale plan,
+// or one whose operations came out differently, is shown again for review.
+func (app *appState) confirm(reviewed *plan) {
+	if reviewed.stale {
+		app.plan = app.buildPlan(reviewed.archive, reviewed.path, reviewed.action)
+		return
+	}
+	fresh := app.runPlan(&plan{archive: reviewed.archive, path: reviewed.path, action: reviewed.action, at: reviewed.at})
+	if len(fresh.questions) > 0 || !slices.EqualFunc(fresh.ops, reviewed.ops, (*operation).same) {
+		app.plan = fresh
+		return
+	}
+	app.adopt(fresh)
+}
+
+// adopt replaces the tree with the planned one and executes the operations.
+func (app *appState) adopt(plan *plan) {
+	app.plan = nil
+	app.decisions = nil
+	app.conflicts = append(app.conflicts, plan.conflicts...)
+	for i, arc := range app.archives {
+		tree := plan.trees[i]
+		arc.rootFolder, arc.curFolder, arc.needed, arc.refused = tree.rootFolder, tree.curFolder, tree.needed, tree.refused
+	}
+	if len(plan.ops) > 0 {
+		app.journal.begin()
+		app.fs.Batch()
+	}
+	for _, op := range plan.ops {
+		app.execute(op)
+	}
+	app.analyze()
+}
+
+// invalidatePlan marks the pending plan stale when an event changes a part
+// of the tree the plan was built from. Changes elsewhere, like the hashing
+// of other folders, leave it alone.
+func (app *appState) invalidatePlan(event fs.Event) {
+	plan := app.plan
+	if plan == nil {
+		return
+	}
+	switch event := event.(type) {
+	case fs.FileMeta:
+		plan.stale = plan.stale || plan.touches(event.Root, event.Path) || plan.hashes[event.Hash]
+	case fs.FileHashed:
+		plan.stale = plan.stale || plan.touches(event.Root, event.Path) || plan.hashes[event.Hash]
+	case fs.Copied:
+		plan.stale = plan.stale || plan.touches(event.FromRoot, event.Path)
+		for _, root := range event.ToRoots {
+			plan.stale = plan.stale || plan.touches(root, event.Path)
+		}
+	case fs.CopyFailed:
+		plan.stale = plan.stale || plan.touches(event.Root, event.Path)
+	case fs.Corrupted:
+		plan.stale = plan.stale || plan.touches(event.Root, event.Path)
+	case fs.Renamed:
+		plan.stale = plan.stale || plan.touches(event.Root, event.SourcePath, event.TargetPath)
+	case fs.Deleted:
+		plan.stale = plan.stale || plan.touches(event.Root, event.Path)
+	}
+}
+
+// cloneTree copies the file and everything below it. Files sharing counts
+// keep sharing them in the copy.
+func (f *file) cloneTree(archive *archive, parent *file, copies map[*file]*file, counts map[*int][]int) *file {
+	clone := *f
+	clone.archive = archive
+	clone.parent = parent
+	copies[f] = &clone
+	if len(f.counts) > 0 {
+		key := &f.counts[0]
+		if _, ok := counts[key]; !ok {
+			counts[key] = slices.Clone(f.counts)
+		}
+		clone.counts = counts[key]
+	}
+	if f.folder != nil {
+		folder := *f.folder
+		folder.children = make(files, len(f.children))
+		folder.byName = nil
+		folder.sortAscending = slices.Clone(f.sortAscending)
+		clone.folder = &folder
+		for i, child := range f.children {
+			folder.children[i] = child.cloneTree(archive, &clone, copies, counts)
+		}
+		folder.selected = copies[f.selected]
+	}
+	return &clone
+}
+
+// planLines lists the operations grouped by archive and kind, each group
+// headed by its byte total.
+func (app *appState) planLines(ops []*operation) []planLine {
+	kinds := []operationKind{renameOperation, copyOperation, repairOperation, deleteOperation}
+	var lines []planLine
+	for _, arc := range app.archives {
+		for _, kind := range kinds {
+			var group []planLine
+			total := 0
+			for _, op := range ops {
+				if op.kind != kind || !op.touches(arc.rootPath) {
+					continue
+				}
+				group = append(group, planLine{text: "    " + op.String(), size: op.size})
+				total += op.size
+			}
+			if len(group) == 0 {
+				continue
+			}
+			header := fmt.Sprintf(" %s: %s %d", arc.rootPath, kind, len(group))
+			lines = append(lines, planLine{text: header, size: total, header: true})
+			lines = append(lines, group...)
+		}
+	}
+	return lines
+}
+
+// touches reports whether the operation changes the archive.
+func (op *operation) touches(root string) bool {
+	switch op.kind {
+	case copyOperation, repairOperation:
+		return slices.Contains(op.toRoots, root)
+	}
+	return op.root == root
+}
+
+func (op *operation) String() string {
+	switch op.kind {
+	case renameOperation:
+		return op.path + " → " + op.targetPath
+	case copyOperation, repairOperation:
+		return op.path + " ← " + op.root
+	}
+	return op.path
+}
+
+func (kind operationKind) String() string {
+	switch kind {
+	case renameOperation:
+		return "Rename"
+	case copyOperation:
+		return "Copy"
+	case deleteOperation:
+		return "Delete"
+	case repairOperation:
+		return "Repair"
+	}
+	panic("invalid operation kind")
+}
+
+func (app *appState) handlePlanKey(event *tcell.EventKey) {
+	plan := app.plan
+	if len(plan.questions) > 0 {
+		app.handleQuestionKey(event)
+		return
+	}
+	lines := app.screenHeight - 4
+	switch event.Name() {
+	case "Up":
+		plan.offset--
+	case "Down":
+		plan.offset++
+	case "PgUp":
+		plan.offset -= lines
+	case "PgDn":
+		plan.offset += lines
+	case "Home":
+		plan.offset = 0
+	case "End":
+		plan.offset = len(plan.lines)
+	case "Enter":
+		if !app.dryRun {
+			app.confirm(plan)
+		}
+	case "Esc":
+		app.plan = nil
+		app.decisions = nil
+	case "Ctrl+C":
+		app.fs.Quit()
+	}
+}
+
+func (app *appState) planView(b *builder) {
+	plan := app.plan
+	lines := app.screenHeight - 4
+	plan.offset = max(min(plan.offset, len(plan.lines)-lines), 0)
+
+	b.style(styleBreadcrumbs)
+	if app.dryRun {
+		b.text(" Plan (dry run)", flex(1))
+	} else {
+		b.text(" Plan", flex(1))
+	}
+	b.newLine()
+
+	b.style(styleFolderHeader)
+	b.text(" Operation", width(20), flex(1))
+	b.text(fmt.Sprintf("%19s", "Size"))
+	b.text(" ")
+	b.newLine()
+
+	rows := 0
+	for i := plan.offset; i < len(plan.lines) && rows < lines; i++ {
+		line := plan.lines[i]
+		if line.header {
+			b.style(stylePlanHeader)
+		} else {
+			b.style(stylePlanLine)
+		}
+		b.text(line.text, width(20), flex(1))
+		b.text(formatSize(line.size))
+		b.text(" ")
+		b.newLine()
+		rows++
+	}
+	b.style(styleDefault)
+	for ; rows < lines; rows++ {
+		b.text("", flex(1))
+		b.newLine()
+	}
+}
+
+func (app *appState) planStatusLine(b *builder) {
+	defer b.newLine()
+
+	b.style(styleArchive)
+	plan := app.plan
+	copied := 0
+	for _, op := range plan.ops {
+		if op.kind == copyOperation || op.kind == repairOperation {
+			copied += op.size * len(op.toRoots)
+		}
+	}
+	b.text(fmt.Sprintf(" Operations: %d", len(plan.ops)))
+	b.text(" To copy: ")
+	b.text(strings.TrimSpace(formatSize(copied)))
+	b.text(fmt.Sprintf(" Conflicts: %d (%s)", len(plan.conflicts), app.conflictPolicy), flex(1))
+	switch {
+	case app.dryRun:
+		b.text(" Esc Close ")
+	case plan.stale:
+		b.text(" Archives changed: Enter Re-plan  Esc Cancel ")
+	default:
+		b.text(" Enter Confirm  Esc Cancel ")
+	}
+}
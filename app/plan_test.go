@@ -0,0 +1,98 @@
+package app
+
+import (
+	"arc/fs"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestInvalidatePlan(t *testing.T) {
+	tests := []struct {
+		name  string
+		event fs.Event
+		stale bool
+	}{
+		{"hashed in the scope", fs.FileHashed{Root: "/b", Path: "docs/a/x", Hash: "h"}, true},
+		{"hashed elsewhere", fs.FileHashed{Root: "/b", Path: "photos/x", Hash: "h"}, false},
+		{"hashed with copied content", fs.FileHashed{Root: "/b", Path: "photos/x", Hash: "copied"}, true},
+		{"scanned in a copy target", fs.FileMeta{Root: "/b", Path: "docs/a/new"}, true},
+		{"scanned folder above the scope", fs.FileMeta{Root: "/c", Path: "docs"}, true},
+		{"renamed into a rename target", fs.Renamed{Root: "/a", SourcePath: "other", TargetPath: "old/target"}, true},
+		{"renamed in another root", fs.Renamed{Root: "/b", SourcePath: "other", TargetPath: "old/target"}, false},
+		{"deleted a kept conflict", fs.Deleted{Root: "/c", Path: "kept"}, true},
+		{"deleted elsewhere", fs.Deleted{Root: "/c", Path: "other"}, false},
+		{"copied elsewhere", fs.Copied{Path: "other", FromRoot: "/a", ToRoots: []string{"/b"}}, false},
+		{"copy failed in a copy target", fs.CopyFailed{Root: "/c", Path: "docs/a/new"}, true},
+		{"corrupted elsewhere", fs.Corrupted{Root: "/a", Path: "other"}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			plan := &plan{
+				path: []string{"docs", "a"},
+				ops: []*operation{
+					{kind: copyOperation, root: "/a", path: "docs/a/new", hash: "copied", toRoots: []string{"/b", "/c"}},
+					{kind: renameOperation, root: "/a", path: "old/source", targetPath: "old/target"},
+				},
+				conflicts: []conflict{{root: "/c", path: "kept"}},
+			}
+			plan.dependencies()
+			app := &appState{plan: plan}
+			app.invalidatePlan(test.event)
+			if plan.stale != test.stale {
+				t.Errorf("stale %v, expected %v", plan.stale, test.stale)
+			}
+		})
+	}
+
+	// A plan on the root folder depends on everything.
+	plan := &plan{}
+	plan.dependencies()
+	app := &appState{plan: plan}
+	app.invalidatePlan(fs.FileHashed{Root: "/b", Path: "photos/x", Hash: "h"})
+	if !plan.stale {
+		t.Error("a plan on the whole archive stayed fresh")
+	}
+}
+
+func TestConfirmKeepsLiveChanges(t *testing.T) {
+	recorder := &recordingFS{}
+	app := &appState{fs: recorder}
+	for _, root := range []string{"/a", "/b"} {
+		arc := &archive{rootPath: root, archiveState: archiveHashed}
+		arc.rootFolder = &file{archive: arc, kind: fs.Directory, folder: &folder{}}
+		arc.curFolder = arc.rootFolder
+		app.archives = append(app.archives, arc)
+	}
+	a, b := app.archives[0], app.archives[1]
+	app.curArchive = a
+	addFile(a, "docs/x", time.Time{})
+	addFile(b, "other/z", time.Time{})
+
+	app.plan = app.buildPlan(a, []string{"docs"}, func(*file) {
+		app.issue(&operation{kind: copyOperation, root: "/a", path: "docs/x", hash: "docs/x", toRoots: []string{"/b"}})
+		addFile(app.archives[1], "docs/x", time.Time{})
+	})
+	app.handleFsEvent(fs.FileMeta{Root: "/a", Path: "other/y", Kind: fs.RegularFile, Hash: "y"})
+	app.handleFsEvent(fs.Deleted{Root: "/b", Path: "other/z"})
+	if app.plan.stale {
+		t.Fatal("changes outside the plan made it stale")
+	}
+	app.confirm(app.plan)
+
+	if app.plan != nil {
+		t.Fatal("the plan was shown again")
+	}
+	if a.findFile([]string{"other", "y"}) == nil {
+		t.Error("the scanned file is gone")
+	}
+	if b.findFile([]string{"other", "z"}) != nil {
+		t.Error("the deleted file is back")
+	}
+	if b.findFile([]string{"docs", "x"}) == nil {
+		t.Error("the planned copy is missing")
+	}
+	if calls := []string{"batch", "copy /a docs/x /b"}; !slices.Equal(recorder.calls, calls) {
+		t.Errorf("calls %q, expected %q", recorder.calls, calls)
+	}
+}
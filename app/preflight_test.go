@@ -0,0 +1,51 @@
+package app
+
+import (
+	"arc/fs"
+	"slices"
+	"testing"
+)
+
+func TestPreflight(t *testing.T) {
+	tests := []struct {
+		name    string
+		free    []int // free space of /b and /c
+		needed  int   // already needed by earlier copies to /b
+		calls   []string
+		refused []int
+	}{
+		{"room everywhere", []int{1000, 1000}, 0, []string{"copy /a x /b /c"}, []int{0, 0, 0}},
+		{"no room in one", []int{50, 1000}, 0, []string{"copy /a x /c"}, []int{0, 100, 0}},
+		{"room taken by earlier copies", []int{150, 1000}, 100, []string{"copy /a x /c"}, []int{0, 100, 0}},
+		{"free space unknown", []int{-1, 1000}, 0, []string{"copy /a x /b /c"}, []int{0, 0, 0}},
+		{"no room anywhere", []int{50, 50}, 0, nil, []int{0, 100, 100}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := &recordingFS{}
+			app := &appState{fs: recorder}
+			for i, root := range []string{"/a", "/b", "/c"} {
+				arc := &archive{idx: i, rootPath: root, archiveState: archiveHashed, free: -1}
+				arc.rootFolder = &file{archive: arc, kind: fs.Directory, folder: &folder{}}
+				arc.curFolder = arc.rootFolder
+				app.archives = append(app.archives, arc)
+			}
+			a, b, c := app.archives[0], app.archives[1], app.archives[2]
+			app.curArchive = a
+			b.free, c.free = test.free[0], test.free[1]
+			b.needed = test.needed
+			x := &file{archive: a, name: "x", kind: fs.RegularFile, size: 100, hash: "h", state: divergent, counts: make([]int, 3), parent: a.rootFolder}
+			a.rootFolder.addChild(x)
+
+			app.preflightAndResolve(x)
+			if !slices.Equal(recorder.calls, test.calls) {
+				t.Errorf("calls %q, expected %q", recorder.calls, test.calls)
+			}
+			for i, arc := range app.archives {
+				if arc.refused != test.refused[i] {
+					t.Errorf("%s refused %d, expected %d", arc.rootPath, arc.refused, test.refused[i])
+				}
+			}
+		})
+	}
+}
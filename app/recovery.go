@@ -0,0 +1,124 @@
+package app
+
+import (
+	"arc/fs"
+	"fmt"
+	"slices"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// recovery offers the batches interrupted in an earlier session, one at a
+// time, to be rolled forward or back.
+type recovery struct {
+	batches []fs.IncompleteBatch
+	offset  int
+}
+
+func (app *appState) handleRecoveryEvent(event fs.Event) {
+	switch event := event.(type) {
+	case fs.IncompleteBatch:
+		app.recovery.batches = append(app.recovery.batches, event)
+
+	case fs.BatchRecovered:
+		app.recovery.batches = slices.DeleteFunc(app.recovery.batches, func(batch fs.IncompleteBatch) bool {
+			return batch.Root == event.Root && batch.Batch == event.Batch
+		})
+		app.analyze()
+	}
+}
+
+func (app *appState) handleRecoveryKey(event *tcell.EventKey) {
+	recovery := &app.recovery
+	batch := recovery.batches[0]
+	lines := app.screenHeight - 4
+	switch event.Name() {
+	case "Up":
+		recovery.offset--
+	case "Down":
+		recovery.offset++
+	case "PgUp":
+		recovery.offset -= lines
+	case "PgDn":
+		recovery.offset += lines
+	case "Rune[f]", "Rune[b]":
+		// Copies rolled forward report on files the archives must know by now.
+		if app.dryRun || app.state() != archiveHashed {
+			return
+		}
+		app.fs.Recover(batch.Root, batch.Batch, event.Name() == "Rune[f]")
+		recovery.batches = recovery.batches[1:]
+		recovery.offset = 0
+	case "Esc":
+		// The batch stays in the log and is offered again on the next start.
+		recovery.batches = recovery.batches[1:]
+		recovery.offset = 0
+	case "Ctrl+C":
+		app.fs.Quit()
+	}
+}
+
+func (app *appState) recoveryView(b *builder) {
+	recovery := &app.recovery
+	batch := recovery.batches[0]
+	lines := app.screenHeight - 4
+	recovery.offset = max(min(recovery.offset, len(batch.Operations)-lines), 0)
+
+	b.style(styleBreadcrumbs)
+	b.text(fmt.Sprintf(" Interrupted batch %s in %s", batch.Batch, batch.Root), flex(1))
+	b.newLine()
+
+	b.style(styleFolderHeader)
+	b.text(" State", width(11))
+	b.text(" Operation", width(20), flex(1))
+	b.newLine()
+
+	rows := 0
+	for i := recovery.offset; i < len(batch.Operations) && rows < lines; i++ {
+		op := batch.Operations[i]
+		b.style(stylePlanLine)
+		if op.Finished {
+			b.text(" Finished", width(11))
+		} else {
+			b.style(stylePlanHeader)
+			b.text(" Unfinished", width(11))
+		}
+		text := " " + op.Kind.String() + " " + op.Path
+		switch op.Kind {
+		case fs.RenameOperation:
+			text += " → " + op.TargetPath
+		case fs.CopyOperation:
+			text += " ← " + op.FromRoot
+		}
+		b.text(text, width(20), flex(1))
+		b.newLine()
+		rows++
+	}
+	b.style(styleDefault)
+	for ; rows < lines; rows++ {
+		b.text("", flex(1))
+		b.newLine()
+	}
+}
+
+func (app *appState) recoveryStatusLine(b *builder) {
+	defer b.newLine()
+
+	b.style(styleArchive)
+	batch := app.recovery.batches[0]
+	finished := 0
+	for _, op := range batch.Operations {
+		if op.Finished {
+			finished++
+		}
+	}
+	b.text(fmt.Sprintf(" Finished %d of %d", finished, len(batch.Operations)), flex(1))
+	switch {
+	case app.dryRun:
+		b.text(" Esc Later ")
+	case app.state() != archiveHashed:
+		b.text(" Waiting for scans  Esc Later ")
+	default:
+		b.text(" F Roll Forward  B Roll Back  Esc Later ")
+	}
+}
@@ -1,7 +1,9 @@
 package app
 
 import (
+	"arc/fs"
 	"fmt"
+	"strings"
 
 	"github.com/gdamore/tcell/v2"
 )
@@ -61,9 +63,26 @@ func (app *appState) render(screen tcell.Screen) {
 	}
 
 	app.showTitle(b)
-	app.breadcrumbs(b)
-	app.folderView(b)
-	app.statusLine(b)
+	if app.plan != nil && len(app.plan.questions) > 0 {
+		app.questionView(b)
+		app.questionStatusLine(b)
+	} else if app.plan != nil {
+		app.planView(b)
+		app.planStatusLine(b)
+	} else if len(app.recovery.batches) > 0 {
+		app.recoveryView(b)
+		app.recoveryStatusLine(b)
+	} else if app.viewingTrash {
+		app.trashView(b)
+		app.trashStatusLine(b)
+	} else if app.viewingConflicts {
+		app.conflictsView(b)
+		app.conflictsStatusLine(b)
+	} else {
+		app.breadcrumbs(b)
+		app.folderView(b)
+		app.statusLine(b)
+	}
 
 	b.show(app.sync)
 	app.sync = false
@@ -74,6 +93,9 @@ func (app *appState) showTitle(b *builder) {
 	b.text(" Archive ")
 	b.style(styleArchive)
 	b.text(app.curArchive.rootPath, flex(1))
+	if app.curArchive.algorithm != "" {
+		b.text(fmt.Sprintf(" %s %s ", app.curArchive.algorithm, app.curArchive.hashMode))
+	}
 	b.newLine()
 }
 
@@ -153,12 +175,19 @@ func (app *appState) folderView(b *builder) {
 		}
 		b.style(style)
 		b.fileState(app.state(), file, width(11))
-		if file.folder == nil {
-			b.text("   ")
-		} else {
+		name := file.name
+		switch {
+		case file.folder != nil:
 			b.text(" ▶ ")
+		case file.kind == fs.Directory:
+			b.text(" ▷ ")
+		case file.kind == fs.Symlink:
+			b.text("   ")
+			name += " → " + file.target
+		default:
+			b.text("   ")
 		}
-		b.text(file.name, width(20), flex(1))
+		b.text(name, width(20), flex(1))
 		b.text(file.modTime.Format(modTimeFormat))
 		b.text(formatSize(file.size))
 		b.text(" ")
@@ -188,6 +217,10 @@ func fileStyle(file *file) tcell.Style {
 		fg = 214
 	case divergent:
 		fg = 196
+	case corrupted:
+		fg = 201
+	case metaDiffers:
+		fg = 141
 	}
 	return tcell.StyleDefault.Foreground(tcell.PaletteColor(fg)).Background(tcell.PaletteColor(17))
 }
@@ -214,13 +247,25 @@ func (app *appState) statusLine(b *builder) {
 		b.text(" ")
 		return
 	}
+	if archive.scrubbing {
+		b.text(" Scrubbing", flex(1))
+		return
+	}
 	switch app.state() {
 	case archiveStarted:
 		b.text(" Scanning other(s)", flex(1))
 	case archiveScanned:
 		b.text(" Hashing other(s)", flex(1))
 	case archiveHashed:
-		if archive.nDuplicates > 0 || archive.nDivergents > 0 {
+		if archive.nDuplicates > 0 || archive.nDivergents > 0 || archive.nCorrupted > 0 || archive.nMetaDiffers > 0 {
+			if archive.nCorrupted > 0 {
+				b.text(" Corrupted: ")
+				b.text(fmt.Sprintf("%d", archive.nCorrupted), styleArchive)
+				if archive.nUnrepaired > 0 {
+					b.text(" No healthy replica: ")
+					b.text(fmt.Sprintf("%d", archive.nUnrepaired), styleArchive)
+				}
+			}
 			if archive.nDivergents > 0 {
 				b.text(" Divergents: ")
 				b.text(fmt.Sprintf("%d", archive.nDivergents), styleArchive)
@@ -229,11 +274,27 @@ func (app *appState) statusLine(b *builder) {
 				b.text(" Duplicates: ")
 				b.text(fmt.Sprintf("%d", archive.nDuplicates), styleArchive)
 			}
+			if archive.nMetaDiffers > 0 {
+				b.text(" Metadata: ")
+				b.text(fmt.Sprintf("%d", archive.nMetaDiffers), styleArchive)
+			}
 			b.text("", flex(1))
 		} else {
 			b.text(" All Clear", flex(1))
 		}
 	}
+	if archive.refused > 0 {
+		b.text(" Not enough space, needs: ")
+		b.text(strings.TrimSpace(formatSize(archive.needed+archive.refused)), styleArchive)
+	} else if archive.needed > 0 {
+		b.text(" Needed: ")
+		b.text(strings.TrimSpace(formatSize(archive.needed)), styleArchive)
+	}
+	if archive.free >= 0 {
+		b.text(" Free: ")
+		b.text(strings.TrimSpace(formatSize(archive.free)), styleArchive)
+		b.text(" ")
+	}
 }
 
 func (b *builder) fileState(state archiveState, file *file, config config) {
@@ -273,12 +334,21 @@ func (b *builder) fileState(state archiveState, file *file, config config) {
 	case pending:
 		b.text(" Pending", config)
 
+	case linked:
+		b.text(" Hard Link", config)
+
+	case metaDiffers:
+		b.text(" Metadata", config)
+
 	case duplicate:
 		b.text(" Duplicates", config)
 
 	case divergent:
 		b.text(" Divergent", config)
 
+	case corrupted:
+		b.text(" Corrupted", config)
+
 	default:
 		panic("invalid file state")
 	}
@@ -0,0 +1,64 @@
+package app
+
+import (
+	"arc/fs"
+	"slices"
+	"testing"
+)
+
+func TestRepair(t *testing.T) {
+	tests := []struct {
+		name     string
+		replicas []string // the state of x in /b, /c and /d
+		calls    []string
+	}{
+		{"healthy replica", []string{"corrupted", "other", "healthy"}, []string{"copy /d x /a", "verify /a x"}},
+		{"first healthy replica", []string{"healthy", "missing", "healthy"}, []string{"copy /b x /a", "verify /a x"}},
+		{"no healthy replica", []string{"corrupted", "other", "missing"}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := &recordingFS{}
+			app := &appState{fs: recorder}
+			for i, root := range []string{"/a", "/b", "/c", "/d"} {
+				arc := &archive{idx: i, rootPath: root, archiveState: archiveHashed}
+				arc.rootFolder = &file{archive: arc, kind: fs.Directory, folder: &folder{}}
+				arc.curFolder = arc.rootFolder
+				app.archives = append(app.archives, arc)
+			}
+			states := append([]string{"corrupted"}, test.replicas...)
+			for i, state := range states {
+				if state == "missing" {
+					continue
+				}
+				arc := app.archives[i]
+				x := &file{archive: arc, name: "x", kind: fs.RegularFile, hash: "h", state: hashed, parent: arc.rootFolder}
+				switch state {
+				case "corrupted":
+					x.corrupted, x.state = true, corrupted
+				case "other":
+					x.hash = "other"
+				}
+				arc.rootFolder.addChild(x)
+			}
+
+			x := app.archives[0].findFile([]string{"x"})
+			app.repair(x)
+			if !slices.Equal(recorder.calls, test.calls) {
+				t.Errorf("calls %q, expected %q", recorder.calls, test.calls)
+			}
+			if x.unrepaired != (test.calls == nil) {
+				t.Errorf("unrepaired %v", x.unrepaired)
+			}
+			if test.calls == nil {
+				return
+			}
+
+			// The repaired copy is healthy once it verifies.
+			app.handleFsEvent(fs.FileVerified{Root: "/a", Path: "x"})
+			if x.corrupted || x.state == corrupted {
+				t.Errorf("still corrupted after the verification, state %v", x.state)
+			}
+		})
+	}
+}
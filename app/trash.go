@@ -0,0 +1,191 @@
+package app
+
+import (
+	"arc/fs"
+	"cmp"
+	"fmt"
+	"slices"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// trash lists the entries of an archive's trash, newest batch first.
+type trash struct {
+	entries     []fs.TrashEntry
+	listed      bool
+	selectedIdx int
+	offsetIdx   int
+}
+
+var styleTrashEntry = tcell.StyleDefault.Foreground(tcell.Color231).Background(tcell.Color17)
+
+func (app *appState) showTrash() {
+	archive := app.curArchive
+	archive.trash = trash{}
+	app.viewingTrash = true
+	app.fs.Trash(archive.rootPath)
+}
+
+func (app *appState) handleTrashEvent(event fs.Event) {
+	switch event := event.(type) {
+	case fs.TrashEntry:
+		archive := app.archive(event.Root)
+		archive.trash.entries = append(archive.trash.entries, event)
+
+	case fs.TrashListed:
+		archive := app.archive(event.Root)
+		archive.trash.listed = true
+		slices.SortFunc(archive.trash.entries, func(a, b fs.TrashEntry) int {
+			if a.Batch != b.Batch {
+				return cmp.Compare(b.Batch, a.Batch)
+			}
+			return cmp.Compare(a.Path, b.Path)
+		})
+
+	case fs.Restored:
+		app.archive(event.Root).trash.remove(event.Batch, event.Path)
+
+	case fs.Purged:
+		app.archive(event.Root).trash.remove(event.Batch, event.Path)
+	}
+}
+
+// remove drops the entry or, with an empty path, the whole batch.
+func (trash *trash) remove(batch, path string) {
+	trash.entries = slices.DeleteFunc(trash.entries, func(entry fs.TrashEntry) bool {
+		return entry.Batch == batch && (path == "" || entry.Path == path)
+	})
+}
+
+func (trash *trash) selected() *fs.TrashEntry {
+	if trash.selectedIdx < 0 || trash.selectedIdx >= len(trash.entries) {
+		return nil
+	}
+	return &trash.entries[trash.selectedIdx]
+}
+
+func (app *appState) handleTrashKey(event *tcell.EventKey) {
+	archive := app.curArchive
+	trash := &archive.trash
+	lines := app.screenHeight - 4
+	switch event.Name() {
+	case "Up":
+		trash.selectedIdx--
+		app.makeSelectedVisible = true
+
+	case "Down":
+		trash.selectedIdx++
+		app.makeSelectedVisible = true
+
+	case "PgUp":
+		trash.selectedIdx -= lines
+		trash.offsetIdx -= lines
+
+	case "PgDn":
+		trash.selectedIdx += lines
+		trash.offsetIdx += lines
+
+	case "Home":
+		trash.selectedIdx = 0
+		app.makeSelectedVisible = true
+
+	case "End":
+		trash.selectedIdx = len(trash.entries) - 1
+		app.makeSelectedVisible = true
+
+	case "Ctrl+R":
+		if entry := trash.selected(); entry != nil && !app.dryRun {
+			app.fs.Restore(archive.rootPath, entry.Batch, entry.Path)
+		}
+
+	case "Backspace2": // Ctrl+Delete
+		if entry := trash.selected(); entry != nil && !app.dryRun {
+			app.fs.Purge(archive.rootPath, entry.Batch, entry.Path)
+		}
+
+	case "Ctrl+B":
+		if entry := trash.selected(); entry != nil && !app.dryRun {
+			app.fs.Purge(archive.rootPath, entry.Batch, "")
+		}
+
+	case "Esc", "Ctrl+T":
+		app.viewingTrash = false
+
+	case "Ctrl+C":
+		app.fs.Quit()
+	}
+	trash.selectedIdx = max(min(trash.selectedIdx, len(trash.entries)-1), 0)
+}
+
+func (app *appState) trashView(b *builder) {
+	trash := &app.curArchive.trash
+	lines := app.screenHeight - 4
+
+	if trash.offsetIdx > len(trash.entries)-lines {
+		trash.offsetIdx = len(trash.entries) - lines
+	}
+	if app.makeSelectedVisible {
+		if trash.offsetIdx <= trash.selectedIdx-lines {
+			trash.offsetIdx = trash.selectedIdx + 1 - lines
+		}
+		if trash.offsetIdx > trash.selectedIdx {
+			trash.offsetIdx = trash.selectedIdx
+		}
+		app.makeSelectedVisible = false
+	}
+	trash.offsetIdx = max(trash.offsetIdx, 0)
+
+	b.style(styleBreadcrumbs)
+	b.text(" Trash", flex(1))
+	b.newLine()
+
+	b.style(styleFolderHeader)
+	b.text(" Deleted", width(25))
+	b.text("Document", width(20), flex(1))
+	b.text("   Date Modified", width(22))
+	b.text(fmt.Sprintf("%19s", "Size"))
+	b.text(" ")
+	b.newLine()
+
+	rows := 0
+	for i := trash.offsetIdx; i < len(trash.entries) && rows < lines; i++ {
+		entry := trash.entries[i]
+		style := styleTrashEntry
+		if i == trash.selectedIdx {
+			style = style.Background(tcell.Color20)
+		}
+		b.style(style)
+		b.text(" "+entry.Batch, width(25))
+		name := entry.Path
+		if entry.Kind == fs.Directory {
+			name += "/"
+		}
+		b.text(name, width(20), flex(1))
+		b.text(entry.ModTime.Format(modTimeFormat))
+		b.text(formatSize(entry.Size))
+		b.text(" ")
+		b.newLine()
+		rows++
+	}
+	b.style(styleDefault)
+	for ; rows < lines; rows++ {
+		b.text("", flex(1))
+		b.newLine()
+	}
+}
+
+func (app *appState) trashStatusLine(b *builder) {
+	defer b.newLine()
+
+	b.style(styleArchive)
+	trash := &app.curArchive.trash
+	switch {
+	case !trash.listed:
+		b.text(" Listing trash", flex(1))
+	case len(trash.entries) == 0:
+		b.text(" Trash is empty", flex(1))
+	default:
+		b.text(fmt.Sprintf(" Entries: %d", len(trash.entries)), flex(1))
+		b.text(" Ctrl+R Restore  Ctrl+Del Purge  Ctrl+B Purge Batch  Esc Back ")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"arc/fs"
 	"arc/lifecycle"
 	"fmt"
+	"os"
 	"slices"
 	"strings"
 	"time"
@@ -27,6 +28,18 @@ type (
 
 		makeSelectedVisible bool
 		sync                bool
+		checkMetadata       bool
+		viewingTrash        bool
+		journal             journal
+		plan                *plan // waiting for confirmation
+		planning            *plan // being built
+		dryRun              bool
+		recovery            recovery
+		conflictPolicy      ConflictPolicy
+		conflicts           []conflict                // every file moved or kept by a policy
+		decisions           map[string]ConflictPolicy // answers to the current plan's questions
+		viewingConflicts    bool
+		conflictsOffset     int
 	}
 
 	archive struct {
@@ -35,21 +48,41 @@ type (
 		rootFolder   *file
 		curFolder    *file
 		archiveState archiveState
+		hashMode     fs.HashMode
+		algorithm    string
 		nDuplicates  int
 		nDivergents  int
+		nCorrupted   int
+		nUnrepaired  int // corrupted files no other archive has a healthy copy of
+		nMetaDiffers int
+		scrubbing    bool
+		free         int // bytes available on the volume, -1 until reported
+		needed       int // bytes of copies queued to this archive
+		refused      int // bytes the last refused resolution needed
+		trash        trash
 	}
 
 	file struct {
-		archive *archive
-		name    string
-		size    int
-		modTime time.Time
-		hash    string
-		copying int
-		copied  int
-		state   fileState
-		parent  *file
-		counts  []int
+		archive    *archive
+		name       string
+		kind       fs.EntryKind
+		target     string
+		inode      uint64
+		links      int
+		size       int
+		modTime    time.Time
+		mode       os.FileMode
+		uid        int
+		gid        int
+		xattrs     string
+		hash       string
+		copying    int
+		copied     int
+		state      fileState
+		corrupted  bool // content no longer matches the recorded hash
+		unrepaired bool // the last repair found no healthy replica
+		parent     *file
+		counts     []int
 		*folder
 	}
 
@@ -57,6 +90,7 @@ type (
 
 	folder struct {
 		children      files
+		byName        map[string]*file // children by name, built on the first lookup
 		selected      *file
 		nFiles        int
 		nHashed       int
@@ -96,8 +130,11 @@ const (
 	pending
 	copying
 	copied
+	linked
+	metaDiffers
 	duplicate
 	divergent
+	corrupted
 )
 
 const (
@@ -161,10 +198,16 @@ func (s fileState) String() string {
 		return "copying"
 	case copied:
 		return "copied"
+	case linked:
+		return "linked"
+	case metaDiffers:
+		return "metaDiffers"
 	case duplicate:
 		return "duplicate"
 	case divergent:
 		return "divergent"
+	case corrupted:
+		return "corrupted"
 	}
 	panic("Invalid state")
 }
@@ -173,12 +216,21 @@ func (f *file) findChild(name string) *file {
 	if f.folder == nil {
 		return nil
 	}
-	for _, file := range f.children {
-		if file.name == name {
-			return file
+	if f.byName == nil {
+		f.byName = make(map[string]*file, len(f.children))
+		for _, child := range f.children {
+			f.byName[child.name] = child
 		}
 	}
-	return nil
+	return f.byName[name]
+}
+
+func (folder *folder) addChild(child *file) {
+	folder.children = append(folder.children, child)
+	if folder.byName != nil {
+		folder.byName[child.name] = child
+	}
+	folder.sorted = false
 }
 
 func (folder *file) getSelected() *file {
@@ -204,6 +256,13 @@ func (folder *file) getSelected() *file {
 
 func (parent *file) getChild(sub string) *file {
 	child := parent.findChild(sub)
+	if child != nil && child.folder == nil && child.kind == fs.Directory {
+		// An empty folder is getting its first entry.
+		child.hash = ""
+		child.folder = &folder{
+			sortAscending: []bool{true, true, true},
+		}
+	}
 	if child == nil {
 		child = &file{
 			archive: parent.archive,
@@ -214,8 +273,7 @@ func (parent *file) getChild(sub string) *file {
 				sortAscending: []bool{true, true, true},
 			},
 		}
-		parent.children = append(parent.children, child)
-		parent.sorted = false
+		parent.addChild(child)
 	}
 	return child
 }
@@ -243,8 +301,14 @@ func (f *file) clone(archive *archive) *file {
 	return &file{
 		archive: archive,
 		name:    f.name,
+		kind:    f.kind,
+		target:  f.target,
 		size:    f.size,
 		modTime: f.modTime,
+		mode:    f.mode,
+		uid:     f.uid,
+		gid:     f.gid,
+		xattrs:  f.xattrs,
 		hash:    f.hash,
 		copied:  f.copied,
 		state:   f.state,
@@ -252,6 +316,22 @@ func (f *file) clone(archive *archive) *file {
 	}
 }
 
+// sameMetadata reports whether the copies agree on what the copier preserves
+// besides the content.
+func (f *file) sameMetadata(other *file) bool {
+	return f.mode == other.mode && f.uid == other.uid && f.gid == other.gid && f.xattrs == other.xattrs &&
+		(f.kind != fs.RegularFile || f.modTime.Equal(other.modTime))
+}
+
+// countsKey groups files for counting copies and duplicates. Empty files,
+// empty folders and symlinks are only compared at the same path.
+func (f *file) countsKey() string {
+	if f.kind == fs.RegularFile && f.size > 0 {
+		return f.hash
+	}
+	return f.hash + "\x00" + strings.Join(f.fullPath(), "/")
+}
+
 func (f *file) path() (result []string) {
 	for f.parent != nil {
 		f = f.parent
@@ -294,7 +374,7 @@ func (folder *file) updateMetas() {
 		}
 		folder.updateMeta(child)
 	}
-	if folder.size == 0 && folder.parent != nil {
+	if len(folder.children) == 0 && folder.parent != nil {
 		folder.parent.deleteFile(folder)
 	}
 }
@@ -339,10 +419,27 @@ func (arc *archive) deleteFile(file *file) {
 	folder.deleteFile(file)
 }
 
+// moveFile applies a rename that happened outside of arc. Renames issued by
+// arc itself are already reflected in the tree and leave it unchanged.
+func (arc *archive) moveFile(sourcePath, targetPath []string) {
+	file := arc.findFile(sourcePath)
+	if file == nil || arc.findFile(targetPath) != nil {
+		return
+	}
+	arc.deleteFile(file)
+	folder := arc.getFile(targetPath[:len(targetPath)-1])
+	file.name = targetPath[len(targetPath)-1]
+	file.parent = folder
+	folder.addChild(file)
+}
+
 func (folder *folder) deleteFile(file *file) {
 	for childIdx, child := range folder.children {
 		if child == file {
 			folder.children = slices.Delete(folder.children, childIdx, childIdx+1)
+			if folder.byName[file.name] == file {
+				delete(folder.byName, file.name)
+			}
 			break
 		}
 	}
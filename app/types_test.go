@@ -0,0 +1,34 @@
+package app
+
+import (
+	"arc/fs"
+	"testing"
+	"time"
+)
+
+func TestFindChild(t *testing.T) {
+	arc := &archive{rootPath: "/a"}
+	arc.rootFolder = &file{archive: arc, kind: fs.Directory, folder: &folder{}}
+	x := addFile(arc, "docs/x", time.Time{})
+	if arc.findFile([]string{"docs", "x"}) != x {
+		t.Fatal("added file not found")
+	}
+	arc.moveFile([]string{"docs", "x"}, []string{"other", "y"})
+	if arc.findFile([]string{"docs", "x"}) != nil {
+		t.Error("moved file found at its old path")
+	}
+	if arc.findFile([]string{"other", "y"}) != x {
+		t.Error("moved file not found at its new path")
+	}
+	arc.deleteFile(x)
+	if arc.findFile([]string{"other", "y"}) != nil {
+		t.Error("deleted file found")
+	}
+
+	// Folders built by a clone index their own children.
+	clone := arc.rootFolder.cloneTree(arc, nil, map[*file]*file{}, map[*int][]int{})
+	addFile(arc, "other/z", time.Time{})
+	if clone.findChild("other").findChild("z") != nil {
+		t.Error("a file added to the tree shows in its clone")
+	}
+}
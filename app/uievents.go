@@ -4,7 +4,6 @@ import (
 	"arc/log"
 	"fmt"
 	"path/filepath"
-	"slices"
 	"strings"
 	"time"
 
@@ -33,6 +32,22 @@ func (app *appState) handleUiEvent(event tcell.Event) {
 
 func (app *appState) handleKeyEvent(event *tcell.EventKey) {
 	log.Debug("handleKeyEvent", "key", event.Name())
+	if app.plan != nil {
+		app.handlePlanKey(event)
+		return
+	}
+	if len(app.recovery.batches) > 0 {
+		app.handleRecoveryKey(event)
+		return
+	}
+	if app.viewingTrash {
+		app.handleTrashKey(event)
+		return
+	}
+	if app.viewingConflicts {
+		app.handleConflictsKey(event)
+		return
+	}
 	switch event.Name() {
 	case "Up":
 		folder := app.curArchive.curFolder
@@ -102,13 +117,26 @@ func (app *appState) handleKeyEvent(event *tcell.EventKey) {
 
 	case "Ctrl+R":
 		if app.state() == archiveHashed {
-			app.resolve(app.curArchive.curFolder.getSelected())
+			app.propose(app.curArchive.curFolder.getSelected(), app.preflightAndResolve)
 		}
 
 	case "Ctrl+A":
 		if app.state() == archiveHashed {
-			app.resolve(app.curArchive.curFolder)
+			app.propose(app.curArchive.curFolder, app.preflightAndResolve)
 		}
+	case "Ctrl+S":
+		if app.state() == archiveHashed && !app.curArchive.scrubbing && !app.dryRun {
+			app.curArchive.scrubbing = true
+			app.fs.Scrub(app.curArchive.rootPath)
+		}
+
+	case "Ctrl+T":
+		app.showTrash()
+
+	case "Ctrl+K":
+		app.viewingConflicts = true
+		app.conflictsOffset = 0
+
 	case "Tab":
 		_, next := app.findNeighbours()
 		if next != nil {
@@ -126,7 +154,18 @@ func (app *appState) handleKeyEvent(event *tcell.EventKey) {
 	case "Backspace2": // Ctrl+Delete
 		if app.state() == archiveHashed {
 			folder := app.curArchive.curFolder
-			app.delete(folder.getSelected())
+			if app.dryRun {
+				app.propose(folder.getSelected(), app.delete)
+			} else {
+				app.journal.begin()
+				app.fs.Batch()
+				app.delete(folder.getSelected())
+			}
+		}
+
+	case "Ctrl+Z":
+		if app.state() == archiveHashed {
+			app.undo()
 		}
 
 	case "F10":
@@ -150,6 +189,9 @@ func (app *appState) handleKeyEvent(event *tcell.EventKey) {
 }
 
 func (app *appState) handleMouseEvent(event *tcell.EventMouse) {
+	if app.plan != nil || len(app.recovery.batches) > 0 || app.viewingTrash || app.viewingConflicts {
+		return
+	}
 	xx, y := event.Position()
 	x := width(xx)
 	if event.Buttons() == 256 || event.Buttons() == 512 {
@@ -229,7 +271,7 @@ func (app *appState) findNeighbours() (prev, next *file) {
 }
 
 func (app *appState) resolve(source *file) {
-	if source.state != divergent {
+	if source.state != divergent && source.state != corrupted {
 		return
 	}
 	if source.folder != nil {
@@ -238,6 +280,10 @@ func (app *appState) resolve(source *file) {
 		}
 		return
 	}
+	if source.state == corrupted {
+		app.repair(source)
+		return
+	}
 
 	path := source.fullPath()
 	archives := []*archive{}
@@ -249,7 +295,12 @@ func (app *appState) resolve(source *file) {
 		if otherFile != nil && otherFile.hash == source.hash {
 			continue
 		}
-		app.clearPath(archive, source.fullPath())
+		if archive.refused > 0 {
+			continue
+		}
+		if !app.clearPath(archive, source) {
+			continue
+		}
 
 		renamed := false
 		archive.rootFolder.walk(func(_ int, child *file) handleResult {
@@ -258,10 +309,9 @@ func (app *appState) resolve(source *file) {
 				source.state = hashed
 				clone := source.clone(archive)
 				folder := archive.getFile(source.path())
-				folder.children = append(folder.children, clone)
+				folder.addChild(clone)
 				clone.parent = folder
-				folder.sorted = false
-				app.fs.Rename(archive.rootPath, filepath.Join(child.fullPath()...), filepath.Join(clone.fullPath()...))
+				app.rename(archive.rootPath, filepath.Join(child.fullPath()...), filepath.Join(clone.fullPath()...), child.size)
 				renamed = true
 				return stop
 			}
@@ -275,16 +325,16 @@ func (app *appState) resolve(source *file) {
 
 	if len(archives) > 0 {
 		for _, archive := range archives {
-			app.clearPath(archive, source.fullPath())
+			app.clearPath(archive, source)
 			clone := source.clone(archive)
 			folder := archive.getFile(source.path())
-			folder.children = append(folder.children, clone)
-			folder.sorted = false
+			folder.addChild(clone)
 			clone.parent = folder
 			clone.state = hashed
 			source.state = pending
 			source.copying = source.size
 			source.counts[archive.idx]++
+			archive.needed += source.size
 		}
 
 		roots := make([]string, len(archives))
@@ -292,54 +342,115 @@ func (app *appState) resolve(source *file) {
 			roots[i] = archives[i].rootPath
 		}
 
-		app.fs.Copy(filepath.Join(source.fullPath()...), source.hash, app.curArchive.rootPath, roots...)
+		app.copy(filepath.Join(source.fullPath()...), source.hash, app.curArchive.rootPath, source.size, roots...)
 	}
 }
 
-func (app *appState) delete(source *file) {
+func (app *appState) preflightAndResolve(source *file) {
+	app.preflight(source)
+	app.resolve(source)
+}
+
+// preflight adds up the bytes resolving the source would copy to each archive
+// and marks the archives without enough free space to take them, so resolve
+// leaves those archives alone.
+func (app *appState) preflight(source *file) {
+	needed := make([]int, len(app.archives))
+	app.neededSpace(source, needed, app.divergentHashes())
+	for i, archive := range app.archives {
+		archive.refused = 0
+		if archive.free >= 0 && needed[i] > 0 && archive.needed+needed[i] > archive.free {
+			archive.refused = needed[i]
+		}
+	}
+}
+
+// divergentHashes returns the hashes of the divergent files of every archive.
+func (app *appState) divergentHashes() []map[string]bool {
+	hashes := make([]map[string]bool, len(app.archives))
+	for i, archive := range app.archives {
+		hashes[i] = map[string]bool{}
+		archive.rootFolder.walk(func(_ int, child *file) handleResult {
+			if child.state == divergent {
+				hashes[i][child.hash] = true
+			}
+			return advance
+		})
+	}
+	return hashes
+}
+
+func (app *appState) neededSpace(source *file, needed []int, divergentHashes []map[string]bool) {
+	if source.state != divergent {
+		return
+	}
 	if source.folder != nil {
+		for _, child := range source.children {
+			app.neededSpace(child, needed, divergentHashes)
+		}
 		return
 	}
+
 	path := source.fullPath()
 	for _, archive := range app.archives {
-		file := archive.getFile(path)
-		if file != nil && file.hash == source.hash {
-			archive.deleteFile(file)
-			app.fs.Delete(filepath.Join(archive.rootPath, filepath.Join(file.fullPath()...)))
-			file.counts[archive.idx]--
+		if archive == source.archive {
+			continue
+		}
+		otherFile := archive.findFile(path)
+		if otherFile != nil && otherFile.hash == source.hash {
+			continue
+		}
+		// A divergent file with the same content gets renamed instead.
+		if divergentHashes[archive.idx][source.hash] {
+			continue
 		}
+		needed[archive.idx] += source.size
 	}
 }
 
-func (app *appState) clearPath(archive *archive, path []string) {
-	folder := archive.rootFolder
-	var child *file
-	for _, name := range path {
-		child = folder.findChild(name)
-		if child == nil {
-			return
-		}
-		if child.folder == nil {
-			newName := folder.uniqueName(child.name)
-			newPath := slices.Clone(child.fullPath())
-			newPath[len(newPath)-1] = newName
-			app.fs.Rename(archive.rootPath, filepath.Join(child.fullPath()...), filepath.Join(newPath...))
-			child.name = newName
-			folder.sorted = false
-			return
-		}
-		folder = child
+// repair overwrites a corrupted file with a copy from another archive that
+// still matches the recorded hash and then verifies the result. Without such
+// a copy the file stays corrupted and is counted in the status line.
+func (app *appState) repair(corrupted *file) {
+	path := corrupted.fullPath()
+	for _, archive := range app.archives {
+		if archive == corrupted.archive {
+			continue
+		}
+		healthy := archive.findFile(path)
+		if healthy == nil || healthy.kind != corrupted.kind || healthy.hash != corrupted.hash || healthy.corrupted {
+			continue
+		}
+		healthy.state = pending
+		healthy.copying = healthy.size
+		strPath := filepath.Join(path...)
+		app.issue(&operation{
+			kind:    repairOperation,
+			root:    archive.rootPath,
+			path:    strPath,
+			hash:    healthy.hash,
+			size:    healthy.size,
+			toRoots: []string{corrupted.archive.rootPath},
+		})
+		return
 	}
-	if child != nil && child.folder != nil {
-		folder = child.parent
-		newName := folder.uniqueName(child.name)
-		newPath := slices.Clone(child.fullPath())
-		newPath[len(newPath)-1] = newName
-		app.fs.Rename(archive.rootPath, filepath.Join(child.fullPath()...), filepath.Join(newPath...))
-		child.name = newName
-		folder.sorted = false
+	corrupted.unrepaired = true
+	app.analyze()
+}
+
+func (app *appState) delete(source *file) {
+	if source.folder != nil {
 		return
 	}
+	path := source.fullPath()
+	for _, archive := range app.archives {
+		file := archive.getFile(path)
+		if file != nil && file.hash == source.hash {
+			archive.deleteFile(file)
+			app.remove(archive.rootPath, filepath.Join(file.fullPath()...), file.size)
+			file.counts[archive.idx]--
+		}
+	}
 }
 
 func (folder *folder) uniqueName(name string) string {
@@ -3,40 +3,244 @@ package main
 import (
 	"arc/app"
 	"arc/fs"
+	"arc/fs/agent"
 	"arc/fs/filesys"
+	"arc/fs/memfs"
 	"arc/fs/mockfs"
+	"arc/fs/mux"
+	"arc/fs/tarfs"
 	"arc/lifecycle"
 	"arc/log"
+	"flag"
+	"fmt"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
 )
 
 func main() {
-	log.SetLogger("log-arc.log")
+	sim := flag.Bool("sim", false, "simulate archives with scanning")
+	sim2 := flag.Bool("sim2", false, "simulate archives without scanning")
+	hashMode := flag.String("hash", "sampled", "hash mode: sampled or full")
+	hasher := flag.String("algo", filesys.DefaultHasher, "hash algorithm: "+strings.Join(filesys.Hashers(), ", "))
+	hashWorkers := flag.Int("hash-workers", 1, "number of hashing workers per storage device")
+	watch := flag.Bool("watch", true, "watch archives for changes made outside of arc")
+	globalIgnore := flag.String("ignore", defaultGlobalIgnore(), "path to the .arcignore file applied to every archive")
+	copyLanes := flag.Int("copy-lanes", 1, "number of concurrent copies per destination device")
+	preserveMetadata := flag.Bool("preserve-metadata", false, "carry permissions, ownership, extended attributes and folder times over to copies")
+	checkMetadata := flag.Bool("check-metadata", false, "flag copies whose metadata differs while their content matches")
+	scrubLimit := flag.Int("scrub-limit", 0, "maximum GiB to verify per archive in one scrub, 0 for no limit")
+	trashDays := flag.Int("trash-days", 30, "days deleted files are kept in an archive's trash, 0 to keep them until purged")
+	dryRun := flag.Bool("dry-run", false, "show the plan of every action without ever executing it")
+	conflicts := flag.String("conflicts", "suffix", "what to do with a file in the way of a resolution: suffix, folder, newer or ask")
+	remoteArc := flag.String("remote-arc", "arc", "arc command to run on the hosts of agent://host/path and host:/path archives")
+	flag.Parse()
+
+	args := flag.Args()
+	agentMode := len(args) > 0 && args[0] == "agent"
+	if agentMode {
+		log.SetLogger("log-arc-agent.log")
+	} else {
+		log.SetLogger("log-arc.log")
+	}
 	defer log.CloseLogger()
 
+	scrubOnly := len(args) > 0 && args[0] == "scrub"
+	if scrubOnly {
+		args = args[1:]
+	}
+
 	var lc = lifecycle.New()
 	var paths []string
 	var fsys fs.FS
-	if len(os.Args) > 1 && (os.Args[1] == "-sim" || os.Args[1] == "-sim2") {
-		fsys = mockfs.NewFS(lc, os.Args[1] == "-sim")
+	if *sim || *sim2 {
+		fsys = mockfs.NewFS(lc, *sim)
 		paths = []string{"origin", "copy 1", "copy 2"}
 	} else {
-		paths = make([]string, len(os.Args)-1)
-		for i, path := range os.Args[1:] {
-			err := os.MkdirAll(path, 0755)
+		if !slices.Contains(filesys.Hashers(), *hasher) {
+			log.Debug("Invalid hash algorithm", "algorithm", *hasher)
+			panic("invalid hash algorithm " + *hasher)
+		}
+		opts := filesys.Options{
+			Hasher:           *hasher,
+			HashWorkers:      *hashWorkers,
+			Watch:            *watch,
+			GlobalIgnore:     *globalIgnore,
+			ScrubLimit:       *scrubLimit << 30,
+			CopyLanes:        *copyLanes,
+			PreserveMetadata: *preserveMetadata,
+			TrashRetention:   time.Duration(*trashDays) * 24 * time.Hour,
+			DryRun:           *dryRun,
+		}
+		var err error
+		opts.HashMode, err = fs.ParseHashMode(*hashMode)
+		if err != nil {
+			log.Debug("Invalid hash mode", "error", err)
+			panic(err)
+		}
+
+		if agentMode {
+			err := agent.Serve(filesys.NewFS(lc, opts), os.Stdin, os.Stdout)
 			if err != nil {
-				log.Debug("Failed to scan archives", "error", err)
-				panic(err)
+				log.Debug("Agent failed", "error", err)
+				log.CloseLogger()
+				os.Exit(1)
 			}
-			path, err := filesys.AbsPath(path)
-			paths[i] = path
+			return
+		}
+
+		backends := &backends{lc: lc, opts: opts, remoteArc: *remoteArc, agents: map[string]fs.FS{}}
+		routes := make([]mux.Route, len(args))
+		paths = make([]string, len(args))
+		for i, arg := range args {
+			route, err := backends.route(arg)
 			if err != nil {
 				log.Debug("Failed to scan archives", "error", err)
 				panic(err)
 			}
+			routes[i] = route
+			paths[i] = route.Root
 		}
-		fsys = filesys.NewFS(lc)
+		fsys = mux.NewFS(lc, routes)
 	}
 
-	app.Run(paths, lc, fsys)
+	if scrubOnly {
+		corrupted := scrub(paths, fsys)
+		log.CloseLogger()
+		if corrupted {
+			os.Exit(1)
+		}
+		return
+	}
+
+	conflictPolicy, err := app.ParseConflictPolicy(*conflicts)
+	if err != nil {
+		log.Debug("Invalid conflict policy", "error", err)
+		panic(err)
+	}
+	app.Run(paths, lc, fsys, app.Options{CheckMetadata: *checkMetadata, DryRun: *dryRun, Conflicts: conflictPolicy})
+}
+
+// agentFlags are the flags passed on to the agent of remote archives.
+var agentFlags = []string{"hash", "algo", "hash-workers", "watch", "ignore", "copy-lanes", "preserve-metadata", "scrub-limit", "trash-days", "dry-run"}
+
+// backends starts the backends of the archives as the first archive that
+// needs each one comes up. Archives share a backend per kind, and per host
+// for remote ones.
+type backends struct {
+	lc        *lifecycle.Lifecycle
+	opts      filesys.Options
+	remoteArc string
+	disk      fs.FS
+	mem       fs.FS
+	tar       fs.FS
+	agents    map[string]fs.FS
+}
+
+// route picks the backend of an archive by its scheme: mem://name,
+// tar://path, agent://host/path or host:/path, or a local path.
+func (b *backends) route(arg string) (mux.Route, error) {
+	if name, ok := strings.CutPrefix(arg, "mem://"); ok {
+		if b.mem == nil {
+			b.mem = memfs.NewFS(b.lc)
+		}
+		return mux.Route{Root: arg, BackendRoot: name, FS: b.mem}, nil
+	}
+	if path, ok := strings.CutPrefix(arg, "tar://"); ok {
+		path, err := filesys.AbsPath(path)
+		if err != nil {
+			return mux.Route{}, err
+		}
+		if b.tar == nil {
+			b.tar = tarfs.NewFS(b.lc, tarfs.Options{HashMode: b.opts.HashMode, Hasher: b.opts.Hasher})
+		}
+		return mux.Route{Root: "tar://" + path, BackendRoot: path, FS: b.tar}, nil
+	}
+	if host, path, ok := remoteArchive(arg); ok {
+		// ssh would read such a host as an option.
+		if strings.HasPrefix(host, "-") {
+			return mux.Route{}, fmt.Errorf("invalid host %q", host)
+		}
+		agentFS := b.agents[host]
+		if agentFS == nil {
+			// The agent gets the flags that configure its filesys.
+			agentArgs := []string{"--", host, b.remoteArc}
+			flag.Visit(func(f *flag.Flag) {
+				if slices.Contains(agentFlags, f.Name) {
+					agentArgs = append(agentArgs, "-"+f.Name+"="+f.Value.String())
+				}
+			})
+			agentArgs = append(agentArgs, "agent")
+			var err error
+			agentFS, err = agent.NewFS(b.lc, exec.Command("ssh", agentArgs...))
+			if err != nil {
+				return mux.Route{}, fmt.Errorf("failed to start the agent on %s: %w", host, err)
+			}
+			b.agents[host] = agentFS
+		}
+		return mux.Route{Root: arg, BackendRoot: path, FS: agentFS}, nil
+	}
+
+	if err := os.MkdirAll(arg, 0755); err != nil {
+		return mux.Route{}, err
+	}
+	path, err := filesys.AbsPath(arg)
+	if err != nil {
+		return mux.Route{}, err
+	}
+	if b.disk == nil {
+		b.disk = filesys.NewFS(b.lc, b.opts)
+	}
+	return mux.Route{Root: path, BackendRoot: path, FS: b.disk}, nil
+}
+
+// remoteArchive splits agent://host/path and host:/path archives into the
+// host and the path. Local paths with a colon, like backup:2024 or C:/foo,
+// stay local: the short form needs an absolute path and no local file by
+// the same name.
+func remoteArchive(arg string) (host, path string, ok bool) {
+	if rest, ok := strings.CutPrefix(arg, "agent://"); ok {
+		host, path, _ = strings.Cut(rest, "/")
+		return host, "/" + path, host != ""
+	}
+	host, path, ok = strings.Cut(arg, ":")
+	if !ok || host == "" || strings.Contains(host, "/") || !strings.HasPrefix(path, "/") || filepath.VolumeName(arg) != "" {
+		return "", "", false
+	}
+	if _, err := os.Lstat(arg); err == nil {
+		return "", "", false
+	}
+	return host, path, true
+}
+
+// scrub verifies the archives without the UI and prints corrupted files.
+func scrub(roots []string, fsys fs.FS) (corrupted bool) {
+	for _, root := range roots {
+		fsys.Scrub(root)
+	}
+	for remaining := len(roots); remaining > 0; {
+		switch event := (<-fsys.Events()).(type) {
+		case fs.Corrupted:
+			fmt.Println("Corrupted:", filepath.Join(event.Root, event.Path))
+			corrupted = true
+		case fs.Error:
+			fmt.Fprintln(os.Stderr, "Error:", event.Path, event.Error)
+		case fs.ArchiveScrubbed:
+			fmt.Println("Scrubbed:", event.Root)
+			remaining--
+		}
+	}
+	fsys.Quit()
+	return corrupted
+}
+
+func defaultGlobalIgnore() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "arc", "arcignore")
 }
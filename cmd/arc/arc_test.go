@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRemoteArchive(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "local:", "data"), 0755)
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+
+	tests := []struct {
+		arg        string
+		host, path string
+		remote     bool
+	}{
+		{"agent://host/data", "host", "/data", true},
+		{"agent://host", "host", "/", true},
+		{"agent:///data", "", "", false},
+		{"host:/data", "host", "/data", true},
+		{"user@host:/data", "user@host", "/data", true},
+		{"backup:2024", "", "", false},
+		{"C:foo", "", "", false},
+		{"host:relative/data", "", "", false},
+		{"local/host:/data", "", "", false},
+		{"/abs/host:/data", "", "", false},
+		{"host:/", "host", "/", true},
+		{"local:/data", "", "", false}, // a folder of the working directory
+	}
+	for _, test := range tests {
+		host, path, remote := remoteArchive(test.arg)
+		if remote != test.remote || remote && (host != test.host || path != test.path) {
+			t.Errorf("%s: %q %q %v, expected %q %q %v", test.arg, host, path, remote, test.host, test.path, test.remote)
+		}
+	}
+}
+
+func TestOptionHost(t *testing.T) {
+	b := &backends{}
+	for _, arg := range []string{"-oProxyCommand=touch:/data", "agent://-oProxyCommand=touch/data"} {
+		if _, err := b.route(arg); err == nil {
+			t.Errorf("%s: routed", arg)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package agent
+
+import (
+	"arc/fs"
+	"arc/fs/filesys"
+	"arc/lifecycle"
+	"arc/log"
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestMain turns the test binary into an agent when the test spawns it.
+func TestMain(m *testing.M) {
+	if os.Getenv("ARC_TEST_AGENT") != "" {
+		log.SetLogger(filepath.Join(os.TempDir(), "arc-test-agent.log"))
+		lc := lifecycle.New()
+		err := Serve(filesys.NewFS(lc, filesys.Options{Watch: false}), os.Stdin, os.Stdout)
+		log.CloseLogger()
+		if err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	log.SetLogger(filepath.Join(os.TempDir(), "arc-test-client.log"))
+	os.Exit(m.Run())
+}
+
+// startAgent runs the test binary as an agent.
+func startAgent(t *testing.T) fs.FS {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	cmd.Env = append(os.Environ(), "ARC_TEST_AGENT=1")
+	f, err := NewFS(lifecycle.New(), cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// nextEvent returns the next event of the agent, failing the test if it
+// takes too long.
+func nextEvent(t *testing.T, f fs.FS) fs.Event {
+	t.Helper()
+	select {
+	case event := <-f.Events():
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	return nil
+}
+
+func TestAgent(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "a"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f := startAgent(t)
+	defer f.Quit()
+	next := func() fs.Event { return nextEvent(t, f) }
+
+	f.Scan(root)
+	hashed := false
+	for done := false; !done; {
+		switch event := next().(type) {
+		case fs.FileHashed:
+			hashed = event.Root == root && event.Path == "a" && event.Hash != ""
+		case fs.ArchiveHashed:
+			done = true
+		case fs.Error:
+			t.Fatal(event.Error)
+		}
+	}
+	if !hashed {
+		t.Fatal("the agent did not hash the file")
+	}
+
+	f.Rename(root, "a", "b")
+	for {
+		if event, ok := next().(fs.Renamed); ok {
+			if event.SourcePath != "a" || event.TargetPath != "b" {
+				t.Fatalf("unexpected %#v", event)
+			}
+			break
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "b")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Errors cross the stream as their messages.
+	f.Rename(root, "missing", "c")
+	for {
+		if event, ok := next().(fs.Error); ok {
+			if event.Error == nil || event.Error.Error() == "" {
+				t.Fatalf("unexpected %#v", event)
+			}
+			break
+		}
+	}
+
+	// Files stream both ways.
+	streamer := f.(fs.Streamer)
+	reader, meta, err := streamer.Open(root, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil || string(content) != "content" || meta.Size != len(content) {
+		t.Fatalf("unexpected %q %#v %v", content, meta, err)
+	}
+	meta.Path = "c/d"
+	writer, err := streamer.Create(meta)
+	if err == nil {
+		writer.Write(content)
+		err = writer.Commit()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written, err := os.ReadFile(filepath.Join(root, "c", "d")); err != nil || string(written) != "content" {
+		t.Fatalf("unexpected %q %v", written, err)
+	}
+	if _, _, err := streamer.Open(root, "missing"); err == nil {
+		t.Fatal("opened a missing file")
+	}
+
+	// The app and the deferred cleanup may both quit.
+	f.Quit()
+}
+
+func TestSlowReader(t *testing.T) {
+	root := t.TempDir()
+	content := make([]byte, (chunkWindow+4)*chunkSize)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	os.WriteFile(filepath.Join(root, "big"), content, 0644)
+	os.WriteFile(filepath.Join(root, "a"), []byte("a"), 0644)
+
+	f := startAgent(t)
+	defer f.Quit()
+	f.Scan(root)
+	for {
+		if _, ok := nextEvent(t, f).(fs.ArchiveHashed); ok {
+			break
+		}
+	}
+
+	// The events keep flowing while nobody reads the opened file.
+	reader, _, err := f.(fs.Streamer).Open(root, "big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	f.Rename(root, "a", "b")
+	for {
+		if _, ok := nextEvent(t, f).(fs.Renamed); ok {
+			break
+		}
+	}
+
+	read, err := io.ReadAll(reader)
+	if err != nil || !bytes.Equal(read, content) {
+		t.Fatalf("read %d of %d bytes: %v", len(read), len(content), err)
+	}
+}
@@ -0,0 +1,413 @@
+package agent
+
+import (
+	"arc/fs"
+	"arc/lifecycle"
+	"arc/log"
+	"arc/stream"
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+var errAgentGone = errors.New("the agent is gone")
+
+type fsys struct {
+	lc       *lifecycle.Lifecycle
+	name     string
+	cmd      *exec.Cmd
+	stdin    io.WriteCloser
+	commands *stream.Stream[command]
+	events   chan fs.Event
+	quit     chan struct{}
+	quitOnce sync.Once
+
+	sendLock sync.Mutex
+	encoder  *gob.Encoder
+
+	sync.Mutex // guards the files and gone
+	nextID     int
+	opened     map[int]*openedFile
+	created    map[int]chan error
+	gone       bool
+	goneCh     chan struct{} // closed once the agent is gone
+}
+
+// openedFile receives the chunks of a file opened in the agent. The agent
+// never has more than chunkWindow of them in flight, so queueing them never
+// blocks the events.
+type openedFile struct {
+	meta    chan fs.FileMeta
+	err     chan error
+	chunks  chan chunk
+	started bool // the meta arrived and Open returned
+}
+
+// NewFS starts the agent command, for instance "ssh host arc agent", and
+// returns an fs.FS that hands everything to it.
+func NewFS(lc *lifecycle.Lifecycle, cmd *exec.Cmd) (fs.FS, error) {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stderr = stderr{}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	fs := &fsys{
+		lc:       lc,
+		name:     strings.Join(cmd.Args, " "),
+		cmd:      cmd,
+		stdin:    stdin,
+		commands: stream.NewStream[command]("agent"),
+		events:   make(chan fs.Event, 256),
+		quit:     make(chan struct{}),
+		encoder:  gob.NewEncoder(stdin),
+		opened:   map[int]*openedFile{},
+		created:  map[int]chan error{},
+		goneCh:   make(chan struct{}),
+	}
+	lc.Started()
+	go fs.run()
+	go fs.read(stdout)
+	return fs, nil
+}
+
+func (fs *fsys) Events() <-chan fs.Event {
+	return fs.events
+}
+
+func (fs *fsys) Scan(root string) {
+	fs.commands.Push(scan{Root: root})
+}
+
+func (fs *fsys) Copy(path, hash, fromRoot string, toRoots ...string) {
+	fs.commands.Push(copy{Path: path, Hash: hash, FromRoot: fromRoot, ToRoots: toRoots})
+}
+
+func (fs *fsys) Rename(root, sourcePath, targetPath string) {
+	fs.commands.Push(rename{Root: root, SourcePath: sourcePath, TargetPath: targetPath})
+}
+
+func (fs *fsys) Delete(root, path string) {
+	fs.commands.Push(deleteCmd{Root: root, Path: path})
+}
+
+func (fs *fsys) Scrub(root string) {
+	fs.commands.Push(scrub{Root: root})
+}
+
+func (fs *fsys) Verify(root, path string) {
+	fs.commands.Push(verify{Root: root, Path: path})
+}
+
+func (fs *fsys) Trash(root string) {
+	fs.commands.Push(trash{Root: root})
+}
+
+func (fs *fsys) Restore(root, batch, path string) {
+	fs.commands.Push(restore{Root: root, Batch: batch, Path: path})
+}
+
+func (fs *fsys) Purge(root, batch, path string) {
+	fs.commands.Push(purge{Root: root, Batch: batch, Path: path})
+}
+
+func (fs *fsys) Batch() {
+	fs.commands.Push(newBatch{})
+}
+
+func (fs *fsys) Recover(root, batch string, forward bool) {
+	fs.commands.Push(recovery{Root: root, Batch: batch, Forward: forward})
+}
+
+// Quit tells the agent to quit. Calls after the first do nothing.
+func (fs *fsys) Quit() {
+	fs.quitOnce.Do(func() {
+		fs.commands.Push(quit{})
+		fs.commands.Close()
+		close(fs.quit)
+		fs.lc.Stop()
+	})
+}
+
+// Open streams a file from the agent. The chunks share the stream with the
+// events; the credits keep a reader that falls behind from holding the
+// events back.
+func (f *fsys) Open(root, path string) (io.ReadCloser, fs.FileMeta, error) {
+	file := &openedFile{meta: make(chan fs.FileMeta, 1), err: make(chan error, 1), chunks: make(chan chunk, chunkWindow)}
+	id, err := f.register(func(id int) { f.opened[id] = file })
+	if err == nil {
+		err = f.send(open{ID: id, Root: root, Path: path})
+	}
+	if err != nil {
+		f.forget(id)
+		return nil, fs.FileMeta{}, err
+	}
+	select {
+	case meta := <-file.meta:
+		return &remoteReader{fsys: f, id: id, file: file}, meta, nil
+	case err := <-file.err:
+		return nil, fs.FileMeta{}, err
+	}
+}
+
+// Create writes a file in the agent. The agent verifies and places it on
+// commit.
+func (f *fsys) Create(meta fs.FileMeta) (fs.FileWriter, error) {
+	result := make(chan error, 1)
+	id, err := f.register(func(id int) { f.created[id] = result })
+	if err == nil {
+		err = f.send(create{ID: id, Meta: meta})
+	}
+	if err != nil {
+		f.forget(id)
+		return nil, err
+	}
+	return &remoteWriter{fsys: f, id: id, result: result}, nil
+}
+
+type remoteReader struct {
+	fsys *fsys
+	id   int
+	file *openedFile
+	data bytes.Reader // the rest of the current chunk
+	err  error        // how the file ended
+}
+
+func (r *remoteReader) Read(b []byte) (int, error) {
+	for r.data.Len() == 0 && r.err == nil {
+		chunk := r.next()
+		r.data.Reset(chunk.Data)
+		switch {
+		case chunk.EOF:
+			r.err = io.EOF
+		case chunk.Error != "":
+			r.err = replyError(chunk.Error)
+		default:
+			r.fsys.send(credit{ID: r.id})
+		}
+	}
+	if r.data.Len() > 0 {
+		return r.data.Read(b)
+	}
+	return 0, r.err
+}
+
+// next returns the next chunk, preferring the ones that arrived before the
+// agent went away.
+func (r *remoteReader) next() chunk {
+	select {
+	case chunk := <-r.file.chunks:
+		return chunk
+	default:
+	}
+	select {
+	case chunk := <-r.file.chunks:
+		return chunk
+	case <-r.fsys.goneCh:
+		return chunk{Error: errAgentGone.Error()}
+	}
+}
+
+func (r *remoteReader) Close() error {
+	r.data.Reset(nil)
+	r.err = io.ErrClosedPipe
+	if r.fsys.forget(r.id) {
+		return r.fsys.send(closeFile{ID: r.id})
+	}
+	return nil
+}
+
+type remoteWriter struct {
+	fsys   *fsys
+	id     int
+	result chan error
+}
+
+func (w *remoteWriter) Write(b []byte) (int, error) {
+	if err := w.fsys.send(write{ID: w.id, Data: b}); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (w *remoteWriter) Commit() error {
+	if err := w.fsys.send(commit{ID: w.id}); err != nil {
+		w.fsys.forget(w.id)
+		return err
+	}
+	return <-w.result
+}
+
+func (w *remoteWriter) Abort() {
+	if w.fsys.forget(w.id) {
+		w.fsys.send(abort{ID: w.id})
+	}
+}
+
+func (f *fsys) register(add func(id int)) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+	if f.gone {
+		return 0, errAgentGone
+	}
+	f.nextID++
+	add(f.nextID)
+	return f.nextID, nil
+}
+
+// forget drops the file and reports whether the agent still has it open.
+func (f *fsys) forget(id int) bool {
+	f.Lock()
+	defer f.Unlock()
+	_, opened := f.opened[id]
+	_, created := f.created[id]
+	delete(f.opened, id)
+	delete(f.created, id)
+	return opened || created
+}
+
+func (f *fsys) send(cmd command) error {
+	f.sendLock.Lock()
+	defer f.sendLock.Unlock()
+	return f.encoder.Encode(&cmd)
+}
+
+// run sends the commands until the quit command, then waits for the agent to
+// exit.
+func (f *fsys) run() {
+	defer f.lc.Done()
+	broken := false
+	for {
+		for _, cmd := range f.commands.Pull() {
+			if !broken {
+				if err := f.send(cmd); err != nil {
+					broken = true
+					f.fail(err)
+				}
+			}
+			if _, ok := cmd.(quit); ok {
+				f.stdin.Close()
+				if err := f.cmd.Wait(); err != nil {
+					log.Debug("agent exited", "agent", f.name, "error", err)
+				}
+				return
+			}
+		}
+	}
+}
+
+// read passes the agent's events on. After quitting it keeps draining them,
+// so the agent never blocks on a full pipe.
+func (f *fsys) read(stdout io.Reader) {
+	decoder := gob.NewDecoder(stdout)
+	var msg any
+	err := decoder.Decode(&msg)
+	if hello, ok := msg.(hello); err == nil && (!ok || hello.Protocol != protocol) {
+		err = fmt.Errorf("agent speaks protocol %d, arc speaks %d", hello.Protocol, protocol)
+	}
+	for err == nil {
+		switch msg := msg.(type) {
+		case chunk:
+			f.receive(msg)
+		case committed:
+			f.Lock()
+			result := f.created[msg.ID]
+			delete(f.created, msg.ID)
+			f.Unlock()
+			if result != nil {
+				result <- replyError(msg.Error)
+			}
+		case fs.Event:
+			select {
+			case f.events <- msg:
+			case <-f.quit:
+			}
+		}
+		msg = nil
+		err = decoder.Decode(&msg)
+	}
+	f.fail(err)
+	f.disconnect()
+}
+
+func (f *fsys) receive(chunk chunk) {
+	f.Lock()
+	file := f.opened[chunk.ID]
+	if file != nil && (chunk.EOF || chunk.Error != "") {
+		delete(f.opened, chunk.ID)
+	}
+	f.Unlock()
+	if file == nil {
+		return
+	}
+	if chunk.Meta != nil {
+		file.started = true
+		file.meta <- *chunk.Meta
+	}
+	if chunk.Error != "" && !file.started {
+		file.err <- replyError(chunk.Error)
+		return
+	}
+	if len(chunk.Data) > 0 || chunk.EOF || chunk.Error != "" {
+		select {
+		case file.chunks <- chunk:
+		default:
+			log.Debug("agent overran the chunk window", "agent", f.name, "id", chunk.ID)
+		}
+	}
+}
+
+// disconnect fails the files still open once the agent is gone.
+func (f *fsys) disconnect() {
+	f.Lock()
+	defer f.Unlock()
+	f.gone = true
+	close(f.goneCh)
+	for _, file := range f.opened {
+		if !file.started {
+			file.err <- errAgentGone
+		}
+	}
+	for _, result := range f.created {
+		result <- errAgentGone
+	}
+	clear(f.opened)
+	clear(f.created)
+}
+
+func (f *fsys) fail(err error) {
+	if f.lc.ShoudStop() {
+		return
+	}
+	log.Debug("agent failed", "agent", f.name, "error", err)
+	select {
+	case f.events <- fs.Error{Path: f.name, Error: err}:
+	case <-f.quit:
+	}
+}
+
+func replyError(message string) error {
+	if message == "" {
+		return nil
+	}
+	return remoteError{Message: message}
+}
+
+// stderr logs what the agent prints there, which would garble the screen.
+type stderr struct{}
+
+func (stderr) Write(b []byte) (int, error) {
+	log.Debug("agent stderr", "output", b)
+	return len(b), nil
+}
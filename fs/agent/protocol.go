@@ -0,0 +1,165 @@
+// Package agent carries the fs.FS commands and events over a byte stream, so
+// an archive can be scanned and hashed by an arc agent running next to it,
+// typically on the other end of an ssh connection.
+//
+// The stream is a gob stream. The agent opens it with a hello, after which
+// the client sends commands and the agent sends events. File contents travel
+// in the same streams, as chunks read from opened files and as writes to
+// created ones. The agent sends chunkWindow chunks of an opened file ahead of
+// the client's reads and one more for every credit the client sends back.
+package agent
+
+import (
+	"arc/fs"
+	"encoding/gob"
+)
+
+// protocol changes whenever a command or an event changes its fields.
+const protocol = 2
+
+type hello struct {
+	Protocol int
+}
+
+type command interface {
+	serve(s *server)
+}
+
+type (
+	scan struct{ Root string }
+	copy struct {
+		Path     string
+		Hash     string
+		FromRoot string
+		ToRoots  []string
+	}
+	rename struct {
+		Root       string
+		SourcePath string
+		TargetPath string
+	}
+	deleteCmd struct {
+		Root string
+		Path string
+	}
+	scrub  struct{ Root string }
+	verify struct {
+		Root string
+		Path string
+	}
+	trash   struct{ Root string }
+	restore struct {
+		Root  string
+		Batch string
+		Path  string
+	}
+	purge struct {
+		Root  string
+		Batch string
+		Path  string
+	}
+	newBatch struct{}
+	recovery struct {
+		Root    string
+		Batch   string
+		Forward bool
+	}
+	quit struct{}
+
+	open struct {
+		ID   int
+		Root string
+		Path string
+	}
+	credit    struct{ ID int } // the client consumed a chunk of the file
+	closeFile struct{ ID int }
+	create    struct {
+		ID   int
+		Meta fs.FileMeta
+	}
+	write struct {
+		ID   int
+		Data []byte
+	}
+	commit struct{ ID int }
+	abort  struct{ ID int }
+)
+
+type (
+	// chunk is the next part of an opened file. The first one carries the
+	// meta, the last one EOF or an error.
+	chunk struct {
+		ID    int
+		Meta  *fs.FileMeta
+		Data  []byte
+		EOF   bool
+		Error string
+	}
+
+	// committed answers the commit of a created file.
+	committed struct {
+		ID    int
+		Error string
+	}
+)
+
+func (cmd scan) serve(s *server)      { s.fsys.Scan(cmd.Root) }
+func (cmd copy) serve(s *server)      { s.fsys.Copy(cmd.Path, cmd.Hash, cmd.FromRoot, cmd.ToRoots...) }
+func (cmd rename) serve(s *server)    { s.fsys.Rename(cmd.Root, cmd.SourcePath, cmd.TargetPath) }
+func (cmd deleteCmd) serve(s *server) { s.fsys.Delete(cmd.Root, cmd.Path) }
+func (cmd scrub) serve(s *server)     { s.fsys.Scrub(cmd.Root) }
+func (cmd verify) serve(s *server)    { s.fsys.Verify(cmd.Root, cmd.Path) }
+func (cmd trash) serve(s *server)     { s.fsys.Trash(cmd.Root) }
+func (cmd restore) serve(s *server)   { s.fsys.Restore(cmd.Root, cmd.Batch, cmd.Path) }
+func (cmd purge) serve(s *server)     { s.fsys.Purge(cmd.Root, cmd.Batch, cmd.Path) }
+func (cmd newBatch) serve(s *server)  { s.fsys.Batch() }
+func (cmd recovery) serve(s *server)  { s.fsys.Recover(cmd.Root, cmd.Batch, cmd.Forward) }
+func (cmd quit) serve(s *server)      { s.fsys.Quit() }
+
+// remoteError stands in for an error of the agent, whose concrete type
+// cannot cross the stream.
+type remoteError struct {
+	Message string
+}
+
+func (err remoteError) Error() string {
+	return err.Message
+}
+
+// portable replaces the errors in the event with remote errors.
+func portable(event fs.Event) fs.Event {
+	switch e := event.(type) {
+	case fs.CopyFailed:
+		if e.Error != nil {
+			e.Error = remoteError{Message: e.Error.Error()}
+		}
+		return e
+	case fs.Error:
+		if e.Error != nil {
+			e.Error = remoteError{Message: e.Error.Error()}
+		}
+		return e
+	}
+	return event
+}
+
+func init() {
+	for _, cmd := range []command{
+		scan{}, copy{}, rename{}, deleteCmd{}, scrub{}, verify{}, trash{}, restore{}, purge{}, newBatch{}, recovery{}, quit{},
+		open{}, credit{}, closeFile{}, create{}, write{}, commit{}, abort{},
+	} {
+		gob.Register(cmd)
+	}
+	gob.Register(hello{})
+	gob.Register(chunk{})
+	gob.Register(committed{})
+	for _, event := range []fs.Event{
+		fs.FileMeta{}, fs.FileHashed{}, fs.CopyProgress{}, fs.ArchiveHashed{}, fs.Copied{}, fs.CopyVerified{},
+		fs.CopyFailed{}, fs.Renamed{}, fs.Deleted{}, fs.FileVerified{}, fs.Corrupted{}, fs.ArchiveScrubbed{},
+		fs.TrashEntry{}, fs.TrashListed{}, fs.Restored{}, fs.Purged{}, fs.IncompleteBatch{}, fs.BatchRecovered{},
+		fs.DiskSpace{}, fs.Error{},
+	} {
+		gob.Register(event)
+	}
+	gob.Register(remoteError{})
+}
@@ -0,0 +1,234 @@
+package agent
+
+import (
+	"arc/fs"
+	"arc/log"
+	"encoding/gob"
+	"errors"
+	"io"
+	"sync"
+)
+
+const (
+	chunkSize   = 256 * 1024
+	chunkWindow = 8 // chunks of an opened file sent ahead of the client's reads
+)
+
+var errNoStreaming = errors.New("the agent's backend cannot stream files")
+
+type server struct {
+	fsys fs.FS
+
+	sync.Mutex // guards the encoder and the files
+	encoder    *gob.Encoder
+	opened     map[int]*streamedFile
+	created    map[int]*createdFile
+}
+
+type streamedFile struct {
+	credits chan struct{} // one for each chunk the client has room for
+	closed  chan struct{} // closed once the client closes the file
+}
+
+type createdFile struct {
+	writer fs.FileWriter
+	err    error
+}
+
+// Serve runs the commands read from r against fsys and writes its events to
+// w. It returns once the client quits or the stream closes, after quitting
+// fsys; events still in flight are dropped.
+func Serve(fsys fs.FS, r io.Reader, w io.Writer) error {
+	s := &server{
+		fsys:    fsys,
+		encoder: gob.NewEncoder(w),
+		opened:  map[int]*streamedFile{},
+		created: map[int]*createdFile{},
+	}
+	if err := s.send(hello{Protocol: protocol}); err != nil {
+		fsys.Quit()
+		return err
+	}
+
+	go func() {
+		for event := range fsys.Events() {
+			if err := s.send(portable(event)); err != nil {
+				log.Debug("agent: failed to send event", "event", event, "error", err)
+				return
+			}
+		}
+	}()
+
+	defer s.closeStreams()
+	decoder := gob.NewDecoder(r)
+	for {
+		var cmd command
+		if err := decoder.Decode(&cmd); err != nil {
+			fsys.Quit()
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		cmd.serve(s)
+		if _, ok := cmd.(quit); ok {
+			return nil
+		}
+	}
+}
+
+func (s *server) send(msg any) error {
+	s.Lock()
+	defer s.Unlock()
+	return s.encoder.Encode(&msg)
+}
+
+func (s *server) streamer() (fs.Streamer, error) {
+	streamer, ok := s.fsys.(fs.Streamer)
+	if !ok {
+		return nil, errNoStreaming
+	}
+	return streamer, nil
+}
+
+func (cmd open) serve(s *server) {
+	file := &streamedFile{credits: make(chan struct{}, chunkWindow), closed: make(chan struct{})}
+	for i := 0; i < chunkWindow; i++ {
+		file.credits <- struct{}{}
+	}
+	s.Lock()
+	s.opened[cmd.ID] = file
+	s.Unlock()
+	go s.stream(cmd, file)
+}
+
+// stream sends the file in chunks, as long as the client has credit, until it
+// ends or the client closes it.
+func (s *server) stream(cmd open, file *streamedFile) {
+	defer func() {
+		s.Lock()
+		delete(s.opened, cmd.ID)
+		s.Unlock()
+	}()
+	streamer, err := s.streamer()
+	if err != nil {
+		s.send(chunk{ID: cmd.ID, Error: err.Error()})
+		return
+	}
+	reader, meta, err := streamer.Open(cmd.Root, cmd.Path)
+	if err != nil {
+		s.send(chunk{ID: cmd.ID, Error: err.Error()})
+		return
+	}
+	defer reader.Close()
+	if s.send(chunk{ID: cmd.ID, Meta: &meta}) != nil {
+		return
+	}
+	buf := make([]byte, chunkSize)
+	for {
+		select {
+		case <-file.credits:
+		case <-file.closed:
+			return
+		}
+		n, err := io.ReadFull(reader, buf)
+		next := chunk{ID: cmd.ID, Data: buf[:n]}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			next.EOF = true
+		} else if err != nil {
+			next.Error = err.Error()
+		}
+		if s.send(next) != nil || next.EOF || next.Error != "" {
+			return
+		}
+	}
+}
+
+func (cmd credit) serve(s *server) {
+	s.Lock()
+	file := s.opened[cmd.ID]
+	s.Unlock()
+	if file != nil {
+		select {
+		case file.credits <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (cmd closeFile) serve(s *server) {
+	s.Lock()
+	defer s.Unlock()
+	if file := s.opened[cmd.ID]; file != nil {
+		close(file.closed)
+		delete(s.opened, cmd.ID)
+	}
+}
+
+// closeStreams stops the streams still waiting for credit once the client is
+// gone.
+func (s *server) closeStreams() {
+	s.Lock()
+	defer s.Unlock()
+	for _, file := range s.opened {
+		close(file.closed)
+	}
+	clear(s.opened)
+}
+
+func (cmd create) serve(s *server) {
+	file := &createdFile{}
+	streamer, err := s.streamer()
+	if err == nil {
+		file.writer, err = streamer.Create(cmd.Meta)
+	}
+	file.err = err
+	s.Lock()
+	s.created[cmd.ID] = file
+	s.Unlock()
+}
+
+func (cmd write) serve(s *server) {
+	s.Lock()
+	file := s.created[cmd.ID]
+	s.Unlock()
+	if file == nil || file.err != nil {
+		return
+	}
+	_, file.err = file.writer.Write(cmd.Data)
+}
+
+func (cmd commit) serve(s *server) {
+	file := s.takeCreated(cmd.ID)
+	if file == nil {
+		return
+	}
+	// Verifying the file takes a while; the commands go on meanwhile.
+	go func() {
+		err := file.err
+		if err == nil {
+			err = file.writer.Commit()
+		} else if file.writer != nil {
+			file.writer.Abort()
+		}
+		reply := committed{ID: cmd.ID}
+		if err != nil {
+			reply.Error = err.Error()
+		}
+		s.send(reply)
+	}()
+}
+
+func (cmd abort) serve(s *server) {
+	if file := s.takeCreated(cmd.ID); file != nil && file.writer != nil {
+		file.writer.Abort()
+	}
+}
+
+func (s *server) takeCreated(id int) *createdFile {
+	s.Lock()
+	defer s.Unlock()
+	file := s.created[id]
+	delete(s.created, id)
+	return file
+}
@@ -2,11 +2,15 @@ package filesys
 
 import (
 	"arc/fs"
-	"encoding/csv"
-	"fmt"
+	"arc/log"
+	"encoding/base64"
+	"errors"
 	"io"
+	"math"
 	"os"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -18,6 +22,9 @@ func (f *fsys) copyFile(copy copy) {
 	defer f.lc.Done()
 
 	defer func() {
+		for _, root := range copy.toRoots {
+			f.reportDiskSpace(root)
+		}
 		f.events <- fs.Copied{
 			Path:     copy.path,
 			FromRoot: copy.fromRoot,
@@ -25,38 +32,51 @@ func (f *fsys) copyFile(copy copy) {
 		}
 	}()
 
-	events := make([]chan event, len(copy.toRoots))
-	copied := make([]int, len(copy.toRoots))
-	reported := 0
+	source := filepath.Join(copy.fromRoot, copy.path)
+	info, err := os.Lstat(source)
+	if err != nil {
+		f.events <- fs.Error{Path: source, Error: err}
+		return
+	}
+	if !info.Mode().IsRegular() {
+		f.copyEntry(copy, info)
+		return
+	}
 
-	for i := range copy.toRoots {
-		events[i] = make(chan event, 1)
+	streamed := copy
+	streamed.toRoots = f.linkCopies(copy, info)
+	streamed.toRoots = f.kernelCopies(streamed, info)
+	if len(streamed.toRoots) == 0 {
+		return
 	}
 
-	go f.reader(copy, events)
+	// Every writer publishes its own progress, so a slow destination never
+	// holds back the bookkeeping of the faster ones.
+	progress := make([]atomic.Int64, len(streamed.toRoots))
+	wg := &sync.WaitGroup{}
+	wg.Add(len(streamed.toRoots))
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	go f.reader(streamed, f.resumePoint(streamed, info), progress, wg)
 
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	reported := 0
 	for {
-		hasValue := false
-		minCopied := 0
-		for i := range events {
-			if event, ok := <-events[i]; ok {
-				hasValue = true
-				switch event := event.(type) {
-				case copyProgress:
-					copied[i] = int(event)
-					minCopied = copied[i]
-
-				case copyError:
-					f.events <- fs.Error{Path: event.Path, Error: event.Error}
-				}
-			}
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
 		}
-		for _, fileCopied := range copied {
-			if minCopied > fileCopied {
-				minCopied = fileCopied
-			}
+		minCopied := math.MaxInt
+		for i := range progress {
+			minCopied = min(minCopied, int(progress[i].Load()))
 		}
-		if reported < minCopied {
+		if reported < minCopied && minCopied < math.MaxInt {
 			reported = minCopied
 			f.events <- fs.CopyProgress{
 				Root:   copy.fromRoot,
@@ -64,26 +84,144 @@ func (f *fsys) copyFile(copy copy) {
 				Copyed: reported,
 			}
 		}
-		if !hasValue {
-			break
+	}
+}
+
+// copyEntry recreates an empty folder or a symlink in every target root.
+func (f *fsys) copyEntry(copy copy, info os.FileInfo) {
+	var target string
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		target, err = os.Readlink(filepath.Join(copy.fromRoot, copy.path))
+		if err != nil {
+			f.events <- fs.Error{Path: filepath.Join(copy.fromRoot, copy.path), Error: err}
+			return
+		}
+	}
+
+	for _, root := range copy.toRoots {
+		fullPath := filepath.Join(root, copy.path)
+		var err error
+		if info.IsDir() {
+			err = f.makeDirs(copy.fromRoot, root, copy.path)
+		} else {
+			err = f.makeDirs(copy.fromRoot, root, filepath.Dir(copy.path))
+			if err == nil {
+				err = os.Symlink(target, fullPath)
+			}
+			if err == nil {
+				err = f.preserveMetadata(filepath.Join(copy.fromRoot, copy.path), fullPath)
+			}
+		}
+		if err != nil {
+			f.events <- fs.Error{Path: fullPath, Error: err}
+			continue
+		}
+		if info.IsDir() {
+			f.restoreDirs(copy.fromRoot, root, copy.path)
+		} else {
+			f.restoreDirs(copy.fromRoot, root, filepath.Dir(copy.path))
+		}
+		if info, err := os.Lstat(fullPath); err == nil {
+			if file := f.entryMeta(root, copy.path, info); file != nil {
+				f.index.set(root, &meta{inode: info.Sys().(*syscall.Stat_t).Ino, file: file})
+			}
 		}
 	}
 }
 
-type event interface {
-	event()
+// linkCopies recreates hard links of the source in the target roots where
+// another link to the same inode has already been copied. It returns the
+// roots that still need the content to be copied.
+func (f *fsys) linkCopies(copy copy, info os.FileInfo) []string {
+	sys := info.Sys().(*syscall.Stat_t)
+	if sys.Nlink < 2 {
+		return copy.toRoots
+	}
+	links := f.index.links(copy.fromRoot, sys.Ino)
+	var remaining []string
+	for _, root := range copy.toRoots {
+		if !f.linkCopy(copy, root, links) {
+			remaining = append(remaining, root)
+		}
+	}
+	return remaining
+}
+
+func (f *fsys) linkCopy(copy copy, root string, links []string) bool {
+	for _, link := range links {
+		if link == copy.path {
+			continue
+		}
+		existing := f.index.get(root, link)
+		if existing == nil || existing.file.Hash != copy.hash {
+			continue
+		}
+		fullPath := filepath.Join(root, copy.path)
+		err := f.makeDirs(copy.fromRoot, root, filepath.Dir(copy.path))
+		if err == nil {
+			err = os.Link(filepath.Join(root, link), fullPath)
+		}
+		if err != nil {
+			f.events <- fs.Error{Path: fullPath, Error: err}
+			return false
+		}
+		file := *existing.file
+		file.Path = copy.path
+		meta := &meta{inode: existing.inode, file: &file}
+		f.index.set(root, meta)
+		f.appendMeta(root, meta)
+		f.countLinks(root, existing.inode, fullPath)
+		f.restoreDirs(copy.fromRoot, root, filepath.Dir(copy.path))
+		return true
+	}
+	return false
+}
+
+// countLinks updates the link count of every indexed link to the inode.
+func (f *fsys) countLinks(root string, inode uint64, fullPath string) {
+	info, err := os.Lstat(fullPath)
+	if err != nil {
+		return
+	}
+	links := int(info.Sys().(*syscall.Stat_t).Nlink)
+	for _, path := range f.index.links(root, inode) {
+		if known := f.index.get(root, path); known != nil && known.file.Links != links {
+			file := *known.file
+			file.Links = links
+			f.index.set(root, &meta{inode: known.inode, file: &file, verified: known.verified, content: known.content})
+		}
+	}
 }
 
-type copyProgress int
+// copyTempPrefix starts the names of files still being copied. Leftovers of
+// interrupted copies that cannot be resumed are removed by the next scan.
+const copyTempPrefix = ".arc-copy-"
 
-func (copyProgress) event() {}
+const (
+	// copyRingSize is how many chunks a writer may lag behind the reader.
+	copyRingSize = 64
 
-type copyError fs.Error
+	progressInterval = 100 * time.Millisecond
+)
 
-func (copyError) event() {}
+var (
+	errSourceIncomplete = errors.New("source was not read completely")
+	errCopyMismatch     = errors.New("copy does not match the source")
+	errSourceMismatch   = errors.New("source does not match its recorded hash")
+)
 
-func (f *fsys) reader(copy copy, eventChans []chan event) {
+// reader streams the source to the writers through buffered channels, so a
+// fast destination can run up to copyRingSize chunks ahead of a slow one.
+func (f *fsys) reader(copy copy, state resumeState, progress []atomic.Int64, wg *sync.WaitGroup) {
+	// sourceSum is set before the command channels are closed, so the writers
+	// can read it once their channels are drained.
+	var sourceSum string
 	commands := make([]chan []byte, len(copy.toRoots))
+	for i, root := range copy.toRoots {
+		commands[i] = make(chan []byte, copyRingSize)
+		go f.writer(copy.fromRoot, root, copy.path, state, &sourceSum, commands[i], &progress[i], wg.Done)
+	}
 	defer func() {
 		for _, cmdChan := range commands {
 			close(cmdChan)
@@ -91,17 +229,6 @@ func (f *fsys) reader(copy copy, eventChans []chan event) {
 	}()
 
 	source := filepath.Join(copy.fromRoot, copy.path)
-	info, err := os.Stat(source)
-	if err != nil {
-		f.events <- fs.Error{Path: copy.fromRoot, Error: err}
-		return
-	}
-
-	for i, root := range copy.toRoots {
-		commands[i] = make(chan []byte)
-		go f.writer(root, copy.path, copy.hash, info.ModTime(), commands[i], eventChans[i])
-	}
-
 	sourceFile, err := os.Open(source)
 	if err != nil {
 		f.events <- fs.Error{Path: copy.fromRoot, Error: err}
@@ -110,74 +237,239 @@ func (f *fsys) reader(copy copy, eventChans []chan event) {
 
 	defer sourceFile.Close()
 
+	hash, _ := f.restoreHash(state.hashState)
+	if state.committed > 0 {
+		log.Debug("resume copy", "path", source, "offset", state.committed)
+		_, err = sourceFile.Seek(int64(state.committed), io.SeekStart)
+		if err != nil {
+			f.events <- fs.Error{Path: copy.fromRoot, Error: err}
+			return
+		}
+	}
+
 	var n int
-	for err != io.EOF && !f.lc.ShoudStop() {
+	for err != io.EOF {
+		if f.lc.ShoudStop() {
+			return
+		}
 		buf := make([]byte, bufSize)
 		n, err = sourceFile.Read(buf)
 		if err != nil && err != io.EOF {
 			f.events <- fs.Error{Path: copy.fromRoot, Error: err}
 			return
 		}
+		hash.Write(buf[:n])
 		for _, cmd := range commands {
 			cmd <- buf[:n]
 		}
 	}
+	sourceSum = base64.RawURLEncoding.EncodeToString(hash.Sum(nil))
 }
 
-func (f *fsys) writer(root, path, hash string, modTime time.Time, cmdChan chan []byte, eventChan chan event) {
-	var copied copyProgress
+// writer writes the bytes streamed by the reader into a hidden temp file next
+// to the destination, verifies it against the hash of the source stream and
+// only then renames it into place, so an interrupted or failed copy never
+// leaves a truncated file under the real name. While writing it checkpoints
+// the committed bytes, so an interrupted copy can resume where it stopped.
+func (f *fsys) writer(fromRoot, root, path string, state resumeState, sourceSum *string, cmdChan chan []byte, progress *atomic.Int64, done func()) {
+	// A writer that gave up keeps draining the commands, so it blocks neither
+	// the reader nor the other writers, and stops counting towards progress.
+	defer func() {
+		progress.Store(math.MaxInt64)
+		done()
+		for range cmdChan {
+		}
+	}()
+	copied := state.committed
 
-	fullPath := filepath.Join(root, path)
-	dirPath := filepath.Dir(fullPath)
-	_ = os.MkdirAll(dirPath, 0755)
-	file, err := os.Create(fullPath)
+	path = norm.NFC.String(path)
+	tempPath, statePath := copyPaths(root, path)
+	_ = f.makeDirs(fromRoot, root, filepath.Dir(path))
+	file, err := os.OpenFile(tempPath, os.O_CREATE|os.O_WRONLY, 0644)
+	if err == nil {
+		err = file.Truncate(int64(state.committed))
+		if err == nil {
+			_, err = file.Seek(int64(state.committed), io.SeekStart)
+		}
+		if err != nil {
+			_ = file.Close()
+		}
+	}
 	if err != nil {
-		f.events <- fs.Error{Path: fullPath, Error: err}
+		f.events <- fs.CopyFailed{Root: root, Path: path, Error: err}
 		return
 	}
 
-	defer func() {
-		if file != nil {
-			info, _ := file.Stat()
-			sys := info.Sys().(*syscall.Stat_t)
-			size := info.Size()
-			_ = file.Close()
-			_ = os.Chtimes(fullPath, time.Now(), modTime)
-
-			absHashFileName := filepath.Join(root, hashFileName)
-			hashInfoFile, err := os.OpenFile(absHashFileName, os.O_APPEND|os.O_WRONLY, 0644)
-			if err == nil {
-				csvWriter := csv.NewWriter(hashInfoFile)
-				_ = csvWriter.Write([]string{
-					fmt.Sprint(sys.Ino),
-					norm.NFC.String(path),
-					fmt.Sprint(size),
-					modTime.UTC().Format(time.RFC3339Nano),
-					hash,
-				})
-				csvWriter.Flush()
-				_ = hashInfoFile.Close()
-			}
-
-			if f.lc.ShoudStop() {
-				_ = os.Remove(dirPath)
-			}
+	hash, _ := f.restoreHash(state.hashState)
+	checkpoint := func() {
+		if file.Sync() != nil {
+			return
 		}
-		close(eventChan)
-	}()
+		state.committed = copied
+		state.hashState = saveHash(hash)
+		if state.hashState != nil {
+			_ = writeResumeState(statePath, &state)
+		}
+	}
 
 	for cmd := range cmdChan {
 		if f.lc.ShoudStop() {
-			// TODO: remove partly written file
+			checkpoint()
+			_ = file.Close()
 			return
 		}
 
 		n, err := file.Write([]byte(cmd))
-		copied += copyProgress(n)
+		hash.Write(cmd[:n])
+		copied += n
 		if err != nil {
-			f.events <- fs.Error{Path: fullPath, Error: err}
+			// What was committed so far is kept for the next attempt.
+			_ = file.Close()
+			f.events <- fs.CopyFailed{Root: root, Path: path, Error: err}
 			return
 		}
-		eventChan <- copied
+		if copied-state.committed >= resumeEvery {
+			checkpoint()
+		}
+		progress.Store(int64(copied))
 	}
+
+	if f.lc.ShoudStop() || *sourceSum == "" {
+		checkpoint()
+		_ = file.Close()
+		if !f.lc.ShoudStop() {
+			f.events <- fs.CopyFailed{Root: root, Path: path, Error: errSourceIncomplete}
+		}
+		return
+	}
+
+	err = file.Sync()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = f.verifyCopy(tempPath, *sourceSum, f.sourceMeta(state))
+	}
+	if err != nil {
+		f.copyFailed(root, path, err)
+		return
+	}
+	f.commitCopy(fromRoot, root, path, state)
+}
+
+// commitCopy moves a written and verified temp file into place and records
+// it in the index and the meta file.
+func (f *fsys) commitCopy(fromRoot, root, path string, state resumeState) {
+	tempPath, statePath := copyPaths(root, path)
+	var meta *meta
+	err := f.preserveMetadata(filepath.Join(fromRoot, path), tempPath)
+	if err == nil {
+		meta, err = f.placeCopy(tempPath, root, path, state.modTime, state.hash)
+	}
+	if err != nil {
+		f.copyFailed(root, path, err)
+		return
+	}
+	_ = os.Remove(statePath)
+	f.restoreDirs(fromRoot, root, filepath.Dir(path))
+	f.appendMeta(root, meta)
+	f.events <- fs.CopyVerified{Root: root, Path: path}
+}
+
+// placeCopy sets the modification time of a verified temp file and renames
+// it to its path in the root, indexed with the hash it was verified against.
+// The temp file stays behind on failure.
+func (f *fsys) placeCopy(tempPath, root, path string, modTime time.Time, hash string) (*meta, error) {
+	if err := os.Chtimes(tempPath, time.Now(), modTime); err != nil {
+		return nil, err
+	}
+	info, err := os.Lstat(tempPath)
+	if err != nil {
+		return nil, err
+	}
+
+	sys := info.Sys().(*syscall.Stat_t)
+	meta := &meta{
+		inode: sys.Ino,
+		file: &fs.FileMeta{
+			Root:      root,
+			Path:      path,
+			Inode:     sys.Ino,
+			Links:     1,
+			Size:      int(info.Size()),
+			ModTime:   modTime.UTC().Round(time.Second),
+			Mode:      info.Mode() & preservedModeBits,
+			UID:       int(sys.Uid),
+			GID:       int(sys.Gid),
+			Xattrs:    f.xattrDigest(tempPath),
+			Hash:      hash,
+			HashMode:  f.opts.HashMode,
+			Algorithm: f.opts.Hasher,
+		},
+	}
+	// The index is updated before the rename, so the watcher recognizes it.
+	previous := f.index.get(root, path)
+	f.index.set(root, meta)
+	if err := os.Rename(tempPath, filepath.Join(root, path)); err != nil {
+		if previous != nil {
+			f.index.set(root, previous)
+		} else {
+			f.index.remove(root, path)
+		}
+		return nil, err
+	}
+	return meta, nil
+}
+
+// verifyCopy re-reads a written copy and compares it with the hash of the
+// source stream, unless sourceSum is empty, and with the hash the source was
+// recorded with, unless there is none. A source that changed or rotted since
+// it was hashed is not copied under its old hash.
+func (f *fsys) verifyCopy(path, sourceSum string, source fs.FileMeta) error {
+	var hash, sum string
+	var err error
+	if source.Hash == "" {
+		sum, err = f.fileSum(path)
+	} else {
+		hash, sum, err = f.readContent(path, &source)
+	}
+	if err != nil {
+		return err
+	}
+	if sourceSum != "" && sum != sourceSum {
+		return errCopyMismatch
+	}
+	if hash != source.Hash {
+		return errSourceMismatch
+	}
+	return nil
+}
+
+// sourceMeta describes the source of a copy as the archive recorded it.
+func (f *fsys) sourceMeta(state resumeState) fs.FileMeta {
+	return fs.FileMeta{Size: state.size, Hash: state.hash, HashMode: f.opts.HashMode, Algorithm: f.opts.Hasher}
+}
+
+// fileSum hashes every byte of the file.
+func (f *fsys) fileSum(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := f.newHash()
+	if err := f.hashFull(hash, file); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(hash.Sum(nil)), nil
+}
+
+// copyFailed removes the temp file and the resume state of a copy that
+// could not be verified or moved into place.
+func (f *fsys) copyFailed(root, path string, err error) {
+	tempPath, statePath := copyPaths(root, path)
+	_ = os.Remove(tempPath)
+	_ = os.Remove(statePath)
+	f.events <- fs.CopyFailed{Root: root, Path: path, Error: err}
 }
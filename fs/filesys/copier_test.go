@@ -0,0 +1,103 @@
+package filesys
+
+import (
+	"arc/fs"
+	"arc/lifecycle"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLinkCopies(t *testing.T) {
+	source, target := t.TempDir(), t.TempDir()
+	os.WriteFile(filepath.Join(source, "a"), []byte("content"), 0644)
+	os.Link(filepath.Join(source, "a"), filepath.Join(source, "b"))
+
+	f := NewFS(lifecycle.New(), Options{CopyLanes: 2}).(*fsys)
+	defer f.Quit()
+	hashes := scanned(t, f, source)
+
+	// With two lanes both links would be copied at once if they were not
+	// ordered by their link group.
+	f.Copy("a", hashes["a"], source, target)
+	f.Copy("b", hashes["b"], source, target)
+	waitFor[fs.Copied](t, f.events)
+	waitFor[fs.Copied](t, f.events)
+
+	infoA, errA := os.Stat(filepath.Join(target, "a"))
+	infoB, errB := os.Stat(filepath.Join(target, "b"))
+	if errA != nil || errB != nil || !os.SameFile(infoA, infoB) {
+		t.Fatalf("the links were not recreated: %v %v", errA, errB)
+	}
+	for _, path := range []string{"a", "b"} {
+		if known := f.index.get(target, path); known == nil || known.file.Links != 2 {
+			t.Errorf("%s: unexpected index entry %v", path, known)
+		}
+	}
+}
+
+func TestVerifyCopy(t *testing.T) {
+	f := NewFS(lifecycle.New(), Options{}).(*fsys)
+	defer f.Quit()
+	path := filepath.Join(t.TempDir(), "copy")
+	os.WriteFile(path, []byte("content"), 0644)
+	sum, _ := f.fileSum(path)
+	hash := f.hashString("content")
+
+	tests := []struct {
+		name      string
+		sourceSum string
+		hash      string
+		err       error
+	}{
+		{"verified", sum, hash, nil},
+		{"no recorded hash", sum, "", nil},
+		{"reflink", "", hash, nil},
+		{"stream mismatch", f.hashString("other"), hash, errCopyMismatch},
+		{"source changed", sum, f.hashString("other"), errSourceMismatch},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			source := fs.FileMeta{Size: len("content"), Hash: test.hash, HashMode: f.opts.HashMode, Algorithm: f.opts.Hasher}
+			if err := f.verifyCopy(path, test.sourceSum, source); err != test.err {
+				t.Errorf("got %v, expected %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestCopyStaleHash(t *testing.T) {
+	source, target := t.TempDir(), t.TempDir()
+	os.WriteFile(filepath.Join(source, "a"), []byte("content"), 0644)
+
+	f := NewFS(lifecycle.New(), Options{}).(*fsys)
+	defer f.Quit()
+	scanned(t, f, source)
+
+	f.Copy("a", f.hashString("other"), source, target)
+	if failed := waitFor[fs.CopyFailed](t, f.events); failed.Error != errSourceMismatch {
+		t.Errorf("unexpected error %v", failed.Error)
+	}
+	waitFor[fs.Copied](t, f.events)
+	if entries, _ := os.ReadDir(target); len(entries) != 0 {
+		t.Errorf("the copy was left in the target: %v", entries)
+	}
+}
+
+func TestScanSweepsPartialCopies(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "a"), []byte("content"), 0644)
+	tempPath, _ := copyPaths(root, "b")
+	os.WriteFile(tempPath, []byte("cont"), 0644)
+
+	f := NewFS(lifecycle.New(), Options{}).(*fsys)
+	defer f.Quit()
+	hashes := scanned(t, f, root)
+
+	if len(hashes) != 1 || hashes["a"] == "" {
+		t.Errorf("unexpected files %v", hashes)
+	}
+	if _, err := os.Stat(tempPath); !os.IsNotExist(err) {
+		t.Errorf("the partial copy was not removed: %v", err)
+	}
+}
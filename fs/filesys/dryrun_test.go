@@ -0,0 +1,41 @@
+package filesys
+
+import (
+	"arc/fs"
+	"arc/lifecycle"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDryRunScan(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "a"), []byte("a"), 0644)
+	expiredBatch := time.Now().Add(-48 * time.Hour).UTC().Format(trashBatchFormat)
+	os.MkdirAll(filepath.Join(root, trashDirName, expiredBatch), 0755)
+	tempPath, _ := copyPaths(root, "b")
+	os.WriteFile(tempPath, []byte("partial"), 0644)
+
+	f := NewFS(lifecycle.New(), Options{TrashRetention: 24 * time.Hour, DryRun: true}).(*fsys)
+	defer f.Quit()
+	f.logOp(root, opRecord{batch: "1", seq: 1, state: opStarted, kind: fs.DeleteOperation, path: "x"})
+	f.logOp(root, opRecord{batch: "1", seq: 1, state: opFinished, kind: fs.DeleteOperation, path: "x", other: "t"})
+	scanned(t, f, root)
+
+	tests := []struct {
+		path string
+		kept bool
+	}{
+		{filepath.Join(trashDirName, expiredBatch), true},
+		{filepath.Base(tempPath), true},
+		{oplogFileName, true},
+		{hashFileName, false},
+	}
+	for _, test := range tests {
+		_, err := os.Lstat(filepath.Join(root, test.path))
+		if kept := err == nil; kept != test.kept {
+			t.Errorf("%s: kept %v, expected %v", test.path, kept, test.kept)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package filesys
+
+import (
+	"arc/fs"
+	"arc/log"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// kernelCopyChunk is how many bytes copy_file_range moves between two
+// progress reports.
+const kernelCopyChunk = 64 << 20
+
+// errNoKernelCopy means the kernel cannot copy between the two files.
+var errNoKernelCopy = errors.New("kernel copy not supported")
+
+// kernelCopies copies the source inside the kernel to the roots on the same
+// device as the source: as a reflink where the filesystem supports it,
+// otherwise with copy_file_range. It returns the roots that still need the
+// streaming copy.
+func (f *fsys) kernelCopies(copy copy, info os.FileInfo) []string {
+	device := deviceOf(copy.fromRoot)
+	var remaining []string
+	for _, root := range copy.toRoots {
+		if deviceOf(root) != device || !f.kernelCopy(copy, root, info) {
+			remaining = append(remaining, root)
+		}
+	}
+	return remaining
+}
+
+// kernelCopy returns false if the copy has to fall back to streaming, which
+// it also does when copy_file_range fails after copying part of the file.
+func (f *fsys) kernelCopy(copy copy, root string, info os.FileInfo) bool {
+	path := norm.NFC.String(copy.path)
+	tempPath, _ := copyPaths(root, path)
+	sourcePath := filepath.Join(copy.fromRoot, copy.path)
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return false
+	}
+	defer source.Close()
+
+	_ = f.makeDirs(copy.fromRoot, root, filepath.Dir(path))
+	temp, err := os.OpenFile(tempPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return false
+	}
+
+	// The copy never leaves the kernel, so reading the source again to
+	// compare every byte buys nothing: the copy is only checked against the
+	// recorded hash.
+	reflinked := reflink(temp, source) == nil
+	log.Debug("kernel copy", "path", sourcePath, "root", root, "reflink", reflinked)
+	size := int(info.Size())
+	copied := 0
+	if reflinked {
+		f.events <- fs.CopyProgress{Root: copy.fromRoot, Path: copy.path, Copyed: size}
+	}
+	for !reflinked && copied < size {
+		if f.lc.ShoudStop() {
+			_ = temp.Close()
+			_ = os.Remove(tempPath)
+			return true
+		}
+		var n int
+		n, err = copyRange(temp, source, min(size-copied, kernelCopyChunk))
+		if err != nil {
+			// The streaming copy starts over in a fresh temp file.
+			log.Debug("kernel copy failed", "path", sourcePath, "root", root, "copied", copied, "error", err)
+			_ = temp.Close()
+			_ = os.Remove(tempPath)
+			return false
+		}
+		if n == 0 {
+			err = errSourceIncomplete
+			break
+		}
+		copied += n
+		f.events <- fs.CopyProgress{Root: copy.fromRoot, Path: copy.path, Copyed: copied}
+	}
+
+	if err == nil {
+		err = temp.Sync()
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	state := resumeState{hash: copy.hash, size: int(info.Size()), modTime: info.ModTime()}
+	if err == nil {
+		err = f.verifyCopy(tempPath, "", f.sourceMeta(state))
+	}
+	if err != nil {
+		f.copyFailed(root, path, err)
+		return true
+	}
+	f.commitCopy(copy.fromRoot, root, path, state)
+	return true
+}
@@ -0,0 +1,27 @@
+//go:build linux
+
+package filesys
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// reflink makes dst share the blocks of src (FICLONE). It is a variable, as
+// is copyRange, so tests can stand in for the kernel.
+var reflink = func(dst, src *os.File) error {
+	return unix.IoctlFileClone(int(dst.Fd()), int(src.Fd()))
+}
+
+// copyRange copies up to n bytes from the current offset of src to the
+// current offset of dst without passing them through user space.
+var copyRange = func(dst, src *os.File, n int) (int, error) {
+	copied, err := unix.CopyFileRange(int(src.Fd()), nil, int(dst.Fd()), nil, n, 0)
+	if errors.Is(err, unix.EXDEV) || errors.Is(err, unix.ENOSYS) ||
+		errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.EINVAL) {
+		return 0, errNoKernelCopy
+	}
+	return copied, err
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package filesys
+
+import "os"
+
+// Kernel copies are only supported on Linux for now, copies always stream.
+var reflink = func(dst, src *os.File) error {
+	return errNoKernelCopy
+}
+
+var copyRange = func(dst, src *os.File, n int) (int, error) {
+	return 0, errNoKernelCopy
+}
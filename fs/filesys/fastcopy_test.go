@@ -0,0 +1,75 @@
+package filesys
+
+import (
+	"arc/fs"
+	"arc/lifecycle"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestKernelCopyFallback(t *testing.T) {
+	defer func(saved func(dst, src *os.File) error) { reflink = saved }(reflink)
+	defer func(saved func(dst, src *os.File, n int) (int, error)) { copyRange = saved }(copyRange)
+	noReflink := func(dst, src *os.File) error { return errNoKernelCopy }
+	fakeReflink := func(dst, src *os.File) error {
+		_, err := io.Copy(dst, src)
+		return err
+	}
+	// partialRange copies half of the first chunk and then fails.
+	partialRange := func() func(dst, src *os.File, n int) (int, error) {
+		calls := 0
+		return func(dst, src *os.File, n int) (int, error) {
+			if calls++; calls > 1 {
+				return 0, syscall.EIO
+			}
+			copied, err := io.CopyN(dst, src, int64(n/2))
+			return int(copied), err
+		}
+	}
+
+	tests := []struct {
+		name      string
+		reflink   func(dst, src *os.File) error
+		copyRange func(dst, src *os.File, n int) (int, error)
+		fallback  bool
+	}{
+		{"reflink", fakeReflink, nil, false},
+		{"unsupported", noReflink, func(dst, src *os.File, n int) (int, error) { return 0, errNoKernelCopy }, true},
+		{"partial copy_file_range", noReflink, partialRange(), true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reflink, copyRange = test.reflink, test.copyRange
+			source, target := t.TempDir(), t.TempDir()
+			content := []byte("kernel copy content")
+			os.WriteFile(filepath.Join(source, "a"), content, 0644)
+
+			f := NewFS(lifecycle.New(), Options{}).(*fsys)
+			defer f.Quit()
+			hashes := scanned(t, f, source)
+			info, _ := os.Lstat(filepath.Join(source, "a"))
+			copy := copy{path: "a", hash: hashes["a"], fromRoot: source, toRoots: []string{target}}
+
+			if kernel := f.kernelCopy(copy, target, info); kernel == test.fallback {
+				t.Fatalf("kernel copy %v, expected fallback %v", kernel, test.fallback)
+			}
+			tempPath, _ := copyPaths(target, "a")
+			if _, err := os.Stat(tempPath); !os.IsNotExist(err) {
+				t.Errorf("the temp file was left behind: %v", err)
+			}
+			if test.fallback {
+				// The streaming copy takes over.
+				f.copyFile(copy)
+			} else if progress := waitFor[fs.CopyProgress](t, f.events); progress.Copyed != len(content) {
+				t.Errorf("progress %d, expected %d", progress.Copyed, len(content))
+			}
+			waitFor[fs.CopyVerified](t, f.events)
+			if copied, _ := os.ReadFile(filepath.Join(target, "a")); string(copied) != string(content) {
+				t.Errorf("unexpected content %q", copied)
+			}
+		})
+	}
+}
@@ -8,15 +8,37 @@ import (
 	iofs "io/fs"
 	"os"
 	"path/filepath"
-	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"golang.org/x/text/unicode/norm"
 )
 
 type fsys struct {
-	commands *stream.Stream[command]
-	events   chan fs.Event
-	lc       *lifecycle.Lifecycle
+	commands  *stream.Stream[command]
+	events    chan fs.Event
+	lc        *lifecycle.Lifecycle
+	opts      Options
+	hashPool  hashPool
+	index     *index
+	ignores   ignores
+	metaLocks metaLocks
+	scheduler scheduler
+	oplog     oplog
+}
+
+type Options struct {
+	HashMode         fs.HashMode
+	Hasher           string
+	HashWorkers      int // per storage device
+	Watch            bool
+	GlobalIgnore     string        // path to an .arcignore file applied to every root
+	ScrubLimit       int           // maximum number of bytes verified per root in one scrub, 0 for no limit
+	CopyLanes        int           // concurrent copies per destination device
+	PreserveMetadata bool          // carry mode bits, ownership, extended attributes and folder times over to copies
+	TrashRetention   time.Duration // how long deleted files are kept in the trash, 0 to keep them until purged
+	DryRun           bool          // scan and read without any housekeeping: the archives and their meta files stay untouched
 }
 
 type command interface {
@@ -30,29 +52,78 @@ type (
 		hash     string
 		fromRoot string
 		toRoots  []string
+		batch    string
+		seq      int
 	}
 	rename struct {
 		root       string
 		sourcePath string
 		targetPath string
+		batch      string
+		seq        int
+	}
+	deleteCmd struct {
+		root  string
+		path  string
+		batch string
+		seq   int
 	}
-	delete struct {
+	scrub  struct{ root string }
+	verify struct {
+		root string
 		path string
 	}
+	trash   struct{ root string }
+	restore struct {
+		root  string
+		batch string
+		path  string
+	}
+	purge struct {
+		root  string
+		batch string
+		path  string
+	}
+	recovery struct {
+		root    string
+		batch   string
+		forward bool
+	}
 )
 
-func (scan) command()   {}
-func (copy) command()   {}
-func (rename) command() {}
-func (delete) command() {}
+func (scan) command()      {}
+func (copy) command()      {}
+func (rename) command()    {}
+func (deleteCmd) command() {}
+func (scrub) command()     {}
+func (verify) command()    {}
+func (trash) command()     {}
+func (restore) command()   {}
+func (purge) command()     {}
+func (recovery) command()  {}
 
 const bufSize = 256 * 1024
 
-func NewFS(lc *lifecycle.Lifecycle) fs.FS {
+func NewFS(lc *lifecycle.Lifecycle, opts Options) fs.FS {
+	if _, ok := hashers[opts.Hasher]; !ok {
+		opts.Hasher = DefaultHasher
+	}
+	if opts.HashWorkers < 1 {
+		opts.HashWorkers = 1
+	}
+	if opts.CopyLanes < 1 {
+		opts.CopyLanes = 1
+	}
 	fs := &fsys{
-		commands: stream.NewStream[command]("commands"),
-		events:   make(chan fs.Event, 256),
-		lc:       lc,
+		commands:  stream.NewStream[command]("commands"),
+		events:    make(chan fs.Event, 256),
+		lc:        lc,
+		opts:      opts,
+		hashPool:  hashPool{queues: map[uint64]chan hashJob{}},
+		index:     newIndex(),
+		ignores:   ignores{roots: map[string]*ignoreRules{}},
+		metaLocks: metaLocks{roots: map[string]*sync.Mutex{}},
+		scheduler: scheduler{active: map[uint64]int{}, running: map[*job]bool{}},
 	}
 	go fs.run()
 	return fs
@@ -67,15 +138,48 @@ func (fs *fsys) Scan(root string) {
 }
 
 func (fs *fsys) Copy(path, hash, fromRoot string, toRoots ...string) {
-	fs.commands.Push(copy{path: path, hash: hash, fromRoot: fromRoot, toRoots: toRoots})
+	batch, seq := fs.nextOp()
+	fs.commands.Push(copy{path: path, hash: hash, fromRoot: fromRoot, toRoots: toRoots, batch: batch, seq: seq})
 }
 
 func (fs *fsys) Rename(root, sourcePath, targetPath string) {
-	fs.commands.Push(rename{root: root, sourcePath: sourcePath, targetPath: targetPath})
+	batch, seq := fs.nextOp()
+	fs.commands.Push(rename{root: root, sourcePath: sourcePath, targetPath: targetPath, batch: batch, seq: seq})
+}
+
+func (fs *fsys) Delete(root, path string) {
+	batch, seq := fs.nextOp()
+	fs.commands.Push(deleteCmd{root: root, path: path, batch: batch, seq: seq})
+}
+
+func (fs *fsys) Scrub(root string) {
+	fs.commands.Push(scrub{root: root})
+}
+
+func (fs *fsys) Verify(root, path string) {
+	fs.commands.Push(verify{root: root, path: path})
+}
+
+func (fs *fsys) Trash(root string) {
+	fs.commands.Push(trash{root: root})
+}
+
+func (fs *fsys) Restore(root, batch, path string) {
+	fs.commands.Push(restore{root: root, batch: batch, path: path})
+}
+
+func (fs *fsys) Purge(root, batch, path string) {
+	fs.commands.Push(purge{root: root, batch: batch, path: path})
 }
 
-func (fs *fsys) Delete(path string) {
-	fs.commands.Push(delete{path: path})
+// Batch starts a new batch for the operations issued from now on, including
+// files created through the Streamer.
+func (fs *fsys) Batch() {
+	fs.startBatch()
+}
+
+func (fs *fsys) Recover(root, batch string, forward bool) {
+	fs.commands.Push(recovery{root: root, batch: batch, forward: forward})
 }
 
 func (fs *fsys) Quit() {
@@ -98,8 +202,19 @@ func AbsPath(path string) (string, error) {
 	return path, nil
 }
 
+// reportDiskSpace reports the space left on the root's volume.
+func (f *fsys) reportDiskSpace(root string) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(root, &stat); err != nil {
+		f.events <- fs.Error{Path: root, Error: err}
+		return
+	}
+	f.events <- fs.DiskSpace{Root: root, Free: int(stat.Bavail) * int(stat.Bsize)}
+}
+
 func (f *fsys) run() {
-	for {
+	// A closed stream returns at once, so the loop ends with the quit.
+	for !f.lc.ShoudStop() {
 		for _, command := range f.commands.Pull() {
 			if f.lc.ShoudStop() {
 				return
@@ -108,11 +223,23 @@ func (f *fsys) run() {
 			case scan:
 				go f.scanArchive(cmd)
 			case copy:
-				f.copyFile(cmd)
+				f.schedule(f.copyJob(cmd))
 			case rename:
-				f.renameFile(cmd)
-			case delete:
-				f.deleteFile(cmd)
+				f.schedule(f.renameJob(cmd))
+			case deleteCmd:
+				f.schedule(f.deleteJob(cmd))
+			case scrub:
+				go f.scrubArchive(cmd)
+			case verify:
+				f.schedule(f.verifyJob(cmd))
+			case trash:
+				go f.listTrash(cmd)
+			case restore:
+				f.schedule(f.restoreJob(cmd))
+			case purge:
+				f.schedule(f.purgeJob(cmd))
+			case recovery:
+				f.schedule(f.recoveryJob(cmd))
 			}
 		}
 	}
@@ -128,51 +255,75 @@ func (f *fsys) renameFile(rename rename) {
 	}
 	from := filepath.Join(rename.root, rename.sourcePath)
 	to := filepath.Join(rename.root, rename.targetPath)
+	// The index is updated first so that the watcher recognizes the rename as our own.
+	moved := f.index.move(rename.root, rename.sourcePath, rename.targetPath)
 	err = os.Rename(from, to)
 	if err != nil {
+		f.index.move(rename.root, rename.targetPath, rename.sourcePath)
 		f.events <- fs.Error{Path: to, Error: err}
 		return
 	}
+	// Files coming back from an ignored folder, like the conflicts folder,
+	// are new to the archive.
+	if f.ignored(rename.root, rename.sourcePath, false) && !f.ignored(rename.root, rename.targetPath, false) {
+		for _, meta := range moved {
+			f.events <- *meta.file
+		}
+	}
 	f.events <- fs.Renamed{
 		Root:       rename.root,
 		SourcePath: rename.sourcePath,
 		TargetPath: rename.targetPath,
 	}
-	f.removeDirIfEmpty(filepath.Dir(from))
+	f.removeDirIfEmpty(rename.root, filepath.Dir(rename.sourcePath))
 }
 
-func (f *fsys) deleteFile(delete delete) {
-	log.Debug("delete", "path", delete.path)
-	err := os.Remove(delete.path)
+// deleteFile moves the file to the trash and returns the trash batch, or an
+// empty string if it failed.
+func (f *fsys) deleteFile(delete deleteCmd) string {
+	log.Debug("delete", "root", delete.root, "path", delete.path)
+	path := filepath.Join(delete.root, delete.path)
+	known := f.index.get(delete.root, delete.path)
+	f.index.remove(delete.root, delete.path)
+	batch, err := f.moveToTrash(delete.root, delete.path, trashBatch())
 	if err != nil {
-		f.events <- fs.Error{Path: delete.path, Error: err}
-		return
+		if known != nil {
+			f.index.set(delete.root, known)
+		}
+		f.events <- fs.Error{Path: path, Error: err}
+		return ""
 	}
-	f.events <- fs.Deleted{Path: delete.path}
-	f.removeDirIfEmpty(filepath.Dir(delete.path))
+	f.events <- fs.Deleted{Root: delete.root, Path: delete.path, Batch: batch}
+	f.removeDirIfEmpty(delete.root, filepath.Dir(delete.path))
+	return batch
 }
 
-func (f *fsys) removeDirIfEmpty(path string) {
+// removeDirIfEmpty removes the folder if nothing but ignored entries are left
+// in it. The ignored entries go to the trash along with the folder.
+func (f *fsys) removeDirIfEmpty(root, dir string) {
+	if dir == "." {
+		return
+	}
+	path := filepath.Join(root, dir)
 	fsys := os.DirFS(path)
 
 	entries, _ := iofs.ReadDir(fsys, ".")
 	hasFiles := false
 	for _, entry := range entries {
-		if entry.Name() != ".DS_Store" && !strings.HasPrefix(entry.Name(), "._") {
-			info, err := entry.Info()
-			if err != nil {
-				f.events <- fs.Error{Path: path, Error: err}
-				return
-			}
-
-			size := int(info.Size())
-			if size > 0 {
-				hasFiles = true
-				break
-			}
+		if !f.ignored(root, filepath.Join(dir, entry.Name()), entry.IsDir()) {
+			hasFiles = true
+			break
 		}
 	}
-	if !hasFiles {
-		os.RemoveAll(path)
+	if hasFiles {
+		return
+	}
+	batch := trashBatch()
+	for _, entry := range entries {
+		if _, err := f.moveToTrash(root, filepath.Join(dir, entry.Name()), batch); err != nil {
+			f.events <- fs.Error{Path: filepath.Join(path, entry.Name()), Error: err}
+			return
+		}
 	}
+	os.Remove(path)
 }
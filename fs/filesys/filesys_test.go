@@ -0,0 +1,55 @@
+package filesys
+
+import (
+	"arc/fs"
+	"arc/log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	log.SetLogger(filepath.Join(os.TempDir(), "arc-test-filesys.log"))
+	os.Exit(m.Run())
+}
+
+// waitFor returns the first event of the type T, failing the test if it
+// takes too long. It fails on errors, unless they are the event waited for.
+func waitFor[T fs.Event](t *testing.T, events <-chan fs.Event) T {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-events:
+			if found, ok := event.(T); ok {
+				return found
+			}
+			if err, ok := event.(fs.Error); ok {
+				t.Fatalf("unexpected error %v: %v", err.Path, err.Error)
+			}
+		case <-timeout:
+			var none T
+			t.Fatalf("timeout waiting for %T", none)
+			return none
+		}
+	}
+}
+
+// scanned scans the roots and returns the hashes of their files by path.
+func scanned(t *testing.T, f *fsys, roots ...string) map[string]string {
+	t.Helper()
+	hashes := map[string]string{}
+	for _, root := range roots {
+		f.Scan(root)
+		for done := false; !done; {
+			switch event := waitFor[fs.Event](t, f.events).(type) {
+			case fs.FileHashed:
+				hashes[event.Path] = event.Hash
+			case fs.ArchiveHashed:
+				done = event.Root == root
+			}
+		}
+	}
+	return hashes
+}
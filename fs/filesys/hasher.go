@@ -0,0 +1,105 @@
+package filesys
+
+import (
+	"arc/fs"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"hash/crc64"
+	"hash/fnv"
+	"io"
+	"slices"
+)
+
+const DefaultHasher = "sha256"
+
+var crc64Table = crc64.MakeTable(crc64.ECMA)
+
+var hashers = map[string]func() hash.Hash{
+	"sha256":     sha256.New,
+	"sha512/256": sha512.New512_256,
+	"crc64":      func() hash.Hash { return crc64.New(crc64Table) },
+	"fnv128":     fnv.New128a,
+}
+
+// Hashers returns the names of all registered hash algorithms.
+func Hashers() []string {
+	names := make([]string, 0, len(hashers))
+	for name := range hashers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func (f *fsys) newHash() hash.Hash {
+	return hashers[f.opts.Hasher]()
+}
+
+func (f *fsys) hashString(text string) string {
+	return HashString(f.opts.Hasher, text)
+}
+
+// HashString hashes the text that stands for the content of a folder or a
+// symlink.
+func HashString(algorithm, text string) string {
+	hash := hashers[algorithm]()
+	hash.Write([]byte(text))
+	return base64.RawURLEncoding.EncodeToString(hash.Sum(nil))
+}
+
+// HashXattrs hashes extended attributes in name order. It returns an empty
+// string if there are none.
+func HashXattrs(algorithm string, attrs map[string][]byte) string {
+	if len(attrs) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	hash := hashers[algorithm]()
+	for _, name := range names {
+		fmt.Fprintf(hash, "%s\x00%d\x00", name, len(attrs[name]))
+		hash.Write(attrs[name])
+	}
+	return base64.RawURLEncoding.EncodeToString(hash.Sum(nil))
+}
+
+// HashStream hashes size bytes of content read from r the way the scanner
+// hashes a file of that size, so other backends produce the same hashes.
+func HashStream(r io.Reader, size int, mode fs.HashMode, algorithm string) (string, error) {
+	newHash, ok := hashers[algorithm]
+	if !ok {
+		return "", fmt.Errorf("unknown hash algorithm %q", algorithm)
+	}
+	hash := newHash()
+	if mode == fs.FullHash {
+		if _, err := io.Copy(hash, r); err != nil {
+			return "", err
+		}
+		return base64.RawURLEncoding.EncodeToString(hash.Sum(nil)), nil
+	}
+
+	// The same samples hashSampled reads: the first and the last bufSize bytes.
+	head := min(size, bufSize)
+	if _, err := io.CopyN(hash, r, int64(head)); err != nil && err != io.EOF {
+		return "", err
+	}
+	if size > bufSize {
+		offset := bufSize
+		if size > 2*bufSize {
+			offset = size - bufSize
+		}
+		if _, err := io.CopyN(io.Discard, r, int64(offset-head)); err != nil && err != io.EOF {
+			return "", err
+		}
+		if _, err := io.Copy(hash, r); err != nil {
+			return "", err
+		}
+	}
+	return base64.RawURLEncoding.EncodeToString(hash.Sum(nil)), nil
+}
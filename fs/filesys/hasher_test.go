@@ -0,0 +1,76 @@
+package filesys
+
+import (
+	"arc/fs"
+	"arc/lifecycle"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHashModes(t *testing.T) {
+	// The files differ only in the middle, which a sampled hash skips.
+	content := make([]byte, 3*bufSize)
+	changed := make([]byte, 3*bufSize)
+	changed[len(changed)/2] = 1
+
+	tests := []struct {
+		mode      fs.HashMode
+		algorithm string
+		same      bool
+	}{
+		{fs.SampledHash, "sha256", true},
+		{fs.FullHash, "sha256", false},
+		{fs.FullHash, "fnv128", false},
+		{fs.SampledHash, "crc64", true},
+	}
+	for _, test := range tests {
+		t.Run(test.mode.String()+"/"+test.algorithm, func(t *testing.T) {
+			root := t.TempDir()
+			os.WriteFile(filepath.Join(root, "a"), content, 0644)
+			os.WriteFile(filepath.Join(root, "b"), changed, 0644)
+
+			f := NewFS(lifecycle.New(), Options{HashMode: test.mode, Hasher: test.algorithm}).(*fsys)
+			defer f.Quit()
+			hashes := scanned(t, f, root)
+			if same := hashes["a"] == hashes["b"]; same != test.same {
+				t.Errorf("same hash %v, expected %v", same, test.same)
+			}
+
+			file, err := os.Open(filepath.Join(root, hashFileName))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			metas, err := readMetaRecords(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(metas) != 2 {
+				t.Errorf("%d files recorded, expected 2", len(metas))
+			}
+			for _, meta := range metas {
+				if meta.file.HashMode != test.mode || meta.file.Algorithm != test.algorithm {
+					t.Errorf("%s recorded as %v %s", meta.file.Path, meta.file.HashMode, meta.file.Algorithm)
+				}
+			}
+		})
+	}
+}
+
+func TestMetaOfOtherAlgorithm(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "a"), []byte("content"), 0644)
+	f := NewFS(lifecycle.New(), Options{Hasher: "sha256"}).(*fsys)
+	scanned(t, f, root)
+	f.Quit()
+
+	for _, algorithm := range []string{"sha256", "fnv128"} {
+		f := NewFS(lifecycle.New(), Options{Hasher: algorithm}).(*fsys)
+		cache := f.readMeta(root)
+		if cached := cache.byPath["a"] != nil; cached != (algorithm == "sha256") {
+			t.Errorf("%s: cached %v", algorithm, cached)
+		}
+		f.Quit()
+	}
+}
@@ -0,0 +1,73 @@
+package filesys
+
+import (
+	"arc/fs"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// hashJob is a single file waiting to be hashed by one of the device workers.
+type hashJob struct {
+	file *fs.FileMeta
+	done func()
+}
+
+// hashPool runs a fixed number of hashing workers per storage device, so that
+// roots sharing a disk don't compete for it while roots on different disks
+// are hashed in parallel.
+type hashPool struct {
+	sync.Mutex
+	queues map[uint64]chan hashJob
+}
+
+func (f *fsys) hashFiles(root string, files []*fs.FileMeta) {
+	queue := f.hashQueue(deviceOf(root))
+	wg := &sync.WaitGroup{}
+	for _, file := range files {
+		wg.Add(1)
+		queue <- hashJob{file: file, done: wg.Done}
+	}
+	wg.Wait()
+}
+
+func (f *fsys) hashQueue(device uint64) chan hashJob {
+	f.hashPool.Lock()
+	defer f.hashPool.Unlock()
+
+	if queue, ok := f.hashPool.queues[device]; ok {
+		return queue
+	}
+	queue := make(chan hashJob, f.opts.HashWorkers)
+	f.hashPool.queues[device] = queue
+	for i := 0; i < f.opts.HashWorkers; i++ {
+		go f.hashWorker(queue)
+	}
+	return queue
+}
+
+func (f *fsys) hashWorker(queue chan hashJob) {
+	for job := range queue {
+		if !f.lc.ShoudStop() {
+			job.file.Hash = f.hashFile(job.file)
+			if job.file.Hash != "" {
+				f.events <- fs.FileHashed{
+					Root:      job.file.Root,
+					Path:      job.file.Path,
+					Hash:      job.file.Hash,
+					HashMode:  job.file.HashMode,
+					Algorithm: job.file.Algorithm,
+				}
+			}
+		}
+		job.done()
+	}
+}
+
+func deviceOf(path string) uint64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return uint64(info.Sys().(*syscall.Stat_t).Dev)
+}
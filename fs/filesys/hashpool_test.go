@@ -0,0 +1,44 @@
+package filesys
+
+import (
+	"arc/fs"
+	"arc/lifecycle"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHashPool(t *testing.T) {
+	f := NewFS(lifecycle.New(), Options{HashWorkers: 2}).(*fsys)
+	defer f.Quit()
+
+	// Roots on one device share its workers, other devices get their own.
+	a, b := t.TempDir(), t.TempDir()
+	if deviceOf(a) != deviceOf(b) {
+		t.Skip("temp dirs on different devices")
+	}
+	if f.hashQueue(deviceOf(a)) != f.hashQueue(deviceOf(b)) {
+		t.Error("roots on the same device hashed by different workers")
+	}
+	if f.hashQueue(deviceOf(a)) == f.hashQueue(deviceOf(a)+1) {
+		t.Error("another device hashed by the same workers")
+	}
+	if cap(f.hashQueue(deviceOf(a))) != 2 {
+		t.Errorf("queue of %d, expected one per worker", cap(f.hashQueue(deviceOf(a))))
+	}
+
+	var files []*fs.FileMeta
+	for _, name := range []string{"x", "y", "z"} {
+		os.WriteFile(filepath.Join(a, name), []byte(name), 0644)
+		files = append(files, &fs.FileMeta{Root: a, Path: name, Size: 1, HashMode: f.opts.HashMode, Algorithm: f.opts.Hasher})
+	}
+	go f.hashFiles(a, files)
+	hashed := map[string]bool{}
+	for range files {
+		event := waitFor[fs.FileHashed](t, f.events)
+		hashed[event.Path] = event.Hash != ""
+	}
+	if !hashed["x"] || !hashed["y"] || !hashed["z"] {
+		t.Errorf("hashed %v", hashed)
+	}
+}
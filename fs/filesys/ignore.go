@@ -0,0 +1,207 @@
+package filesys
+
+import (
+	"arc/fs"
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const ignoreFileName = ".arcignore"
+
+// defaultIgnore skips the files macOS leaves behind. It comes first, so it
+// can be overridden with negated patterns.
+var defaultIgnore = []string{".DS_Store", "._*"}
+
+type ignores struct {
+	sync.Mutex
+	roots map[string]*ignoreRules
+}
+
+type ignorePattern struct {
+	regexp  *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// ignoreRules implements the gitignore pattern syntax: globs, "**",
+// negation with "!" and directory-only patterns with a trailing "/".
+type ignoreRules struct {
+	patterns []ignorePattern
+}
+
+func newIgnoreRules(lines ...string) *ignoreRules {
+	rules := &ignoreRules{}
+	for _, line := range lines {
+		rules.add(line)
+	}
+	return rules
+}
+
+// readIgnoreFile adds patterns from the file, if it exists.
+func (rules *ignoreRules) readIgnoreFile(path string) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		rules.add(scanner.Text())
+	}
+	return scanner.Err()
+}
+
+func (rules *ignoreRules) add(line string) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return
+	}
+
+	pattern := ignorePattern{}
+	if strings.HasPrefix(line, "!") {
+		pattern.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		pattern.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return
+	}
+
+	// Patterns without a slash match at any depth.
+	if strings.Contains(line, "/") {
+		line = strings.TrimPrefix(line, "/")
+	} else {
+		line = "**/" + line
+	}
+
+	re, err := regexp.Compile("^" + globToRegexp(line) + "$")
+	if err != nil {
+		return
+	}
+	pattern.regexp = re
+	rules.patterns = append(rules.patterns, pattern)
+}
+
+func globToRegexp(glob string) string {
+	buf := &strings.Builder{}
+	for i := 0; i < len(glob); i++ {
+		ch := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			buf.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "/**") && i+3 == len(glob):
+			buf.WriteString("/.*")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			buf.WriteString(".*")
+			i++
+		case ch == '*':
+			buf.WriteString("[^/]*")
+		case ch == '?':
+			buf.WriteString("[^/]")
+		case ch == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				buf.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			buf.WriteString("[" + class + "]")
+			i += end + 1
+		case ch == '\\' && i+1 < len(glob):
+			i++
+			buf.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		default:
+			buf.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	return buf.String()
+}
+
+// ignored reports whether the slash separated path relative to the root is
+// excluded. As in git, nothing under an excluded folder can be re-included.
+func (rules *ignoreRules) ignored(path string, isDir bool) bool {
+	parts := strings.Split(path, "/")
+	for i := 1; i < len(parts); i++ {
+		if rules.match(strings.Join(parts[:i], "/"), true) {
+			return true
+		}
+	}
+	return rules.match(path, isDir)
+}
+
+func (rules *ignoreRules) match(path string, isDir bool) bool {
+	result := false
+	for _, pattern := range rules.patterns {
+		if pattern.dirOnly && !isDir {
+			continue
+		}
+		if pattern.regexp.MatchString(path) {
+			result = !pattern.negate
+		}
+	}
+	return result
+}
+
+// loadIgnoreRules reads the global and the root's ignore files. Besides them
+// only arc's own files and the macOS litter are ignored, other hidden files
+// are not: a lost .keep marker is as much a difference as any other file.
+func (f *fsys) loadIgnoreRules(root string) *ignoreRules {
+	rules := newIgnoreRules(defaultIgnore...)
+	if f.opts.GlobalIgnore != "" {
+		if err := rules.readIgnoreFile(f.opts.GlobalIgnore); err != nil {
+			f.events <- fs.Error{Path: f.opts.GlobalIgnore, Error: err}
+		}
+	}
+	path := filepath.Join(root, ignoreFileName)
+	if err := rules.readIgnoreFile(path); err != nil {
+		f.events <- fs.Error{Path: path, Error: err}
+	}
+
+	f.ignores.Lock()
+	f.ignores.roots[root] = rules
+	f.ignores.Unlock()
+	return rules
+}
+
+// ignored reports whether the path relative to the root is excluded from the archive.
+func (f *fsys) ignored(root, path string, isDir bool) bool {
+	if path == hashFileName || path == lockFileName || path == ignoreFileName || path == oplogFileName || path == oplogFileName+".tmp" {
+		return true
+	}
+	if matched, _ := filepath.Match(hashTempName, path); matched {
+		return true
+	}
+	for _, dir := range []string{trashDirName, fs.ConflictsDir} {
+		if path == dir || strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			return true
+		}
+	}
+	if name := filepath.Base(path); strings.HasPrefix(name, copyTempPrefix) || strings.HasPrefix(name, resumePrefix) {
+		return true
+	}
+	f.ignores.Lock()
+	rules := f.ignores.roots[root]
+	f.ignores.Unlock()
+	if rules == nil {
+		rules = f.loadIgnoreRules(root)
+	}
+	return rules.ignored(filepath.ToSlash(path), isDir)
+}
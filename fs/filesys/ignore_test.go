@@ -0,0 +1,95 @@
+package filesys
+
+import "testing"
+
+func TestIgnoreRules(t *testing.T) {
+	rules := newIgnoreRules(
+		".*",
+		"!.keep",
+		"*.tmp",
+		"build/",
+		"/cache",
+		"docs/**/draft-*",
+		"media/**",
+		"!media/keep.jpg",
+		"# comment",
+		`\#literal`,
+		"[ab]?.log",
+	)
+
+	tests := []struct {
+		path    string
+		isDir   bool
+		ignored bool
+	}{
+		{".DS_Store", false, true},
+		{"a/._photo.jpg", false, true},
+		{"a/.keep", false, false},
+		{"a/b/file.tmp", false, true},
+		{"file.tmpx", false, false},
+		{"build", true, true},
+		{"src/build", true, true},
+		{"src/build", false, false},
+		{"src/build/out.o", false, true},
+		{"cache", true, true},
+		{"src/cache", true, false},
+		{"docs/draft-1.md", false, true},
+		{"docs/a/b/draft-2.md", false, true},
+		{"docs/a/final.md", false, false},
+		{"media/a.jpg", false, true},
+		{"media/keep.jpg", false, false},
+		{"#literal", false, true},
+		{"comment", false, false},
+		{"a1.log", false, true},
+		{"c1.log", false, false},
+		{"photos/2023/img.jpg", false, false},
+	}
+
+	for _, test := range tests {
+		if got := rules.ignored(test.path, test.isDir); got != test.ignored {
+			t.Errorf("ignored(%q, %v) = %v, want %v", test.path, test.isDir, got, test.ignored)
+		}
+	}
+}
+
+func TestDefaultIgnores(t *testing.T) {
+	tests := []struct {
+		rules   []string
+		path    string
+		ignored bool
+	}{
+		{nil, ".DS_Store", true},
+		{nil, "a/.DS_Store", true},
+		{nil, "a/._photo.jpg", true},
+		{nil, "a/.keep", false},
+		{nil, "a/__init__.py", false},
+		{[]string{"!.DS_Store"}, "a/.DS_Store", false},
+	}
+
+	for _, test := range tests {
+		rules := newIgnoreRules(append(defaultIgnore, test.rules...)...)
+		if got := rules.ignored(test.path, false); got != test.ignored {
+			t.Errorf("ignored(%q) with %q = %v, want %v", test.path, test.rules, got, test.ignored)
+		}
+	}
+}
+
+func TestBuiltinIgnores(t *testing.T) {
+	f := &fsys{ignores: ignores{roots: map[string]*ignoreRules{"/a": newIgnoreRules()}}}
+	tests := []struct {
+		path    string
+		ignored bool
+	}{
+		{".meta.csv", true},
+		{".meta.csv.123456.tmp", true},
+		{"docs/.meta.csv.123456.tmp", false},
+		{".meta.csv.bak", false},
+		{"docs/x", false},
+	}
+
+	for _, test := range tests {
+		if got := f.ignored("/a", test.path, false); got != test.ignored {
+			t.Errorf("ignored(%q) = %v, want %v", test.path, got, test.ignored)
+		}
+	}
+}
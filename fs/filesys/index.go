@@ -0,0 +1,186 @@
+package filesys
+
+import (
+	"arc/fs"
+	pathpkg "path"
+	"sync"
+)
+
+// index keeps the last known state of every file under every scanned root.
+// It lets the watcher tell changes made by arc itself from external ones.
+type index struct {
+	sync.Mutex
+	roots map[string]*rootIndex
+}
+
+// rootIndex finds files by path, the files under a folder by walking its
+// children, and hard links by inode, without going through every file.
+type rootIndex struct {
+	files    map[string]*meta
+	children map[string]map[string]bool // folder to the paths of its files and folders
+	inodes   map[uint64]map[string]bool // regular files by inode
+}
+
+func newIndex() *index {
+	return &index{roots: map[string]*rootIndex{}}
+}
+
+func (idx *index) get(root, path string) *meta {
+	idx.Lock()
+	defer idx.Unlock()
+	if files := idx.roots[root]; files != nil {
+		return files.files[path]
+	}
+	return nil
+}
+
+func (idx *index) set(root string, file *meta) {
+	idx.Lock()
+	defer idx.Unlock()
+	files := idx.roots[root]
+	if files == nil {
+		files = &rootIndex{
+			files:    map[string]*meta{},
+			children: map[string]map[string]bool{},
+			inodes:   map[uint64]map[string]bool{},
+		}
+		idx.roots[root] = files
+	}
+	files.remove(file.file.Path)
+	files.add(file)
+}
+
+// contains reports whether path is a known file or a folder with known files.
+func (idx *index) contains(root, path string) bool {
+	idx.Lock()
+	defer idx.Unlock()
+	files := idx.roots[root]
+	if files == nil {
+		return false
+	}
+	_, ok := files.files[path]
+	return ok || len(files.children[path]) > 0
+}
+
+// remove forgets a file or, if path is a folder, every file under it.
+func (idx *index) remove(root, path string) {
+	idx.Lock()
+	defer idx.Unlock()
+	if files := idx.roots[root]; files != nil {
+		for _, file := range files.under(path) {
+			files.remove(file.file.Path)
+		}
+	}
+}
+
+// move renames a file or, if path is a folder, every file under it, and
+// returns what it moved.
+func (idx *index) move(root, sourcePath, targetPath string) []*meta {
+	idx.Lock()
+	defer idx.Unlock()
+	files := idx.roots[root]
+	if files == nil {
+		return []*meta{}
+	}
+	moved := files.under(sourcePath)
+	for _, file := range moved {
+		files.remove(file.file.Path)
+	}
+	for _, file := range moved {
+		file.file.Path = targetPath + file.file.Path[len(sourcePath):]
+		files.remove(file.file.Path)
+		files.add(file)
+	}
+	return moved
+}
+
+// links returns the paths of all known hard links to the inode.
+func (idx *index) links(root string, inode uint64) []string {
+	idx.Lock()
+	defer idx.Unlock()
+	files := idx.roots[root]
+	if files == nil {
+		return nil
+	}
+	paths := make([]string, 0, len(files.inodes[inode]))
+	for path := range files.inodes[inode] {
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// paths returns the paths of every known file of the root.
+func (idx *index) paths(root string) []string {
+	idx.Lock()
+	defer idx.Unlock()
+	files := idx.roots[root]
+	if files == nil {
+		return nil
+	}
+	paths := make([]string, 0, len(files.files))
+	for path := range files.files {
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+func (files *rootIndex) add(file *meta) {
+	path := file.file.Path
+	files.files[path] = file
+	if file.file.Kind == fs.RegularFile {
+		if files.inodes[file.inode] == nil {
+			files.inodes[file.inode] = map[string]bool{}
+		}
+		files.inodes[file.inode][path] = true
+	}
+	// Folders are linked to their parents until one already is.
+	for path != "." && path != "" {
+		parent := pathpkg.Dir(path)
+		children := files.children[parent]
+		if children == nil {
+			children = map[string]bool{}
+			files.children[parent] = children
+		}
+		if children[path] {
+			return
+		}
+		children[path] = true
+		path = parent
+	}
+}
+
+// remove forgets the file at path and the folders it leaves empty.
+func (files *rootIndex) remove(path string) {
+	file := files.files[path]
+	if file == nil {
+		return
+	}
+	delete(files.files, path)
+	if links := files.inodes[file.inode]; links != nil {
+		delete(links, path)
+		if len(links) == 0 {
+			delete(files.inodes, file.inode)
+		}
+	}
+	for path != "." && path != "" {
+		if len(files.children[path]) > 0 || files.files[path] != nil {
+			return
+		}
+		delete(files.children, path)
+		parent := pathpkg.Dir(path)
+		delete(files.children[parent], path)
+		path = parent
+	}
+}
+
+// under returns the file at path and every file under it.
+func (files *rootIndex) under(path string) []*meta {
+	var found []*meta
+	if file := files.files[path]; file != nil {
+		found = append(found, file)
+	}
+	for child := range files.children[path] {
+		found = append(found, files.under(child)...)
+	}
+	return found
+}
@@ -0,0 +1,53 @@
+package filesys
+
+import (
+	"arc/fs"
+	"slices"
+	"testing"
+)
+
+func TestIndex(t *testing.T) {
+	idx := newIndex()
+	for _, file := range []struct {
+		path  string
+		inode uint64
+	}{
+		{"a/b/c", 1},
+		{"a/b/d", 2},
+		{"a/e", 1},
+		{"f", 3},
+	} {
+		idx.set("/r", &meta{inode: file.inode, file: &fs.FileMeta{Root: "/r", Path: file.path}})
+	}
+	idx.move("/r", "a/b", "g")
+	idx.remove("/r", "f")
+
+	tests := []struct {
+		path     string
+		contains bool
+	}{
+		{"a", true},
+		{"a/b", false},
+		{"a/b/c", false},
+		{"a/e", true},
+		{"g", true},
+		{"g/c", true},
+		{"g/d", true},
+		{"f", false},
+		{"a/", false},
+	}
+	for _, test := range tests {
+		if got := idx.contains("/r", test.path); got != test.contains {
+			t.Errorf("contains(%q) = %v, want %v", test.path, got, test.contains)
+		}
+	}
+
+	links := idx.links("/r", 1)
+	slices.Sort(links)
+	if !slices.Equal(links, []string{"a/e", "g/c"}) {
+		t.Errorf("links(1) = %v", links)
+	}
+	if file := idx.get("/r", "g/d"); file == nil || file.file.Path != "g/d" {
+		t.Errorf("get(g/d) = %v", file)
+	}
+}
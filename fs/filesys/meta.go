@@ -0,0 +1,370 @@
+package filesys
+
+import (
+	"arc/fs"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// The meta file caches hashes of the archive's files between runs.
+//
+// Since version 2 the file starts with a version record followed by a header
+// record naming the columns. Files without the version record are version 1:
+// a bare header with the first five columns and, later, the optional HashMode
+// and Algorithm. Version 3 adds the time of the last successful scrub and
+// version 4 the hash of the whole content of sampled files, which the scrub
+// records the first time it reads them.
+const (
+	hashFileName = ".meta.csv"
+	hashTempName = hashFileName + ".*.tmp" // pattern of the file replacing it
+	lockFileName = ".meta.lock"
+	metaMagic    = "arc-meta"
+	metaVersion  = 4
+)
+
+var metaColumns = []string{"INode", "Name", "Size", "ModTime", "Hash", "HashMode", "Algorithm", "Verified", "Content"}
+
+type meta struct {
+	inode    uint64
+	file     *fs.FileMeta
+	verified time.Time // last time the content was verified by a scrub
+	content  string    // full hash of a sampled file, empty until scrubbed
+}
+
+type metaLocks struct {
+	sync.Mutex
+	roots map[string]*sync.Mutex
+}
+
+// lockMeta serializes access to the root's meta file between the goroutines
+// of this process and, through flock, with other arc processes.
+func (f *fsys) lockMeta(root string) (unlock func()) {
+	f.metaLocks.Lock()
+	lock := f.metaLocks.roots[root]
+	if lock == nil {
+		lock = &sync.Mutex{}
+		f.metaLocks.roots[root] = lock
+	}
+	f.metaLocks.Unlock()
+
+	lock.Lock()
+	lockFile, err := os.OpenFile(filepath.Join(root, lockFileName), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return lock.Unlock
+	}
+	_ = syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX)
+	return func() {
+		_ = syscall.Flock(int(lockFile.Fd()), syscall.LOCK_UN)
+		_ = lockFile.Close()
+		lock.Unlock()
+	}
+}
+
+// metaCache holds the hashes read from the meta file. Inode numbers don't
+// survive restoring an archive from a backup or copying it to another disk,
+// and some file systems don't keep them stable at all, so files are also
+// looked up by their path, size and modification time.
+type metaCache struct {
+	byInode map[uint64]*meta
+	byPath  map[string]*meta
+}
+
+// lookup returns the cached meta of an unchanged file or nil. The path is
+// trusted first; a file found only by its inode counts just when it stands
+// at the same path or its path has no record, as the inode may belong to
+// another file on file systems that reuse inode numbers.
+func (cache *metaCache) lookup(inode uint64, file *fs.FileMeta) *meta {
+	unchanged := func(cached *meta) bool {
+		return cached != nil && cached.file.ModTime == file.ModTime && cached.file.Size == file.Size && cached.file.HashMode == file.HashMode
+	}
+	byPath := cache.byPath[file.Path]
+	if unchanged(byPath) {
+		return byPath
+	}
+	byInode := cache.byInode[inode]
+	if unchanged(byInode) && (byPath == nil || norm.NFC.String(byInode.file.Path) == file.Path) {
+		return byInode
+	}
+	return nil
+}
+
+func (s *fsys) readMeta(root string) *metaCache {
+	unlock := s.lockMeta(root)
+	defer unlock()
+
+	cache := &metaCache{
+		byInode: map[uint64]*meta{},
+		byPath:  map[string]*meta{},
+	}
+	absHashFileName := filepath.Join(root, hashFileName)
+	hashInfoFile, err := os.Open(absHashFileName)
+	if err != nil {
+		return cache
+	}
+	defer hashInfoFile.Close()
+
+	files, err := readMetaRecords(hashInfoFile)
+	if err != nil {
+		s.events <- fs.Error{Path: absHashFileName, Error: err}
+	}
+	for _, file := range files {
+		if file.file.Algorithm != s.opts.Hasher {
+			continue
+		}
+		file.file.Root = root
+		cache.byInode[file.inode] = file
+		cache.byPath[norm.NFC.String(file.file.Path)] = file
+	}
+	return cache
+}
+
+// readMetaRecords parses a meta file of any known version. A damaged tail,
+// left by a crash in the middle of an append, ends the file without losing
+// the records before it.
+func readMetaRecords(reader io.Reader) ([]*meta, error) {
+	csvReader := csv.NewReader(reader)
+	csvReader.FieldsPerRecord = -1
+
+	record, err := csvReader.Read()
+	if err != nil {
+		return nil, nil
+	}
+	if len(record) == 2 && record[0] == metaMagic {
+		version, err := strconv.Atoi(record[1])
+		if err != nil || version > metaVersion {
+			return nil, fmt.Errorf("unsupported meta file version %q", record[1])
+		}
+		record, err = csvReader.Read()
+		if err != nil {
+			return nil, nil
+		}
+	}
+
+	columns := map[string]int{}
+	for i, name := range record {
+		columns[name] = i
+	}
+	for _, name := range metaColumns[:5] {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("meta file is missing column %q", name)
+		}
+	}
+	column := func(record []string, name, defaultValue string) string {
+		if idx, ok := columns[name]; ok {
+			return record[idx]
+		}
+		return defaultValue
+	}
+
+	var result []*meta
+	for {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			break
+		}
+		if len(record) != len(columns) {
+			continue
+		}
+
+		iNode, er1 := strconv.ParseUint(column(record, "INode", ""), 10, 64)
+		path := column(record, "Name", "")
+		size, er2 := strconv.ParseUint(column(record, "Size", ""), 10, 64)
+		modTime, er3 := time.Parse(time.RFC3339, column(record, "ModTime", ""))
+		modTime = modTime.UTC().Round(time.Second)
+		hash := column(record, "Hash", "")
+		// Rows written before hash modes and algorithms were introduced
+		// hold sampled SHA-256 hashes.
+		hashMode, er4 := fs.ParseHashMode(column(record, "HashMode", fs.SampledHash.String()))
+		algorithm := column(record, "Algorithm", "sha256")
+		if hash == "" || er1 != nil || er2 != nil || er3 != nil || er4 != nil {
+			continue
+		}
+		var verified time.Time
+		if value := column(record, "Verified", ""); value != "" {
+			verified, _ = time.Parse(time.RFC3339, value)
+		}
+
+		result = append(result, &meta{
+			inode: iNode,
+			file: &fs.FileMeta{
+				Path:      path,
+				Size:      int(size),
+				ModTime:   modTime,
+				Hash:      hash,
+				HashMode:  hashMode,
+				Algorithm: algorithm,
+			},
+			verified: verified,
+			content:  column(record, "Content", ""),
+		})
+	}
+	return result, nil
+}
+
+// storeMeta replaces the meta file atomically: the new content is written
+// to a temporary file which is renamed over the old one once it is synced.
+// The meta file is never written in a dry run, by this or the functions
+// below.
+func (s *fsys) storeMeta(root string, metas []*meta) error {
+	if s.opts.DryRun {
+		return nil
+	}
+	unlock := s.lockMeta(root)
+	defer unlock()
+	return replaceMeta(root, metas)
+}
+
+// updateMeta rewrites the root's meta file with records changed by update.
+func (s *fsys) updateMeta(root string, update func(metas []*meta)) {
+	if s.opts.DryRun {
+		return
+	}
+	unlock := s.lockMeta(root)
+	defer unlock()
+
+	absHashFileName := filepath.Join(root, hashFileName)
+	hashInfoFile, err := os.Open(absHashFileName)
+	if err != nil {
+		s.events <- fs.Error{Path: absHashFileName, Error: err}
+		return
+	}
+	metas, err := readMetaRecords(hashInfoFile)
+	_ = hashInfoFile.Close()
+	if err != nil {
+		s.events <- fs.Error{Path: absHashFileName, Error: err}
+		return
+	}
+
+	update(metas)
+	err = replaceMeta(root, metas)
+	if err != nil {
+		s.events <- fs.Error{Path: absHashFileName, Error: err}
+	}
+}
+
+func replaceMeta(root string, metas []*meta) error {
+	tmpFile, err := os.CreateTemp(root, hashTempName)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	err = writeMetaRecords(tmpFile, metas)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if er := tmpFile.Close(); err == nil {
+		err = er
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpFile.Name(), filepath.Join(root, hashFileName))
+	if err != nil {
+		return err
+	}
+	if dir, err := os.Open(root); err == nil {
+		_ = dir.Sync()
+		_ = dir.Close()
+	}
+	return nil
+}
+
+func writeMetaRecords(writer io.Writer, metas []*meta) error {
+	csvWriter := csv.NewWriter(writer)
+	_ = csvWriter.Write([]string{metaMagic, fmt.Sprint(metaVersion)})
+	_ = csvWriter.Write(metaColumns)
+	for _, meta := range metas {
+		if meta.file.Hash == "" || meta.file.Kind != fs.RegularFile {
+			continue
+		}
+		_ = csvWriter.Write(metaRecord(meta))
+	}
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
+
+func metaRecord(meta *meta) []string {
+	verified := ""
+	if !meta.verified.IsZero() {
+		verified = meta.verified.UTC().Format(time.RFC3339)
+	}
+	return []string{
+		fmt.Sprint(meta.inode),
+		norm.NFC.String(meta.file.Path),
+		fmt.Sprint(meta.file.Size),
+		meta.file.ModTime.UTC().Format(time.RFC3339Nano),
+		meta.file.Hash,
+		meta.file.HashMode.String(),
+		meta.file.Algorithm,
+		verified,
+		meta.content,
+	}
+}
+
+// appendMeta adds a single freshly hashed file to the root's meta file.
+// A file in an older format is migrated first, so that the appended record
+// matches the header.
+func (s *fsys) appendMeta(root string, file *meta) {
+	if s.opts.DryRun {
+		return
+	}
+	unlock := s.lockMeta(root)
+	defer unlock()
+
+	absHashFileName := filepath.Join(root, hashFileName)
+	if !currentMetaVersion(absHashFileName) {
+		var metas []*meta
+		if hashInfoFile, err := os.Open(absHashFileName); err == nil {
+			metas, _ = readMetaRecords(hashInfoFile)
+			_ = hashInfoFile.Close()
+		}
+		err := replaceMeta(root, append(metas, file))
+		if err != nil {
+			s.events <- fs.Error{Path: absHashFileName, Error: err}
+		}
+		return
+	}
+
+	hashInfoFile, err := os.OpenFile(absHashFileName, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		s.events <- fs.Error{Path: absHashFileName, Error: err}
+		return
+	}
+	csvWriter := csv.NewWriter(hashInfoFile)
+	_ = csvWriter.Write(metaRecord(file))
+	csvWriter.Flush()
+	err = csvWriter.Error()
+	if err == nil {
+		err = hashInfoFile.Sync()
+	}
+	if er := hashInfoFile.Close(); err == nil {
+		err = er
+	}
+	if err != nil {
+		s.events <- fs.Error{Path: absHashFileName, Error: err}
+	}
+}
+
+// currentMetaVersion reports whether the meta file exists and is written in the current format.
+func currentMetaVersion(path string) bool {
+	hashInfoFile, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer hashInfoFile.Close()
+	record, err := csv.NewReader(hashInfoFile).Read()
+	return err == nil && len(record) == 2 && record[0] == metaMagic && record[1] == fmt.Sprint(metaVersion)
+}
@@ -0,0 +1,100 @@
+package filesys
+
+import (
+	"arc/fs"
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadLegacyMeta(t *testing.T) {
+	legacy := "INode,Name,Size,ModTime,Hash\n" +
+		"12,a/b.txt,100,2023-01-02T03:04:05Z,hash-b\n" +
+		"13,c.txt,200,2023-01-02T03:04:05Z,\n"
+
+	metas, err := readMetaRecords(strings.NewReader(legacy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metas) != 1 {
+		t.Fatalf("got %d records, want 1", len(metas))
+	}
+	file := metas[0].file
+	if metas[0].inode != 12 || file.Path != "a/b.txt" || file.Size != 100 || file.Hash != "hash-b" ||
+		file.HashMode != fs.SampledHash || file.Algorithm != "sha256" {
+		t.Errorf("unexpected record %v %v", metas[0].inode, file)
+	}
+}
+
+func TestMetaRoundTrip(t *testing.T) {
+	modTime := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	metas := []*meta{
+		{inode: 1, file: &fs.FileMeta{Path: "a", Size: 1, ModTime: modTime, Hash: "h1", HashMode: fs.FullHash, Algorithm: "fnv128"}},
+		{inode: 2, file: &fs.FileMeta{Path: "b", Size: 2, ModTime: modTime, Hash: "h2", Algorithm: "sha256"}, verified: modTime, content: "c2"},
+		{inode: 3, file: &fs.FileMeta{Path: "link", Kind: fs.Symlink, Hash: "h3"}},
+	}
+
+	buf := &bytes.Buffer{}
+	if err := writeMetaRecords(buf, metas); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), "arc-meta,4\n") {
+		t.Errorf("missing version record: %q", buf.String())
+	}
+
+	// Simulate a crash in the middle of an append.
+	buf.WriteString(`4,"c,4,2023`)
+
+	read, err := readMetaRecords(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != 2 {
+		t.Fatalf("got %d records, want 2", len(read))
+	}
+	for i, meta := range read {
+		if meta.inode != metas[i].inode || *meta.file != *metas[i].file || !meta.verified.Equal(metas[i].verified) || meta.content != metas[i].content {
+			t.Errorf("record %d: got %v, want %v", i, meta.file, metas[i].file)
+		}
+	}
+}
+
+func TestReadNewerMeta(t *testing.T) {
+	_, err := readMetaRecords(strings.NewReader("arc-meta,99\nINode,Name\n"))
+	if err == nil {
+		t.Error("expected an error for an unsupported version")
+	}
+}
+
+func TestMetaCacheLookup(t *testing.T) {
+	modTime := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	cached := &meta{inode: 7, file: &fs.FileMeta{Path: "a/b.txt", Size: 10, ModTime: modTime, Hash: "h"}}
+	cache := &metaCache{
+		byInode: map[uint64]*meta{7: cached},
+		byPath:  map[string]*meta{"a/b.txt": cached},
+	}
+
+	restored := &fs.FileMeta{Path: "a/b.txt", Size: 10, ModTime: modTime}
+	if cache.lookup(42, restored) != cached {
+		t.Error("a restored file with a new inode should be found by path")
+	}
+
+	moved := &fs.FileMeta{Path: "c.txt", Size: 10, ModTime: modTime}
+	if cache.lookup(7, moved) != cached {
+		t.Error("a moved file should be found by inode")
+	}
+
+	// An inode reused by another file must not hand it this file's hash.
+	other := &meta{inode: 8, file: &fs.FileMeta{Path: "d.txt", Size: 5, ModTime: modTime, Hash: "other"}}
+	cache.byPath["d.txt"] = other
+	reused := &fs.FileMeta{Path: "d.txt", Size: 10, ModTime: modTime}
+	if cache.lookup(7, reused) != nil {
+		t.Error("a reused inode should not be trusted over the path")
+	}
+
+	changed := &fs.FileMeta{Path: "a/b.txt", Size: 11, ModTime: modTime}
+	if cache.lookup(42, changed) != nil {
+		t.Error("a changed file should not be found")
+	}
+}
@@ -0,0 +1,96 @@
+package filesys
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+const preservedModeBits = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// xattrDigest hashes the extended attributes of path, so copies can be
+// compared without shipping the attributes around.
+func (f *fsys) xattrDigest(path string) string {
+	attrs, _ := readXattrs(path)
+	return HashXattrs(f.opts.Hasher, attrs)
+}
+
+// preserveMetadata carries the owner, the mode bits and the extended
+// attributes of source over to target if Options.PreserveMetadata is set.
+// The owner is only changed where the process is allowed to.
+func (f *fsys) preserveMetadata(source, target string) error {
+	if !f.opts.PreserveMetadata {
+		return nil
+	}
+	info, err := os.Lstat(source)
+	if err != nil {
+		return err
+	}
+	sys := info.Sys().(*syscall.Stat_t)
+	err = os.Lchown(target, int(sys.Uid), int(sys.Gid))
+	if err != nil && !errors.Is(err, os.ErrPermission) {
+		return err
+	}
+	// Symlinks have no mode bits of their own on Linux.
+	if info.Mode()&os.ModeSymlink == 0 {
+		if err := os.Chmod(target, info.Mode()&preservedModeBits); err != nil {
+			return err
+		}
+	}
+	return copyXattrs(source, target)
+}
+
+// makeDirs creates the folder dir and its parents in root. If
+// Options.PreserveMetadata is set, they get the owner and the extended
+// attributes of the same folders in fromRoot and stay writable until
+// restoreDirs gives them their modes and modification times.
+func (f *fsys) makeDirs(fromRoot, root, dir string) error {
+	if !f.opts.PreserveMetadata {
+		return os.MkdirAll(filepath.Join(root, dir), 0755)
+	}
+	if dir == "." {
+		return nil
+	}
+	if err := f.makeDirs(fromRoot, root, filepath.Dir(dir)); err != nil {
+		return err
+	}
+	target := filepath.Join(root, dir)
+	if info, err := os.Stat(target); err == nil {
+		if info.Mode().Perm()&0200 == 0 {
+			return os.Chmod(target, info.Mode()&preservedModeBits|0700)
+		}
+		return nil
+	}
+	if err := os.Mkdir(target, 0755); err != nil && !os.IsExist(err) {
+		return err
+	}
+	source := filepath.Join(fromRoot, dir)
+	info, err := os.Stat(source)
+	if err != nil {
+		return nil
+	}
+	if err := f.preserveMetadata(source, target); err != nil {
+		return err
+	}
+	return os.Chmod(target, info.Mode()&preservedModeBits|0700)
+}
+
+// restoreDirs gives the folder dir and its parents in root the modes and the
+// modification times of the same folders in fromRoot, once a copy into them
+// is finished.
+func (f *fsys) restoreDirs(fromRoot, root, dir string) {
+	if !f.opts.PreserveMetadata {
+		return
+	}
+	for ; dir != "." && dir != "/"; dir = filepath.Dir(dir) {
+		info, err := os.Stat(filepath.Join(fromRoot, dir))
+		if err != nil || !info.IsDir() {
+			continue
+		}
+		target := filepath.Join(root, dir)
+		_ = os.Chmod(target, info.Mode()&preservedModeBits)
+		_ = os.Chtimes(target, time.Now(), info.ModTime())
+	}
+}
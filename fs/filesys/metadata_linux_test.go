@@ -0,0 +1,50 @@
+package filesys
+
+import (
+	"arc/fs"
+	"arc/lifecycle"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestPreserveMetadata(t *testing.T) {
+	for _, preserve := range []bool{false, true} {
+		source, target := t.TempDir(), t.TempDir()
+		dir, path := filepath.Join(source, "d"), filepath.Join(source, "d", "x")
+		os.Mkdir(dir, 0755)
+		os.WriteFile(path, []byte("content"), 0644)
+		os.Chmod(path, 0600)
+		xattrs := unix.Lsetxattr(path, "user.arc", []byte("value"), 0) == nil
+		os.Chmod(dir, 0750)
+		dirTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+		os.Chtimes(dir, dirTime, dirTime)
+
+		f := NewFS(lifecycle.New(), Options{PreserveMetadata: preserve}).(*fsys)
+		hashes := scanned(t, f, source)
+		f.Copy("d/x", hashes["d/x"], source, target)
+		waitFor[fs.Copied](t, f.events)
+		f.Quit()
+
+		info, err := os.Stat(filepath.Join(target, "d", "x"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kept := info.Mode().Perm() == 0600; kept != preserve {
+			t.Errorf("preserve %v: file mode %v", preserve, info.Mode())
+		}
+		dirInfo, _ := os.Stat(filepath.Join(target, "d"))
+		if kept := dirInfo.Mode().Perm() == 0750 && dirInfo.ModTime().Equal(dirTime); kept != preserve {
+			t.Errorf("preserve %v: folder mode %v, time %v", preserve, dirInfo.Mode(), dirInfo.ModTime())
+		}
+		if xattrs {
+			attrs, _ := readXattrs(filepath.Join(target, "d", "x"))
+			if kept := string(attrs["user.arc"]) == "value"; kept != preserve {
+				t.Errorf("preserve %v: extended attributes %q", preserve, attrs)
+			}
+		}
+	}
+}
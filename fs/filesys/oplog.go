@@ -0,0 +1,426 @@
+package filesys
+
+import (
+	"arc/fs"
+	"arc/log"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The operation log is written ahead of every rename, copy and delete issued
+// within a batch. Each operation is logged as started before it touches the
+// root and as finished or failed once it is over, so a batch interrupted by a
+// crash or an unplugged drive shows which of its operations may be half done.
+// Copies are logged in their target roots.
+const (
+	oplogFileName = ".arc-oplog.csv"
+	oplogMagic    = "arc-oplog"
+	oplogVersion  = 1
+)
+
+const (
+	opStarted  = "started"
+	opFinished = "finished"
+	opFailed   = "failed"
+	opClosed   = "closed" // the batch was recovered
+)
+
+var (
+	errBadOplog     = errors.New("bad operation log")
+	errNoCopySource = errors.New("the file was streamed from another backend and cannot be copied again from here")
+)
+
+// opRecord is a line of the log. For renames other is the target path, for
+// copies the source root, empty for files created through the Streamer, and
+// for finished deletes the trash batch.
+type opRecord struct {
+	batch   string
+	seq     int
+	state   string
+	kind    fs.OperationKind
+	path    string
+	other   string
+	hash    string
+	existed bool // a copy replaced an existing file
+}
+
+// oplog serializes appends to the operation logs and numbers the operations
+// in the order they are issued.
+type oplog struct {
+	sync.Mutex
+	batch string // the batch operations are issued in
+	seq   int
+}
+
+// nextOp returns the batch and the sequence number of the next operation.
+func (f *fsys) nextOp() (string, int) {
+	f.oplog.Lock()
+	defer f.oplog.Unlock()
+	if f.oplog.batch == "" {
+		return "", 0
+	}
+	f.oplog.seq++
+	return f.oplog.batch, f.oplog.seq
+}
+
+func (f *fsys) startBatch() {
+	f.oplog.Lock()
+	defer f.oplog.Unlock()
+	f.oplog.batch = time.Now().UTC().Format("2006-01-02T15-04-05.000000")
+	f.oplog.seq = 0
+}
+
+// logOp appends the record to the root's log and syncs it. Operations
+// issued outside of a batch are not logged.
+func (f *fsys) logOp(root string, record opRecord) {
+	if record.batch == "" {
+		return
+	}
+	f.oplog.Lock()
+	defer f.oplog.Unlock()
+
+	path := filepath.Join(root, oplogFileName)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		f.events <- fs.Error{Path: path, Error: err}
+		return
+	}
+	defer file.Close()
+
+	buf := &bytes.Buffer{}
+	writer := csv.NewWriter(buf)
+	if info, err := file.Stat(); err == nil && info.Size() == 0 {
+		_ = writer.Write([]string{oplogMagic, strconv.Itoa(oplogVersion)})
+	}
+	_ = writer.Write(record.fields())
+	writer.Flush()
+	_, err = file.Write(buf.Bytes())
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		f.events <- fs.Error{Path: path, Error: err}
+	}
+}
+
+func (record opRecord) fields() []string {
+	kind, existed := "", ""
+	if record.state != opClosed {
+		kind = record.kind.String()
+	}
+	if record.existed {
+		existed = "existed"
+	}
+	return []string{record.batch, strconv.Itoa(record.seq), record.state, kind,
+		record.path, record.other, record.hash, existed}
+}
+
+func readOplog(root string) ([]opRecord, error) {
+	file, err := os.Open(filepath.Join(root, oplogFileName))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil || len(header) != 2 || header[0] != oplogMagic || header[1] != strconv.Itoa(oplogVersion) {
+		return nil, errBadOplog
+	}
+	kinds := map[string]fs.OperationKind{}
+	for _, kind := range []fs.OperationKind{fs.RenameOperation, fs.CopyOperation, fs.DeleteOperation} {
+		kinds[kind.String()] = kind
+	}
+	var records []opRecord
+	for {
+		// A record cut short by a crash ends the log.
+		line, err := reader.Read()
+		if err != nil || len(line) != 8 {
+			break
+		}
+		seq, err := strconv.Atoi(line[1])
+		kind, ok := kinds[line[3]]
+		if err != nil || !ok && line[2] != opClosed {
+			break
+		}
+		records = append(records, opRecord{
+			batch:   line[0],
+			seq:     seq,
+			state:   line[2],
+			kind:    kind,
+			path:    line[4],
+			other:   line[5],
+			hash:    line[6],
+			existed: line[7] != "",
+		})
+	}
+	return records, nil
+}
+
+// loggedBatch is a batch of the log with the latest record of each operation
+// in the order the operations were issued.
+type loggedBatch struct {
+	name   string
+	ops    []opRecord
+	closed bool
+}
+
+func (batch *loggedBatch) incomplete() bool {
+	if batch.closed {
+		return false
+	}
+	for _, op := range batch.ops {
+		if op.state == opStarted {
+			return true
+		}
+	}
+	return false
+}
+
+func loggedBatches(records []opRecord) []*loggedBatch {
+	var batches []*loggedBatch
+	byName := map[string]*loggedBatch{}
+	for _, record := range records {
+		batch := byName[record.batch]
+		if batch == nil {
+			batch = &loggedBatch{name: record.batch}
+			byName[record.batch] = batch
+			batches = append(batches, batch)
+		}
+		if record.state == opClosed {
+			batch.closed = true
+			continue
+		}
+		idx := slices.IndexFunc(batch.ops, func(op opRecord) bool { return op.seq == record.seq })
+		if idx < 0 {
+			batch.ops = append(batch.ops, record)
+			continue
+		}
+		// A finished delete knows its trash batch, a started copy whether it
+		// replaces a file.
+		record.existed = record.existed || batch.ops[idx].existed
+		batch.ops[idx] = record
+	}
+	for _, batch := range batches {
+		slices.SortFunc(batch.ops, func(a, b opRecord) int { return a.seq - b.seq })
+	}
+	return batches
+}
+
+// checkOplog reports the root's incomplete batches and drops the rest of the
+// log, unless it is a dry run. It runs when the root is scanned, before any
+// operation is issued.
+func (f *fsys) checkOplog(root string) {
+	path := filepath.Join(root, oplogFileName)
+	records, err := readOplog(root)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		f.events <- fs.Error{Path: path, Error: err}
+		return
+	}
+
+	var kept []opRecord
+	for _, batch := range loggedBatches(records) {
+		if !batch.incomplete() {
+			continue
+		}
+		event := fs.IncompleteBatch{Root: root, Batch: batch.name}
+		for _, op := range batch.ops {
+			logged := fs.LoggedOperation{Kind: op.kind, Path: op.path, Finished: op.state != opStarted}
+			switch op.kind {
+			case fs.RenameOperation:
+				logged.TargetPath = op.other
+			case fs.CopyOperation:
+				logged.FromRoot = op.other
+			}
+			event.Operations = append(event.Operations, logged)
+		}
+		f.events <- event
+		for _, record := range records {
+			if record.batch == batch.name {
+				kept = append(kept, record)
+			}
+		}
+	}
+	if f.opts.DryRun {
+		return
+	}
+	if err := f.rewriteOplog(root, kept); err != nil {
+		f.events <- fs.Error{Path: path, Error: err}
+	}
+}
+
+func (f *fsys) rewriteOplog(root string, records []opRecord) error {
+	f.oplog.Lock()
+	defer f.oplog.Unlock()
+
+	path := filepath.Join(root, oplogFileName)
+	if len(records) == 0 {
+		err := os.Remove(path)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	buf := &bytes.Buffer{}
+	writer := csv.NewWriter(buf)
+	_ = writer.Write([]string{oplogMagic, strconv.Itoa(oplogVersion)})
+	for _, record := range records {
+		_ = writer.Write(record.fields())
+	}
+	writer.Flush()
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// loggedRename, loggedCopy and loggedDelete run the operation between its
+// started record and the record of its outcome. A copy cut short by quitting
+// stays started.
+func (f *fsys) loggedRename(rename rename) {
+	record := opRecord{batch: rename.batch, seq: rename.seq, state: opStarted, kind: fs.RenameOperation,
+		path: rename.sourcePath, other: rename.targetPath}
+	f.logOp(rename.root, record)
+	f.renameFile(rename)
+	record.state = opFailed
+	if !exists(filepath.Join(rename.root, rename.sourcePath)) && exists(filepath.Join(rename.root, rename.targetPath)) {
+		record.state = opFinished
+	}
+	f.logOp(rename.root, record)
+}
+
+func (f *fsys) loggedCopy(copy copy) {
+	records := make([]opRecord, len(copy.toRoots))
+	for i, root := range copy.toRoots {
+		records[i] = opRecord{batch: copy.batch, seq: copy.seq, state: opStarted, kind: fs.CopyOperation,
+			path: copy.path, other: copy.fromRoot, hash: copy.hash, existed: exists(filepath.Join(root, copy.path))}
+		f.logOp(root, records[i])
+	}
+	f.copyFile(copy)
+	if f.lc.ShoudStop() {
+		return
+	}
+	for i, root := range copy.toRoots {
+		tempPath, _ := copyPaths(root, copy.path)
+		records[i].state = opFailed
+		if exists(filepath.Join(root, copy.path)) && !exists(tempPath) {
+			records[i].state = opFinished
+		}
+		f.logOp(root, records[i])
+	}
+}
+
+func (f *fsys) loggedDelete(delete deleteCmd) {
+	record := opRecord{batch: delete.batch, seq: delete.seq, state: opStarted, kind: fs.DeleteOperation, path: delete.path}
+	f.logOp(delete.root, record)
+	record.other = f.deleteFile(delete)
+	record.state = opFailed
+	if record.other != "" {
+		record.state = opFinished
+	}
+	f.logOp(delete.root, record)
+}
+
+// recoverBatch rolls the root's part of an interrupted batch forward, redoing
+// the operations that did not finish, or back, undoing them in reverse order.
+// Either way the changes are reported like changes made outside of arc and
+// the batch is closed.
+func (f *fsys) recoverBatch(recovery recovery) {
+	log.Debug("recover", "root", recovery.root, "batch", recovery.batch, "forward", recovery.forward)
+	path := filepath.Join(recovery.root, oplogFileName)
+	records, err := readOplog(recovery.root)
+	if err != nil {
+		f.events <- fs.Error{Path: path, Error: err}
+		return
+	}
+	idx := slices.IndexFunc(loggedBatches(records), func(batch *loggedBatch) bool { return batch.name == recovery.batch })
+	if idx < 0 {
+		f.events <- fs.Error{Path: path, Error: fmt.Errorf("%w: no batch %s", errBadOplog, recovery.batch)}
+		return
+	}
+	batch := loggedBatches(records)[idx]
+
+	if recovery.forward {
+		for _, op := range batch.ops {
+			if op.state == opStarted {
+				f.redo(recovery.root, op)
+			}
+		}
+	} else {
+		for i := len(batch.ops) - 1; i >= 0; i-- {
+			if op := batch.ops[i]; op.state != opFailed {
+				f.undo(recovery.root, op)
+			}
+		}
+	}
+	if f.lc.ShoudStop() {
+		return
+	}
+	f.logOp(recovery.root, opRecord{batch: batch.name, state: opClosed})
+	f.events <- fs.BatchRecovered{Root: recovery.root, Batch: batch.name, Forward: recovery.forward}
+}
+
+// redo runs the operation again unless it got as far as changing the root.
+func (f *fsys) redo(root string, op opRecord) {
+	switch op.kind {
+	case fs.RenameOperation:
+		if exists(filepath.Join(root, op.path)) && !exists(filepath.Join(root, op.other)) {
+			f.renameFile(rename{root: root, sourcePath: op.path, targetPath: op.other})
+		}
+	case fs.CopyOperation:
+		if op.other == "" {
+			f.events <- fs.Error{Path: filepath.Join(root, op.path), Error: errNoCopySource}
+			return
+		}
+		// The archive learns about the copy the way it does about a file
+		// copied outside of arc.
+		f.copyFile(copy{path: op.path, hash: op.hash, fromRoot: op.other, toRoots: []string{root}})
+		if copied := f.index.get(root, op.path); copied != nil {
+			f.events <- *copied.file
+		}
+	case fs.DeleteOperation:
+		if exists(filepath.Join(root, op.path)) {
+			f.deleteFile(deleteCmd{root: root, path: op.path})
+		}
+	}
+}
+
+// undo reverts what the operation did to the root. A copy that replaced a
+// file is left in place, the replaced content is gone.
+func (f *fsys) undo(root string, op opRecord) {
+	switch op.kind {
+	case fs.RenameOperation:
+		if !exists(filepath.Join(root, op.path)) && exists(filepath.Join(root, op.other)) {
+			f.renameFile(rename{root: root, sourcePath: op.other, targetPath: op.path})
+		}
+	case fs.CopyOperation:
+		tempPath, statePath := copyPaths(root, op.path)
+		os.Remove(tempPath)
+		os.Remove(statePath)
+		if op.state == opFinished && !op.existed && exists(filepath.Join(root, op.path)) {
+			f.deleteFile(deleteCmd{root: root, path: op.path})
+		}
+	case fs.DeleteOperation:
+		if op.state == opFinished && !exists(filepath.Join(root, op.path)) {
+			f.restoreFile(restore{root: root, batch: op.other, path: op.path})
+		}
+	}
+}
+
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
@@ -0,0 +1,83 @@
+package filesys
+
+import (
+	"arc/fs"
+	"arc/lifecycle"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOplogRecovery(t *testing.T) {
+	root := t.TempDir()
+	f := &fsys{
+		lc:      lifecycle.New(),
+		events:  make(chan fs.Event, 16),
+		index:   newIndex(),
+		ignores: ignores{roots: map[string]*ignoreRules{}},
+	}
+
+	// A rename finished, a second one was interrupted after it got logged.
+	os.WriteFile(filepath.Join(root, "b"), nil, 0644)
+	os.WriteFile(filepath.Join(root, "c"), nil, 0644)
+	f.logOp(root, opRecord{batch: "1", seq: 1, state: opStarted, kind: fs.RenameOperation, path: "a", other: "b"})
+	f.logOp(root, opRecord{batch: "1", seq: 1, state: opFinished, kind: fs.RenameOperation, path: "a", other: "b"})
+	f.logOp(root, opRecord{batch: "1", seq: 2, state: opStarted, kind: fs.RenameOperation, path: "c", other: "d"})
+	f.logOp(root, opRecord{batch: "2", seq: 1, state: opStarted, kind: fs.DeleteOperation, path: "x"})
+	f.logOp(root, opRecord{batch: "2", seq: 1, state: opFinished, kind: fs.DeleteOperation, path: "x", other: "t"})
+
+	// Simulate a crash in the middle of an append.
+	file, _ := os.OpenFile(filepath.Join(root, oplogFileName), os.O_APPEND|os.O_WRONLY, 0644)
+	file.WriteString(`2,2,sta`)
+	file.Close()
+
+	f.checkOplog(root)
+	event := (<-f.events).(fs.IncompleteBatch)
+	if event.Batch != "1" || len(event.Operations) != 2 || !event.Operations[0].Finished || event.Operations[1].Finished {
+		t.Fatalf("unexpected %#v", event)
+	}
+	if len(f.events) != 0 {
+		t.Fatalf("unexpected %#v", <-f.events)
+	}
+
+	f.recoverBatch(recovery{root: root, batch: "1"})
+	for event := range f.events {
+		if _, ok := event.(fs.BatchRecovered); ok {
+			break
+		}
+	}
+	for _, name := range []string{"a", "c"} {
+		if _, err := os.Stat(filepath.Join(root, name)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	f.checkOplog(root)
+	if len(f.events) != 0 {
+		t.Fatalf("unexpected %#v", <-f.events)
+	}
+	if _, err := os.Stat(filepath.Join(root, oplogFileName)); err == nil {
+		t.Error("log left after recovery")
+	}
+}
+
+func TestRedoStreamedCopy(t *testing.T) {
+	root := t.TempDir()
+	f := NewFS(lifecycle.New(), Options{}).(*fsys)
+	defer f.Quit()
+
+	// An upload was interrupted after it got logged.
+	f.Batch()
+	writer, err := f.Create(fs.FileMeta{Root: root, Path: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Write([]byte("content"))
+	batch := f.oplog.batch
+
+	f.Recover(root, batch, true)
+	if failed := waitFor[fs.Error](t, f.events); failed.Error != errNoCopySource {
+		t.Errorf("unexpected error %v", failed.Error)
+	}
+	waitFor[fs.BatchRecovered](t, f.events)
+}
@@ -0,0 +1,208 @@
+package filesys
+
+import (
+	"arc/fs"
+	"bytes"
+	"encoding"
+	"encoding/base64"
+	"encoding/csv"
+	"errors"
+	"hash"
+	"os"
+	pathpkg "path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// resumePrefix starts the names of the files that keep the state of
+	// interrupted copies next to their temp files.
+	resumePrefix  = ".arc-resume-"
+	resumeMagic   = "arc-resume"
+	resumeVersion = 1
+
+	// resumeEvery is how many bytes are written between two checkpoints.
+	resumeEvery = 64 << 20
+
+	// resumeRetention is how long an interrupted copy can be resumed.
+	resumeRetention = 7 * 24 * time.Hour
+)
+
+var errBadResumeState = errors.New("bad resume state")
+
+// resumeState describes the source of a copy and how much of it has been
+// committed to the temp file. The hash state is that of the source stream
+// hash after the committed bytes, so the copy can still be verified as a
+// whole once it is resumed.
+type resumeState struct {
+	hash      string // recorded hash of the source
+	size      int
+	modTime   time.Time
+	algorithm string
+	committed int
+	hashState []byte
+}
+
+func (s *resumeState) sameSource(other *resumeState) bool {
+	return s.hash == other.hash &&
+		s.size == other.size &&
+		s.modTime.UTC().Round(time.Second).Equal(other.modTime.UTC().Round(time.Second)) &&
+		s.algorithm == other.algorithm
+}
+
+// copyPaths returns the temp file a copy is written to and the file keeping
+// its resume state.
+func copyPaths(root, path string) (tempPath, statePath string) {
+	dir, name := filepath.Split(filepath.Join(root, path))
+	return filepath.Join(dir, copyTempPrefix+name), filepath.Join(dir, resumePrefix+name)
+}
+
+// resumePoint returns where a copy starts. It continues after the bytes
+// committed in every target root, provided the source has not changed since.
+func (f *fsys) resumePoint(copy copy, info os.FileInfo) resumeState {
+	start := resumeState{
+		hash:      copy.hash,
+		size:      int(info.Size()),
+		modTime:   info.ModTime(),
+		algorithm: f.opts.Hasher,
+	}
+	var resumed *resumeState
+	for _, root := range copy.toRoots {
+		tempPath, statePath := copyPaths(root, copy.path)
+		state, err := readResumeState(statePath)
+		if err != nil || !state.sameSource(&start) {
+			return start
+		}
+		tempInfo, err := os.Stat(tempPath)
+		if err != nil || int(tempInfo.Size()) < state.committed {
+			return start
+		}
+		if resumed == nil || state.committed < resumed.committed {
+			resumed = state
+		}
+	}
+	if resumed == nil {
+		return start
+	}
+	if _, err := f.restoreHash(resumed.hashState); err != nil {
+		return start
+	}
+	start.committed = resumed.committed
+	start.hashState = resumed.hashState
+	return start
+}
+
+// restoreHash returns a new hash continuing from the saved state. It
+// returns a fresh hash along with the error if the state cannot be restored.
+func (f *fsys) restoreHash(state []byte) (hash.Hash, error) {
+	hash := f.newHash()
+	if len(state) == 0 {
+		return hash, nil
+	}
+	unmarshaler, ok := hash.(encoding.BinaryUnmarshaler)
+	if !ok {
+		return hash, errBadResumeState
+	}
+	if err := unmarshaler.UnmarshalBinary(state); err != nil {
+		return f.newHash(), err
+	}
+	return hash, nil
+}
+
+// saveHash returns the state of the hash or nil if it cannot be saved.
+func saveHash(hash hash.Hash) []byte {
+	marshaler, ok := hash.(encoding.BinaryMarshaler)
+	if !ok {
+		return nil
+	}
+	state, err := marshaler.MarshalBinary()
+	if err != nil {
+		return nil
+	}
+	return state
+}
+
+func readResumeState(statePath string) (*resumeState, error) {
+	data, err := os.ReadFile(statePath)
+	if err != nil {
+		return nil, err
+	}
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) != 2 || len(records[0]) != 2 || len(records[1]) != 6 ||
+		records[0][0] != resumeMagic || records[0][1] != strconv.Itoa(resumeVersion) {
+		return nil, errBadResumeState
+	}
+
+	record := records[1]
+	size, er1 := strconv.Atoi(record[1])
+	modTime, er2 := time.Parse(time.RFC3339Nano, record[2])
+	committed, er3 := strconv.Atoi(record[4])
+	hashState, er4 := base64.RawURLEncoding.DecodeString(record[5])
+	if err := errors.Join(er1, er2, er3, er4); err != nil {
+		return nil, err
+	}
+	return &resumeState{
+		hash:      record[0],
+		size:      size,
+		modTime:   modTime,
+		algorithm: record[3],
+		committed: committed,
+		hashState: hashState,
+	}, nil
+}
+
+func writeResumeState(statePath string, state *resumeState) error {
+	buf := &bytes.Buffer{}
+	writer := csv.NewWriter(buf)
+	_ = writer.Write([]string{resumeMagic, strconv.Itoa(resumeVersion)})
+	_ = writer.Write([]string{
+		state.hash,
+		strconv.Itoa(state.size),
+		state.modTime.UTC().Format(time.RFC3339Nano),
+		state.algorithm,
+		strconv.Itoa(state.committed),
+		base64.RawURLEncoding.EncodeToString(state.hashState),
+	})
+	writer.Flush()
+	return os.WriteFile(statePath, buf.Bytes(), 0644)
+}
+
+// sweepCopyLeftover removes a temp file or a resume state left by an
+// interrupted copy unless the copy can still be resumed: both halves are
+// there, the state is readable and it was checkpointed less than
+// resumeRetention ago. A copy retried from a changed source starts over
+// anyway, so older pairs would only take space.
+func (f *fsys) sweepCopyLeftover(root, path string) {
+	if f.opts.DryRun {
+		return
+	}
+	dir, name := pathpkg.Split(path)
+	name = strings.TrimPrefix(strings.TrimPrefix(name, copyTempPrefix), resumePrefix)
+	if resumable(copyPaths(root, pathpkg.Join(dir, name))) {
+		return
+	}
+	absPath := filepath.Join(root, path)
+	if err := os.Remove(absPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		f.events <- fs.Error{Path: absPath, Error: err}
+	}
+}
+
+func resumable(tempPath, statePath string) bool {
+	stateInfo, err := os.Stat(statePath)
+	if err != nil || time.Since(stateInfo.ModTime()) > resumeRetention {
+		return false
+	}
+	state, err := readResumeState(statePath)
+	if err != nil {
+		return false
+	}
+	tempInfo, err := os.Stat(tempPath)
+	return err == nil && int(tempInfo.Size()) >= state.committed
+}
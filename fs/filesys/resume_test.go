@@ -0,0 +1,151 @@
+package filesys
+
+import (
+	"arc/fs"
+	"arc/lifecycle"
+	"bytes"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// interrupted leaves the temp file and the resume state of a copy of content
+// interrupted after committed bytes.
+func interrupted(t *testing.T, f *fsys, root, path string, content []byte, committed int, modTime time.Time) {
+	t.Helper()
+	hash := f.newHash()
+	hash.Write(content[:committed])
+	tempPath, statePath := copyPaths(root, path)
+	os.WriteFile(tempPath, content[:committed], 0644)
+	err := writeResumeState(statePath, &resumeState{
+		hash:      recordedHash(f, content),
+		size:      len(content),
+		modTime:   modTime,
+		algorithm: f.opts.Hasher,
+		committed: committed,
+		hashState: saveHash(hash),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func recordedHash(f *fsys, content []byte) string {
+	hash, _ := HashStream(bytes.NewReader(content), len(content), f.opts.HashMode, f.opts.Hasher)
+	return hash
+}
+
+func TestSweepCopyLeftovers(t *testing.T) {
+	f := NewFS(lifecycle.New(), Options{}).(*fsys)
+	defer f.Quit()
+	content := []byte("content")
+
+	tests := []struct {
+		name  string
+		setup func(root string)
+		kept  bool
+	}{
+		{"temp file alone", func(root string) {
+			tempPath, _ := copyPaths(root, "a")
+			os.WriteFile(tempPath, content, 0644)
+		}, false},
+		{"resume state alone", func(root string) {
+			interrupted(t, f, root, "a", content, 3, time.Now())
+			tempPath, _ := copyPaths(root, "a")
+			os.Remove(tempPath)
+		}, false},
+		{"resumable pair", func(root string) {
+			interrupted(t, f, root, "a", content, 3, time.Now())
+		}, true},
+		{"truncated temp file", func(root string) {
+			interrupted(t, f, root, "a", content, 3, time.Now())
+			tempPath, _ := copyPaths(root, "a")
+			os.Truncate(tempPath, 1)
+		}, false},
+		{"expired pair", func(root string) {
+			interrupted(t, f, root, "a", content, 3, time.Now())
+			_, statePath := copyPaths(root, "a")
+			expired := time.Now().Add(-resumeRetention - time.Hour)
+			os.Chtimes(statePath, expired, expired)
+		}, false},
+		{"unreadable state", func(root string) {
+			interrupted(t, f, root, "a", content, 3, time.Now())
+			_, statePath := copyPaths(root, "a")
+			os.WriteFile(statePath, []byte("garbage"), 0644)
+		}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			test.setup(root)
+			entries, _ := os.ReadDir(root)
+			for _, entry := range entries {
+				f.sweepCopyLeftover(root, entry.Name())
+			}
+			left, _ := os.ReadDir(root)
+			expected := 0
+			if test.kept {
+				expected = len(entries)
+			}
+			if len(left) != expected {
+				t.Errorf("%d of %d leftovers kept, expected %d", len(left), len(entries), expected)
+			}
+		})
+	}
+}
+
+func TestResumedCopy(t *testing.T) {
+	source, target := t.TempDir(), t.TempDir()
+	content := make([]byte, 3*bufSize)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	os.WriteFile(filepath.Join(source, "a"), content, 0644)
+	info, _ := os.Stat(filepath.Join(source, "a"))
+
+	f := NewFS(lifecycle.New(), Options{}).(*fsys)
+	defer f.Quit()
+	copy := copy{path: "a", hash: recordedHash(f, content), fromRoot: source, toRoots: []string{target}}
+
+	tests := []struct {
+		name      string
+		setup     func()
+		committed int
+	}{
+		{"interrupted", func() {
+			interrupted(t, f, target, "a", content, bufSize, info.ModTime())
+		}, bufSize},
+		{"source changed", func() {
+			interrupted(t, f, target, "a", content, bufSize, info.ModTime().Add(-time.Hour))
+		}, 0},
+		{"no state", func() {
+			tempPath, _ := copyPaths(target, "a")
+			os.WriteFile(tempPath, content[:bufSize], 0644)
+		}, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			os.Remove(filepath.Join(target, "a"))
+			test.setup()
+			state := f.resumePoint(copy, info)
+			if state.committed != test.committed {
+				t.Fatalf("resumes at %d, expected %d", state.committed, test.committed)
+			}
+
+			// The streaming copy takes over from the resume point.
+			progress := make([]atomic.Int64, 1)
+			wg := &sync.WaitGroup{}
+			wg.Add(1)
+			f.reader(copy, state, progress, wg)
+			wg.Wait()
+			waitFor[fs.CopyVerified](t, f.events)
+			copied, err := os.ReadFile(filepath.Join(target, "a"))
+			if err != nil || string(copied) != string(content) {
+				t.Errorf("the resumed copy differs from the source: %v", err)
+			}
+		})
+	}
+}
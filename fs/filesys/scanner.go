@@ -2,15 +2,13 @@ package filesys
 
 import (
 	"arc/fs"
-	"crypto/sha256"
 	"encoding/base64"
-	"encoding/csv"
-	"fmt"
+	"errors"
 	"io"
 	iofs "io/fs"
 	"os"
+	pathpkg "path"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -18,37 +16,69 @@ import (
 	"golang.org/x/text/unicode/norm"
 )
 
-const hashFileName = ".meta.csv"
-
-type meta struct {
-	inode uint64
-	file  *fs.FileMeta
-}
+var errInterrupted = errors.New("interrupted")
 
 func (s *fsys) scanArchive(scan scan) {
 	s.lc.Started()
 	defer s.lc.Done()
 
-	metaMap := s.readMeta(scan.root)
+	s.loadIgnoreRules(scan.root)
+	s.purgeExpiredTrash(scan.root)
+	s.checkOplog(scan.root)
+	metaCache := s.readMeta(scan.root)
 	var metaSlice []*meta
 
 	defer func() {
 		_ = s.storeMeta(scan.root, metaSlice)
+		s.reportDiskSpace(scan.root)
 		s.events <- fs.ArchiveHashed{
 			Root: scan.root,
 		}
+		if s.opts.Watch && !s.lc.ShoudStop() {
+			s.watchArchive(scan.root)
+		}
 	}()
 
+	// Folders are reported only when they turn out to be empty.
+	var dirs []string
+	dirInfos := map[string]iofs.FileInfo{}
+	nonEmptyDirs := map[string]bool{}
+
 	fsys := os.DirFS(scan.root)
 	err := iofs.WalkDir(fsys, ".", func(path string, d iofs.DirEntry, err error) error {
-		if s.lc.ShoudStop() || !d.Type().IsRegular() || strings.HasPrefix(d.Name(), ".") {
+		if err != nil {
+			s.events <- fs.Error{Path: scan.root, Error: err}
 			return nil
 		}
 
-		if err != nil {
-			s.events <- fs.Error{Path: scan.root, Error: err}
+		if s.lc.ShoudStop() {
+			return iofs.SkipAll
+		}
+
+		if path == "." {
+			return nil
+		}
+
+		if path == trashDirName {
+			return iofs.SkipDir
+		}
+
+		if !d.IsDir() && (strings.HasPrefix(d.Name(), copyTempPrefix) || strings.HasPrefix(d.Name(), resumePrefix)) {
+			s.sweepCopyLeftover(scan.root, path)
+			return nil
+		}
+
+		if s.ignored(scan.root, path, d.IsDir()) {
+			if d.IsDir() {
+				return iofs.SkipDir
+			}
+			return nil
+		}
+
+		if !d.IsDir() && !d.Type().IsRegular() && d.Type()&iofs.ModeSymlink == 0 {
 			return nil
 		}
+		nonEmptyDirs[pathpkg.Dir(path)] = true
 
 		info, err := d.Info()
 		if err != nil {
@@ -56,33 +86,54 @@ func (s *fsys) scanArchive(scan scan) {
 			return nil
 		}
 
-		size := int(info.Size())
-		if size == 0 {
+		if d.IsDir() {
+			dirs = append(dirs, path)
+			dirInfos[path] = info
 			return nil
 		}
 
+		sys := info.Sys().(*syscall.Stat_t)
+		if !d.Type().IsRegular() {
+			file := s.entryMeta(scan.root, path, info)
+			if file != nil {
+				s.events <- *file
+				s.index.set(scan.root, &meta{inode: sys.Ino, file: file})
+			}
+			return nil
+		}
+
+		size := int(info.Size())
 		modTime := info.ModTime()
 		modTime = modTime.UTC().Round(time.Second)
 
 		file := &fs.FileMeta{
-			Root:    scan.root,
-			Path:    norm.NFC.String(path),
-			Size:    size,
-			ModTime: modTime,
+			Root:      scan.root,
+			Path:      norm.NFC.String(path),
+			Inode:     sys.Ino,
+			Links:     int(sys.Nlink),
+			Size:      size,
+			ModTime:   modTime,
+			Mode:      info.Mode() & preservedModeBits,
+			UID:       int(sys.Uid),
+			GID:       int(sys.Gid),
+			Xattrs:    s.xattrDigest(filepath.Join(scan.root, path)),
+			HashMode:  s.opts.HashMode,
+			Algorithm: s.opts.Hasher,
 		}
 
-		sys := info.Sys().(*syscall.Stat_t)
-		readMeta := metaMap[sys.Ino]
-		if readMeta != nil && readMeta.ModTime == modTime && readMeta.Size == size {
-			file.Hash = readMeta.Hash
+		meta := &meta{
+			inode: sys.Ino,
+			file:  file,
+		}
+		if cached := metaCache.lookup(sys.Ino, file); cached != nil {
+			file.Hash = cached.file.Hash
+			meta.verified = cached.verified
+			meta.content = cached.content
 		}
 		s.events <- *file
 
-		metaSlice = append(metaSlice, &meta{
-			inode: sys.Ino,
-			file:  file,
-		})
-		metaMap[sys.Ino] = file
+		metaSlice = append(metaSlice, meta)
+		s.index.set(scan.root, meta)
 
 		return nil
 	})
@@ -91,96 +142,88 @@ func (s *fsys) scanArchive(scan scan) {
 		return
 	}
 
-	for _, meta := range metaSlice {
-		if meta.file.Hash != "" {
+	for _, dir := range dirs {
+		if nonEmptyDirs[dir] {
 			continue
 		}
-		if s.lc.ShoudStop() {
-			return
-		}
-		meta.file.Hash = s.hashFile(meta.file)
-		s.events <- fs.FileHashed{
-			Root: scan.root,
-			Path: meta.file.Path,
-			Hash: meta.file.Hash,
-		}
-	}
-}
-
-func (s *fsys) readMeta(root string) map[uint64]*fs.FileMeta {
-	metas := map[uint64]*fs.FileMeta{}
-	absHashFileName := filepath.Join(root, hashFileName)
-	hashInfoFile, err := os.Open(absHashFileName)
-	if err != nil {
-		return metas
-	}
-	defer hashInfoFile.Close()
-
-	records, err := csv.NewReader(hashInfoFile).ReadAll()
-	if err != nil || len(records) == 0 {
-		return metas
+		info := dirInfos[dir]
+		file := s.entryMeta(scan.root, dir, info)
+		s.events <- *file
+		s.index.set(scan.root, &meta{inode: info.Sys().(*syscall.Stat_t).Ino, file: file})
 	}
 
-	for _, record := range records[1:] {
-		if len(record) == 5 {
-			iNode, er1 := strconv.ParseUint(record[0], 10, 64)
-			path := record[1]
-			size, er2 := strconv.ParseUint(record[2], 10, 64)
-			modTime, er3 := time.Parse(time.RFC3339, record[3])
-			modTime = modTime.UTC().Round(time.Second)
-			hash := record[4]
-			if hash == "" || er1 != nil || er2 != nil || er3 != nil {
+	// Hard links share their content, so only one of them gets hashed.
+	var unhashed []*fs.FileMeta
+	firstLinks := map[uint64]*fs.FileMeta{}
+	otherLinks := map[*fs.FileMeta][]*fs.FileMeta{}
+	for _, meta := range metaSlice {
+		if meta.file.Hash != "" {
+			continue
+		}
+		if meta.file.Links > 1 {
+			if first, ok := firstLinks[meta.inode]; ok {
+				otherLinks[first] = append(otherLinks[first], meta.file)
 				continue
 			}
-
-			metas[iNode] = &fs.FileMeta{
-				Root:    root,
-				Path:    path,
-				Size:    int(size),
-				ModTime: modTime,
-				Hash:    hash,
-			}
-
-			info, ok := metas[iNode]
-			if hash != "" && ok && info.ModTime == modTime && info.Size == int(size) {
-				metas[iNode].Hash = hash
-			}
+			firstLinks[meta.inode] = meta.file
 		}
+		unhashed = append(unhashed, meta.file)
 	}
-	return metas
-}
-
-func (s *fsys) storeMeta(root string, metas []*meta) error {
-	result := make([][]string, 1, len(metas)+1)
-	result[0] = []string{"INode", "Name", "Size", "ModTime", "Hash"}
+	s.hashFiles(scan.root, unhashed)
 
-	for _, meta := range metas {
-		if meta.file.Hash == "" {
+	for first, others := range otherLinks {
+		if first.Hash == "" {
 			continue
 		}
-		result = append(result, []string{
-			fmt.Sprint(meta.inode),
-			norm.NFC.String(meta.file.Path),
-			fmt.Sprint(meta.file.Size),
-			meta.file.ModTime.UTC().Format(time.RFC3339Nano),
-			meta.file.Hash,
-		})
+		for _, other := range others {
+			other.Hash = first.Hash
+			s.events <- fs.FileHashed{
+				Root:      scan.root,
+				Path:      other.Path,
+				Hash:      other.Hash,
+				HashMode:  other.HashMode,
+				Algorithm: other.Algorithm,
+			}
+		}
 	}
+}
 
-	absHashFileName := filepath.Join(root, hashFileName)
-	hashInfoFile, err := os.Create(absHashFileName)
-
-	if err != nil {
-		return err
+// entryMeta describes a folder or a symlink. Their hashes are derived from
+// the entry kind and the link target, so no content has to be read.
+func (s *fsys) entryMeta(root, path string, info iofs.FileInfo) *fs.FileMeta {
+	sys := info.Sys().(*syscall.Stat_t)
+	file := &fs.FileMeta{
+		Root:      root,
+		Path:      norm.NFC.String(path),
+		Inode:     sys.Ino,
+		Links:     int(sys.Nlink),
+		ModTime:   info.ModTime().UTC().Round(time.Second),
+		Mode:      info.Mode() & preservedModeBits,
+		UID:       int(sys.Uid),
+		GID:       int(sys.Gid),
+		Xattrs:    s.xattrDigest(filepath.Join(root, path)),
+		HashMode:  s.opts.HashMode,
+		Algorithm: s.opts.Hasher,
+	}
+	if info.Mode()&iofs.ModeSymlink != 0 {
+		absPath := filepath.Join(root, path)
+		target, err := os.Readlink(absPath)
+		if err != nil {
+			s.events <- fs.Error{Path: absPath, Error: err}
+			return nil
+		}
+		file.Kind = fs.Symlink
+		file.Target = target
+		file.Hash = s.hashString("symlink:" + target)
+	} else {
+		file.Kind = fs.Directory
+		file.Hash = s.hashString("directory")
 	}
-	err = csv.NewWriter(hashInfoFile).WriteAll(result)
-	_ = hashInfoFile.Close()
-	return err
+	return file
 }
 
 func (s *fsys) hashFile(meta *fs.FileMeta) string {
-	hash := sha256.New()
-	buf := make([]byte, bufSize)
+	hash := s.newHash()
 	path := filepath.Join(meta.Root, meta.Path)
 
 	file, err := os.Open(path)
@@ -190,24 +233,59 @@ func (s *fsys) hashFile(meta *fs.FileMeta) string {
 	}
 	defer file.Close()
 
-	offset := bufSize
-	if meta.Size > 2*bufSize {
-		offset = meta.Size - bufSize
+	if meta.HashMode == fs.FullHash {
+		err = s.hashFull(hash, file)
+	} else {
+		err = s.hashSampled(hash, file, meta.Size)
 	}
-	nr, er := file.Read(buf)
-	if er != nil && er != io.EOF {
+	if err == errInterrupted {
+		return ""
+	}
+	if err != nil {
 		s.events <- fs.Error{Path: path, Error: err}
 		return ""
 	}
+
+	return base64.RawURLEncoding.EncodeToString(hash.Sum(nil))
+}
+
+// hashSampled hashes only the first and the last bufSize bytes of the file.
+func (s *fsys) hashSampled(hash io.Writer, file *os.File, size int) error {
+	buf := make([]byte, bufSize)
+
+	offset := bufSize
+	if size > 2*bufSize {
+		offset = size - bufSize
+	}
+	nr, err := file.Read(buf)
+	if err != nil && err != io.EOF {
+		return err
+	}
 	hash.Write(buf[0:nr])
-	if meta.Size > bufSize {
-		nr, er := file.ReadAt(buf, int64(offset))
-		if er != nil && er != io.EOF {
-			s.events <- fs.Error{Path: path, Error: err}
-			return ""
+	if size > bufSize {
+		nr, err := file.ReadAt(buf, int64(offset))
+		if err != nil && err != io.EOF {
+			return err
 		}
 		hash.Write(buf[0:nr])
 	}
+	return nil
+}
 
-	return base64.RawURLEncoding.EncodeToString(hash.Sum(nil))
+// hashFull hashes every byte of the file.
+func (s *fsys) hashFull(hash io.Writer, file *os.File) error {
+	buf := make([]byte, bufSize)
+	for {
+		if s.lc.ShoudStop() {
+			return errInterrupted
+		}
+		nr, err := file.Read(buf)
+		hash.Write(buf[0:nr])
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
 }
@@ -0,0 +1,66 @@
+package filesys
+
+import (
+	"arc/fs"
+	"arc/lifecycle"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestScanEntries(t *testing.T) {
+	source, target := t.TempDir(), t.TempDir()
+	os.WriteFile(filepath.Join(source, "zero"), nil, 0644)
+	os.Mkdir(filepath.Join(source, "empty"), 0755)
+	os.Symlink("zero", filepath.Join(source, "link"))
+	os.Mkdir(filepath.Join(source, "full"), 0755)
+	os.WriteFile(filepath.Join(source, "full", "x"), []byte("x"), 0644)
+
+	f := NewFS(lifecycle.New(), Options{}).(*fsys)
+	defer f.Quit()
+	f.Scan(source)
+	scanned := map[string]fs.FileMeta{}
+	for done := false; !done; {
+		switch event := waitFor[fs.Event](t, f.events).(type) {
+		case fs.FileMeta:
+			scanned[event.Path] = event
+		case fs.ArchiveHashed:
+			done = true
+		}
+	}
+
+	tests := []struct {
+		path   string
+		kind   fs.EntryKind
+		target string
+	}{
+		{"zero", fs.RegularFile, ""},
+		{"empty", fs.Directory, ""},
+		{"link", fs.Symlink, "zero"},
+		{"full/x", fs.RegularFile, ""},
+	}
+	for _, test := range tests {
+		file, ok := scanned[test.path]
+		if !ok {
+			t.Errorf("%s not scanned", test.path)
+			continue
+		}
+		if file.Kind != test.kind || file.Target != test.target {
+			t.Errorf("%s scanned as %v %q, expected %v %q", test.path, file.Kind, file.Target, test.kind, test.target)
+		}
+	}
+	if _, ok := scanned["full"]; ok {
+		t.Error("a folder with files scanned as an entry")
+	}
+
+	for _, path := range []string{"empty", "link"} {
+		f.Copy(path, scanned[path].Hash, source, target)
+		waitFor[fs.Copied](t, f.events)
+	}
+	if info, err := os.Lstat(filepath.Join(target, "empty")); err != nil || !info.IsDir() {
+		t.Errorf("empty folder not copied: %v", err)
+	}
+	if link, err := os.Readlink(filepath.Join(target, "link")); err != nil || link != "zero" {
+		t.Errorf("symlink copied as %q: %v", link, err)
+	}
+}
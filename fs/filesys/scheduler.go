@@ -0,0 +1,228 @@
+package filesys
+
+import (
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// job is a command run off the command loop. Copies occupy a lane on every
+// destination device they write to. Every job waits for the earlier jobs
+// touching the same paths, so a rename, a delete or a verify queued after a
+// copy of the same file still sees the copy finished, while unrelated ones
+// never wait behind a long copy.
+type job struct {
+	devices []uint64
+	paths   []string // absolute paths the job reads or writes
+	run     func()
+}
+
+// queuedPerLane bounds how many copies may wait for each lane of a device.
+const queuedPerLane = 16
+
+// scheduler runs jobs with at most Options.CopyLanes copies per destination
+// device. Jobs start in order unless an earlier job is still waiting for a
+// lane or a path the later one doesn't need.
+type scheduler struct {
+	sync.Mutex
+	freed   sync.Cond // signaled when queued copies start
+	active  map[uint64]int
+	queued  map[uint64]int // pending jobs by destination device
+	pending []*job
+	running map[*job]bool
+}
+
+// schedule blocks while a destination device of the job has
+// queuedPerLane*Options.CopyLanes copies waiting, so a large resolution
+// waits in the command stream instead of piling up in the scheduler.
+func (f *fsys) schedule(job *job) {
+	s := &f.scheduler
+	s.Lock()
+	defer s.Unlock()
+	if s.freed.L == nil {
+		s.freed.L = &s.Mutex
+		s.queued = map[uint64]int{}
+	}
+	for f.queueFull(job) && !f.lc.ShoudStop() {
+		s.freed.Wait()
+	}
+	for _, device := range job.devices {
+		s.queued[device]++
+	}
+	s.pending = append(s.pending, job)
+	f.dispatch()
+}
+
+func (f *fsys) queueFull(job *job) bool {
+	for _, device := range job.devices {
+		if f.scheduler.queued[device] >= queuedPerLane*f.opts.CopyLanes {
+			return true
+		}
+	}
+	return false
+}
+
+// dispatch starts the pending jobs that can run. It is called with the
+// scheduler locked.
+func (f *fsys) dispatch() {
+	s := &f.scheduler
+	defer s.freed.Broadcast()
+	reserved := map[uint64]bool{}
+	var waiting []*job
+	for _, job := range s.pending {
+		if f.lc.ShoudStop() {
+			s.pending = nil
+			clear(s.queued)
+			return
+		}
+		if !f.canStart(job, reserved, waiting) {
+			for _, device := range job.devices {
+				reserved[device] = true
+			}
+			waiting = append(waiting, job)
+			continue
+		}
+		for _, device := range job.devices {
+			s.active[device]++
+			s.queued[device]--
+		}
+		s.running[job] = true
+		go f.runJob(job)
+	}
+	s.pending = waiting
+}
+
+func (f *fsys) canStart(job *job, reserved map[uint64]bool, waiting []*job) bool {
+	s := &f.scheduler
+	for _, device := range job.devices {
+		if reserved[device] || s.active[device] >= f.opts.CopyLanes {
+			return false
+		}
+	}
+	for other := range s.running {
+		if overlaps(job, other) {
+			return false
+		}
+	}
+	for _, other := range waiting {
+		if overlaps(job, other) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *fsys) runJob(finished *job) {
+	finished.run()
+
+	f.scheduler.Lock()
+	defer f.scheduler.Unlock()
+	for _, device := range finished.devices {
+		f.scheduler.active[device]--
+	}
+	delete(f.scheduler.running, finished)
+	f.dispatch()
+}
+
+// copyJob also claims the source's link group, so the links of one inode
+// are copied one after the other and every link after the first is
+// recreated as a link to it instead of being copied again.
+func (f *fsys) copyJob(copy copy) *job {
+	job := &job{
+		paths: []string{filepath.Join(copy.fromRoot, copy.path)},
+		run:   func() { f.loggedCopy(copy) },
+	}
+	if known := f.index.get(copy.fromRoot, copy.path); known != nil && known.file.Links > 1 {
+		job.paths = append(job.paths, linkGroup(copy.fromRoot, known.inode))
+	}
+	for _, root := range copy.toRoots {
+		job.paths = append(job.paths, filepath.Join(root, copy.path))
+		if device := deviceOf(root); !slices.Contains(job.devices, device) {
+			job.devices = append(job.devices, device)
+		}
+	}
+	return job
+}
+
+// linkGroup names the links of an inode with a path no file can have.
+func linkGroup(root string, inode uint64) string {
+	return filepath.Join(root, "\x00links", strconv.FormatUint(inode, 10))
+}
+
+// renameJob and deleteJob also touch the source folder, which they remove
+// once it is empty.
+func (f *fsys) renameJob(rename rename) *job {
+	return &job{
+		paths: append(parentFolder(rename.root, rename.sourcePath),
+			filepath.Join(rename.root, rename.sourcePath),
+			filepath.Join(rename.root, rename.targetPath)),
+		run: func() { f.loggedRename(rename) },
+	}
+}
+
+func (f *fsys) deleteJob(delete deleteCmd) *job {
+	return &job{
+		paths: append(parentFolder(delete.root, delete.path), filepath.Join(delete.root, delete.path)),
+		run:   func() { f.loggedDelete(delete) },
+	}
+}
+
+// parentFolder returns the folder containing the path unless it is the root,
+// which is never removed.
+func parentFolder(root, path string) []string {
+	if dir := filepath.Dir(path); dir != "." {
+		return []string{filepath.Join(root, dir)}
+	}
+	return nil
+}
+
+func (f *fsys) verifyJob(verify verify) *job {
+	return &job{
+		paths: []string{filepath.Join(verify.root, verify.path)},
+		run:   func() { f.verifyFile(verify) },
+	}
+}
+
+// restoreJob also touches the folders of the restored path, which it may create.
+func (f *fsys) restoreJob(restore restore) *job {
+	return &job{
+		paths: append(parentFolder(restore.root, restore.path),
+			filepath.Join(restore.root, trashDirName, restore.batch, restore.path),
+			filepath.Join(restore.root, restore.path)),
+		run: func() { f.restoreFile(restore) },
+	}
+}
+
+func (f *fsys) purgeJob(purge purge) *job {
+	return &job{
+		paths: []string{filepath.Join(purge.root, trashDirName, purge.batch, purge.path)},
+		run:   func() { f.purgeTrash(purge) },
+	}
+}
+
+// recoveryJob waits for everything else in the root, it may touch any of it.
+func (f *fsys) recoveryJob(recovery recovery) *job {
+	return &job{
+		paths: []string{recovery.root},
+		run:   func() { f.recoverBatch(recovery) },
+	}
+}
+
+// overlaps reports whether two jobs touch the same path or one touches a
+// folder containing a path of the other.
+func overlaps(a, b *job) bool {
+	for _, pathA := range a.paths {
+		for _, pathB := range b.paths {
+			if pathA == pathB || within(pathA, pathB) || within(pathB, pathA) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func within(path, dir string) bool {
+	return strings.HasPrefix(path, dir+string(filepath.Separator))
+}
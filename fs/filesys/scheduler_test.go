@@ -0,0 +1,79 @@
+package filesys
+
+import (
+	"arc/lifecycle"
+	"testing"
+	"time"
+)
+
+func TestScheduler(t *testing.T) {
+	f := &fsys{
+		lc:        lifecycle.New(),
+		opts:      Options{CopyLanes: 1},
+		scheduler: scheduler{active: map[uint64]int{}, running: map[*job]bool{}},
+	}
+	started := make(chan string, 4)
+	release := make(chan struct{})
+	blocking := func(name string) func() {
+		return func() {
+			started <- name
+			<-release
+		}
+	}
+
+	f.schedule(&job{devices: []uint64{1}, paths: []string{"/a/big"}, run: blocking("copy")})
+	f.schedule(&job{devices: []uint64{1}, paths: []string{"/a/other"}, run: blocking("second copy")})
+	f.schedule(&job{paths: []string{"/a/big"}, run: blocking("verify")})
+	f.schedule(&job{paths: []string{"/a/x", "/a/y"}, run: blocking("rename")})
+
+	want := map[string]bool{"copy": true, "rename": true}
+	for range want {
+		select {
+		case name := <-started:
+			if !want[name] {
+				t.Fatalf("%s started while the copy is running", name)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout")
+		}
+	}
+	select {
+	case name := <-started:
+		t.Fatalf("%s started while the copy is running", name)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+}
+
+func TestSchedulerBackpressure(t *testing.T) {
+	f := &fsys{
+		lc:        lifecycle.New(),
+		opts:      Options{CopyLanes: 1},
+		scheduler: scheduler{active: map[uint64]int{}, running: map[*job]bool{}},
+	}
+	release := make(chan struct{})
+	f.schedule(&job{devices: []uint64{1}, run: func() { <-release }})
+	for i := 0; i < queuedPerLane; i++ {
+		f.schedule(&job{devices: []uint64{1}, run: func() {}})
+	}
+	// Other devices and jobs without one are not held back.
+	f.schedule(&job{devices: []uint64{2}, run: func() {}})
+	f.schedule(&job{run: func() {}})
+
+	scheduled := make(chan struct{})
+	go func() {
+		f.schedule(&job{devices: []uint64{1}, run: func() {}})
+		close(scheduled)
+	}()
+	select {
+	case <-scheduled:
+		t.Fatal("scheduled past the bound of the device")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case <-scheduled:
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+}
@@ -0,0 +1,177 @@
+package filesys
+
+import (
+	"arc/fs"
+	"arc/lifecycle"
+	"cmp"
+	"encoding/base64"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// storeVerifiedEvery is how many verified files are recorded at once, so an
+// interrupted scrub loses little progress.
+const storeVerifiedEvery = 64
+
+// scrubArchive re-reads the files recorded in the meta file and compares them
+// with their recorded hashes. The files verified longest ago go first and the
+// verification times are stored, so every run continues where the previous
+// one stopped and Options.ScrubLimit lets a large archive be checked a slice
+// at a time.
+//
+// Every file is read whole, even when its hash only samples it: the first
+// scrub records the hash of the whole content next to the sampled one, and
+// later scrubs compare with both.
+func (f *fsys) scrubArchive(scrub scrub) {
+	f.lc.Started()
+	defer f.lc.Done()
+
+	defer func() {
+		f.events <- fs.ArchiveScrubbed{Root: scrub.root}
+	}()
+
+	var files []*meta
+	for _, file := range f.readMeta(scrub.root).byInode {
+		files = append(files, file)
+	}
+	slices.SortFunc(files, func(a, b *meta) int {
+		if byTime := a.verified.Compare(b.verified); byTime != 0 {
+			return byTime
+		}
+		return cmp.Compare(a.file.Path, b.file.Path)
+	})
+
+	verified := map[string]scrubbed{}
+	defer func() {
+		f.storeVerified(scrub.root, verified)
+	}()
+
+	scrubbedBytes := 0
+	for _, file := range files {
+		if f.lc.ShoudStop() || f.opts.ScrubLimit > 0 && scrubbedBytes >= f.opts.ScrubLimit {
+			return
+		}
+
+		path := filepath.Join(scrub.root, file.file.Path)
+		info, err := os.Lstat(path)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		// A modified file is not corrupted, it just needs rehashing on the next scan.
+		if int(info.Size()) != file.file.Size || !info.ModTime().UTC().Round(time.Second).Equal(file.file.ModTime) {
+			continue
+		}
+
+		result, ok := f.checkContent(scrub.root, file)
+		if !ok {
+			continue
+		}
+		scrubbedBytes += file.file.Size
+		verified[file.file.Path] = result
+		if len(verified) >= storeVerifiedEvery {
+			f.storeVerified(scrub.root, verified)
+			verified = map[string]scrubbed{}
+		}
+	}
+}
+
+// scrubbed is the outcome of reading a file that matched its hashes.
+type scrubbed struct {
+	at      time.Time
+	hash    string // the recorded hash the content matched
+	content string // the hash of the whole content of a sampled file
+}
+
+// checkContent reads the whole file and reports it verified or corrupted.
+// It returns false if the file is corrupted or could not be read.
+func (f *fsys) checkContent(root string, file *meta) (scrubbed, bool) {
+	path := filepath.Join(root, file.file.Path)
+	hash, content, err := f.readContent(path, file.file)
+	if err != nil {
+		if err != errInterrupted {
+			f.events <- fs.Error{Path: path, Error: err}
+		}
+		return scrubbed{}, false
+	}
+	if hash != file.file.Hash || file.content != "" && content != file.content {
+		f.events <- fs.Corrupted{Root: root, Path: file.file.Path, Hash: file.file.Hash}
+		return scrubbed{}, false
+	}
+	f.events <- fs.FileVerified{Root: root, Path: file.file.Path}
+	result := scrubbed{at: time.Now(), hash: hash}
+	if file.file.HashMode != fs.FullHash {
+		result.content = content
+	}
+	return result, true
+}
+
+// readContent reads every byte of the file once and returns its hash in the
+// recorded mode along with the hash of the whole content.
+func (f *fsys) readContent(path string, file *fs.FileMeta) (hash, content string, err error) {
+	reader, err := os.Open(path)
+	if err != nil {
+		return "", "", err
+	}
+	defer reader.Close()
+
+	full := f.newHash()
+	tee := io.TeeReader(stoppable{reader: reader, lc: f.lc}, full)
+	hash, err = HashStream(tee, file.Size, file.HashMode, file.Algorithm)
+	if err == nil {
+		_, err = io.Copy(io.Discard, tee)
+	}
+	if err != nil {
+		return "", "", err
+	}
+	return hash, base64.RawURLEncoding.EncodeToString(full.Sum(nil)), nil
+}
+
+// stoppable stops reading once arc quits.
+type stoppable struct {
+	reader io.Reader
+	lc     *lifecycle.Lifecycle
+}
+
+func (s stoppable) Read(b []byte) (int, error) {
+	if s.lc.ShoudStop() {
+		return 0, errInterrupted
+	}
+	return s.reader.Read(b)
+}
+
+// storeVerified records verification times and whole content hashes in the
+// root's meta file.
+func (f *fsys) storeVerified(root string, verified map[string]scrubbed) {
+	if len(verified) == 0 {
+		return
+	}
+	f.updateMeta(root, func(metas []*meta) {
+		for _, meta := range metas {
+			if result, ok := verified[meta.file.Path]; ok && result.hash == meta.file.Hash {
+				meta.verified = result.at
+				if meta.content == "" {
+					meta.content = result.content
+				}
+			}
+		}
+	})
+}
+
+// verifyFile re-reads a single file, for example a freshly repaired one, and
+// compares it with its recorded hash. It waits for earlier copies of the
+// same file, so a Verify pushed after a Copy checks the copied file.
+func (f *fsys) verifyFile(verify verify) {
+	path := norm.NFC.String(verify.path)
+	known := f.index.get(verify.root, path)
+	if known == nil || known.file.Kind != fs.RegularFile {
+		return
+	}
+	if result, ok := f.checkContent(verify.root, known); ok {
+		f.storeVerified(verify.root, map[string]scrubbed{path: result})
+	}
+}
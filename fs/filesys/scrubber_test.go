@@ -0,0 +1,68 @@
+package filesys
+
+import (
+	"arc/fs"
+	"arc/lifecycle"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestScrub(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    fs.HashMode
+		offset  int // the byte damaged after the first scrub, -1 for none
+		corrupt bool
+	}{
+		{"intact", fs.SampledHash, -1, false},
+		{"sampled head", fs.SampledHash, 0, true},
+		{"sampled middle", fs.SampledHash, 2 * bufSize, true},
+		{"full middle", fs.FullHash, 2 * bufSize, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			path := filepath.Join(root, "file")
+			content := make([]byte, 4*bufSize)
+			for i := range content {
+				content[i] = byte(i)
+			}
+			modTime := time.Now().Add(-time.Hour).Round(time.Second)
+			os.WriteFile(path, content, 0644)
+			os.Chtimes(path, modTime, modTime)
+
+			f := NewFS(lifecycle.New(), Options{HashMode: test.mode}).(*fsys)
+			defer f.Quit()
+			scanned(t, f, root)
+
+			// The first scrub records the hash of the whole content.
+			f.Scrub(root)
+			waitFor[fs.FileVerified](t, f.events)
+			waitFor[fs.ArchiveScrubbed](t, f.events)
+
+			if test.offset >= 0 {
+				content[test.offset]++
+				os.WriteFile(path, content, 0644)
+				os.Chtimes(path, modTime, modTime)
+			}
+			f.Scrub(root)
+			corrupt := false
+			for done := false; !done; {
+				switch event := waitFor[fs.Event](t, f.events).(type) {
+				case fs.Corrupted:
+					corrupt = true
+				case fs.FileVerified:
+					corrupt = false
+				case fs.ArchiveScrubbed:
+					done = event.Root == root
+				}
+			}
+			if corrupt != test.corrupt {
+				t.Errorf("corrupted %v, expected %v", corrupt, test.corrupt)
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package filesys
+
+import (
+	"arc/fs"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Open returns the content of a regular file in the root.
+func (f *fsys) Open(root, path string) (io.ReadCloser, fs.FileMeta, error) {
+	fullPath := filepath.Join(root, path)
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return nil, fs.FileMeta{}, err
+	}
+	info, err := file.Stat()
+	if err == nil && !info.Mode().IsRegular() {
+		err = fmt.Errorf("%s: not a regular file", fullPath)
+	}
+	if err != nil {
+		file.Close()
+		return nil, fs.FileMeta{}, err
+	}
+	sys := info.Sys().(*syscall.Stat_t)
+	meta := fs.FileMeta{
+		Root:      root,
+		Path:      path,
+		Inode:     sys.Ino,
+		Links:     int(sys.Nlink),
+		Size:      int(info.Size()),
+		ModTime:   info.ModTime().UTC().Round(time.Second),
+		Mode:      info.Mode() & preservedModeBits,
+		UID:       int(sys.Uid),
+		GID:       int(sys.Gid),
+		Xattrs:    f.xattrDigest(fullPath),
+		HashMode:  f.opts.HashMode,
+		Algorithm: f.opts.Hasher,
+	}
+	if known := f.index.get(root, path); known != nil {
+		meta.Hash = known.file.Hash
+	}
+	return file, meta, nil
+}
+
+// Create writes the file into a hidden temp file next to its place, like a
+// copy does, and commits it the same way. It is logged as a copy of the
+// current batch.
+func (f *fsys) Create(meta fs.FileMeta) (fs.FileWriter, error) {
+	meta.Path = norm.NFC.String(meta.Path)
+	tempPath, _ := copyPaths(meta.Root, meta.Path)
+	if err := os.MkdirAll(filepath.Dir(tempPath), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.Create(tempPath)
+	if err != nil {
+		return nil, err
+	}
+	batch, seq := f.nextOp()
+	record := opRecord{batch: batch, seq: seq, state: opStarted, kind: fs.CopyOperation,
+		path: meta.Path, hash: meta.Hash, existed: exists(filepath.Join(meta.Root, meta.Path))}
+	f.logOp(meta.Root, record)
+	return &upload{fsys: f, meta: meta, file: file, tempPath: tempPath, hash: f.newHash(), record: record}, nil
+}
+
+type upload struct {
+	fsys     *fsys
+	meta     fs.FileMeta
+	file     *os.File
+	tempPath string
+	hash     hash.Hash
+	record   opRecord
+}
+
+func (u *upload) Write(b []byte) (int, error) {
+	n, err := u.file.Write(b)
+	u.hash.Write(b[:n])
+	return n, err
+}
+
+// Commit checks the written file against the stream and against the hash of
+// the meta, in the meta's mode and algorithm, before putting it in place.
+func (u *upload) Commit() error {
+	f, root, path := u.fsys, u.meta.Root, u.meta.Path
+	err := u.file.Sync()
+	if closeErr := u.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = f.verifyCopy(u.tempPath, base64.RawURLEncoding.EncodeToString(u.hash.Sum(nil)), u.meta)
+	}
+	if err == nil && u.meta.Mode != 0 {
+		err = os.Chmod(u.tempPath, u.meta.Mode)
+	}
+
+	// A hash of another mode or algorithm would never match; the next scan
+	// hashes the file instead.
+	hash := u.meta.Hash
+	if u.meta.HashMode != f.opts.HashMode || u.meta.Algorithm != f.opts.Hasher {
+		hash = ""
+	}
+	var meta *meta
+	if err == nil {
+		meta, err = f.placeCopy(u.tempPath, root, path, u.meta.ModTime, hash)
+	}
+	if err != nil {
+		_ = os.Remove(u.tempPath)
+		u.logOutcome(opFailed)
+		return err
+	}
+	u.logOutcome(opFinished)
+	if hash != "" {
+		f.appendMeta(root, meta)
+	}
+	f.reportDiskSpace(root)
+	return nil
+}
+
+func (u *upload) Abort() {
+	_ = u.file.Close()
+	_ = os.Remove(u.tempPath)
+	u.logOutcome(opFailed)
+}
+
+func (u *upload) logOutcome(state string) {
+	u.record.state = state
+	u.fsys.logOp(u.meta.Root, u.record)
+}
@@ -0,0 +1,57 @@
+package filesys
+
+import (
+	"arc/fs"
+	"arc/lifecycle"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCommitUpload(t *testing.T) {
+	content := []byte("uploaded content")
+	full, _ := HashStream(bytes.NewReader(content), len(content), fs.FullHash, DefaultHasher)
+	tests := []struct {
+		name      string
+		mode      fs.HashMode // of the archive
+		meta      fs.FileMeta
+		committed bool
+		kept      bool // the hash is recorded
+	}{
+		{"no hash", fs.FullHash, fs.FileMeta{}, true, false},
+		{"matching hash", fs.FullHash, fs.FileMeta{Hash: full, HashMode: fs.FullHash, Algorithm: DefaultHasher}, true, true},
+		{"hash of other content", fs.FullHash, fs.FileMeta{Hash: "other", HashMode: fs.FullHash, Algorithm: DefaultHasher}, false, false},
+		{"hash of another mode", fs.SampledHash, fs.FileMeta{Hash: full, HashMode: fs.FullHash, Algorithm: DefaultHasher}, true, false},
+		{"unknown algorithm", fs.FullHash, fs.FileMeta{Hash: full, HashMode: fs.FullHash, Algorithm: "unknown"}, false, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			f := NewFS(lifecycle.New(), Options{HashMode: test.mode}).(*fsys)
+			defer f.Quit()
+
+			meta := test.meta
+			meta.Root, meta.Path, meta.Size = root, "a", len(content)
+			writer, err := f.Create(meta)
+			if err != nil {
+				t.Fatal(err)
+			}
+			writer.Write(content)
+			if err := writer.Commit(); (err == nil) != test.committed {
+				t.Fatalf("commit error %v, expected committed %v", err, test.committed)
+			}
+			_, err = os.Stat(filepath.Join(root, "a"))
+			if placed := err == nil; placed != test.committed {
+				t.Errorf("placed %v, expected %v", placed, test.committed)
+			}
+			if entries, _ := os.ReadDir(root); !test.committed && len(entries) != 0 {
+				t.Errorf("left behind %v", entries)
+			}
+			known := f.index.get(root, "a")
+			if kept := known != nil && known.file.Hash != ""; kept != test.kept {
+				t.Errorf("hash kept %v, expected %v", kept, test.kept)
+			}
+		})
+	}
+}
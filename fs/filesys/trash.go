@@ -0,0 +1,165 @@
+package filesys
+
+import (
+	"arc/fs"
+	"arc/log"
+	"fmt"
+	iofs "io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Deleted files are moved to .arc-trash/<batch>/ in their root, keeping their
+// relative paths, where batch is the time of the deletion.
+const (
+	trashDirName     = ".arc-trash"
+	trashBatchFormat = "2006-01-02T15-04-05.000"
+)
+
+func trashBatch() string {
+	return time.Now().UTC().Format(trashBatchFormat)
+}
+
+// trashBatchTime returns when the batch was deleted.
+func trashBatchTime(batch string) (time.Time, bool) {
+	batch, _, _ = strings.Cut(batch, "~")
+	deleted, err := time.Parse(trashBatchFormat, batch)
+	return deleted, err == nil
+}
+
+// moveToTrash moves the entry at path into the batch of the root's trash and
+// returns the batch it ended up in.
+func (f *fsys) moveToTrash(root, path, batch string) (string, error) {
+	base := batch
+	target := filepath.Join(root, trashDirName, batch, path)
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(target); err != nil {
+			break
+		}
+		// Two deletions of the same path within the same millisecond.
+		batch = fmt.Sprintf("%s~%d", base, i)
+		target = filepath.Join(root, trashDirName, batch, path)
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return "", err
+	}
+	return batch, os.Rename(filepath.Join(root, path), target)
+}
+
+func (f *fsys) listTrash(trash trash) {
+	f.lc.Started()
+	defer f.lc.Done()
+	defer func() {
+		f.events <- fs.TrashListed{Root: trash.root}
+	}()
+
+	trashPath := filepath.Join(trash.root, trashDirName)
+	batches, _ := os.ReadDir(trashPath)
+	for _, batch := range batches {
+		if !batch.IsDir() {
+			continue
+		}
+		batchPath := filepath.Join(trashPath, batch.Name())
+		_ = filepath.WalkDir(batchPath, func(path string, d iofs.DirEntry, err error) error {
+			if err != nil || path == batchPath {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			kind := fs.RegularFile
+			switch {
+			case d.IsDir():
+				if entries, _ := os.ReadDir(path); len(entries) > 0 {
+					return nil
+				}
+				kind = fs.Directory
+			case d.Type()&iofs.ModeSymlink != 0:
+				kind = fs.Symlink
+			case !d.Type().IsRegular():
+				return nil
+			}
+			relPath, _ := filepath.Rel(batchPath, path)
+			f.events <- fs.TrashEntry{
+				Root:    trash.root,
+				Batch:   batch.Name(),
+				Path:    norm.NFC.String(relPath),
+				Kind:    kind,
+				Size:    int(info.Size()),
+				ModTime: info.ModTime().UTC().Round(time.Second),
+			}
+			return nil
+		})
+	}
+}
+
+// restoreFile moves an entry of the trash back to its original path and
+// reports it the same way a scan does. An entry never replaces a file that
+// took its place in the meantime.
+func (f *fsys) restoreFile(restore restore) {
+	log.Debug("restore", "root", restore.root, "batch", restore.batch, "path", restore.path)
+	source := filepath.Join(restore.root, trashDirName, restore.batch, restore.path)
+	target := filepath.Join(restore.root, restore.path)
+	if _, err := os.Lstat(target); err == nil {
+		f.events <- fs.Error{Path: target, Error: os.ErrExist}
+		return
+	}
+	err := os.MkdirAll(filepath.Dir(target), 0755)
+	if err == nil {
+		err = os.Rename(source, target)
+	}
+	if err != nil {
+		f.events <- fs.Error{Path: target, Error: err}
+		return
+	}
+	f.removeEmptyTrashDirs(restore.root, restore.batch, filepath.Dir(restore.path))
+	f.events <- fs.Restored{Root: restore.root, Batch: restore.batch, Path: restore.path}
+	f.rescanFile(restore.root, restore.path)
+}
+
+// purgeTrash permanently removes an entry or, with an empty path, a whole
+// batch from the trash.
+func (f *fsys) purgeTrash(purge purge) {
+	log.Debug("purge", "root", purge.root, "batch", purge.batch, "path", purge.path)
+	path := filepath.Join(purge.root, trashDirName, purge.batch, purge.path)
+	if err := os.RemoveAll(path); err != nil {
+		f.events <- fs.Error{Path: path, Error: err}
+		return
+	}
+	if purge.path != "" {
+		f.removeEmptyTrashDirs(purge.root, purge.batch, filepath.Dir(purge.path))
+	}
+	f.events <- fs.Purged{Root: purge.root, Batch: purge.batch, Path: purge.path}
+	f.reportDiskSpace(purge.root)
+}
+
+// purgeExpiredTrash removes the batches older than Options.TrashRetention.
+func (f *fsys) purgeExpiredTrash(root string) {
+	if f.opts.TrashRetention <= 0 || f.opts.DryRun {
+		return
+	}
+	batches, _ := os.ReadDir(filepath.Join(root, trashDirName))
+	for _, batch := range batches {
+		deleted, ok := trashBatchTime(batch.Name())
+		if ok && time.Since(deleted) > f.opts.TrashRetention {
+			log.Debug("trash expired", "root", root, "batch", batch.Name())
+			_ = os.RemoveAll(filepath.Join(root, trashDirName, batch.Name()))
+		}
+	}
+}
+
+// removeEmptyTrashDirs removes the folders of a batch, and the batch itself,
+// that were left empty by a restore or a purge.
+func (f *fsys) removeEmptyTrashDirs(root, batch, dir string) {
+	batchPath := filepath.Join(root, trashDirName, batch)
+	for path := filepath.Join(batchPath, dir); path != filepath.Dir(batchPath); path = filepath.Dir(path) {
+		if os.Remove(path) != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package filesys
+
+import (
+	"arc/fs"
+	"arc/lifecycle"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTrash(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "dir"), 0755)
+	os.WriteFile(filepath.Join(root, "dir", "a"), []byte("a"), 0644)
+	os.WriteFile(filepath.Join(root, "b"), []byte("b"), 0644)
+
+	f := NewFS(lifecycle.New(), Options{}).(*fsys)
+	defer f.Quit()
+	scanned(t, f, root)
+
+	f.Delete(root, "dir/a")
+	deletedA := waitFor[fs.Deleted](t, f.events)
+	f.Delete(root, "b")
+	deletedB := waitFor[fs.Deleted](t, f.events)
+	for _, path := range []string{"dir/a", "dir", "b"} {
+		if _, err := os.Lstat(filepath.Join(root, path)); !os.IsNotExist(err) {
+			t.Errorf("%s was not moved to the trash: %v", path, err)
+		}
+	}
+
+	f.Trash(root)
+	listed := map[string]string{}
+	for done := false; !done; {
+		switch event := waitFor[fs.Event](t, f.events).(type) {
+		case fs.TrashEntry:
+			listed[event.Path] = event.Batch
+		case fs.TrashListed:
+			done = true
+		}
+	}
+	if listed["dir/a"] != deletedA.Batch || listed["b"] != deletedB.Batch {
+		t.Errorf("unexpected trash %v", listed)
+	}
+
+	f.Restore(root, deletedA.Batch, "dir/a")
+	waitFor[fs.Restored](t, f.events)
+	if content, err := os.ReadFile(filepath.Join(root, "dir", "a")); err != nil || string(content) != "a" {
+		t.Errorf("dir/a was not restored: %v", err)
+	}
+
+	// A restore never replaces a file that took the place of the deleted one.
+	os.WriteFile(filepath.Join(root, "b"), []byte("new"), 0644)
+	f.Restore(root, deletedB.Batch, "b")
+	if failed := waitFor[fs.Error](t, f.events); failed.Error != os.ErrExist {
+		t.Errorf("unexpected error %v", failed.Error)
+	}
+
+	f.Purge(root, deletedB.Batch, "b")
+	waitFor[fs.Purged](t, f.events)
+	if entries, _ := os.ReadDir(filepath.Join(root, trashDirName)); len(entries) != 0 {
+		t.Errorf("the trash is not empty: %v", entries)
+	}
+}
+
+func TestPurgeExpiredTrash(t *testing.T) {
+	tests := []struct {
+		batch   string
+		expired bool
+	}{
+		{time.Now().Add(-48 * time.Hour).UTC().Format(trashBatchFormat), true},
+		{time.Now().Add(-48*time.Hour).UTC().Format(trashBatchFormat) + "~1", true},
+		{time.Now().Add(-time.Hour).UTC().Format(trashBatchFormat), false},
+		{"not a batch", false},
+	}
+
+	root := t.TempDir()
+	for _, test := range tests {
+		os.MkdirAll(filepath.Join(root, trashDirName, test.batch), 0755)
+	}
+	f := &fsys{opts: Options{TrashRetention: 24 * time.Hour}}
+	f.purgeExpiredTrash(root)
+
+	for _, test := range tests {
+		_, err := os.Stat(filepath.Join(root, trashDirName, test.batch))
+		if expired := os.IsNotExist(err); expired != test.expired {
+			t.Errorf("%s: expired %v, expected %v", test.batch, expired, test.expired)
+		}
+	}
+}
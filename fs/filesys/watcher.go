@@ -0,0 +1,159 @@
+package filesys
+
+import (
+	"arc/fs"
+	iofs "io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// rescanFile brings a file or a folder changed outside of arc up to date
+// and reports the changes the same way the initial scan does.
+func (f *fsys) rescanFile(root, path string) {
+	absPath := filepath.Join(root, path)
+	info, err := os.Lstat(absPath)
+	if err != nil || f.ignored(root, path, info.IsDir()) {
+		return
+	}
+
+	if info.IsDir() {
+		entries, _ := os.ReadDir(absPath)
+		empty := true
+		for _, entry := range entries {
+			entryPath := filepath.Join(path, entry.Name())
+			if !f.ignored(root, entryPath, entry.IsDir()) {
+				empty = false
+				f.rescanFile(root, entryPath)
+			}
+		}
+		if empty {
+			f.rescanEntry(root, path, info)
+		}
+		return
+	}
+
+	if info.Mode()&iofs.ModeSymlink != 0 {
+		f.rescanEntry(root, path, info)
+		return
+	}
+
+	if !info.Mode().IsRegular() {
+		return
+	}
+
+	path = norm.NFC.String(path)
+	sys := info.Sys().(*syscall.Stat_t)
+	inode := sys.Ino
+	size := int(info.Size())
+	modTime := info.ModTime().UTC().Round(time.Second)
+	known := f.index.get(root, path)
+	if known != nil && known.inode == inode && known.file.Size == size && known.file.ModTime == modTime {
+		// The content is the same; only the mode, the ownership or the
+		// extended attributes may differ.
+		mode, uid, gid, xattrs := info.Mode()&preservedModeBits, int(sys.Uid), int(sys.Gid), f.xattrDigest(absPath)
+		if known.file.Mode != mode || known.file.UID != uid || known.file.GID != gid || known.file.Xattrs != xattrs {
+			file := *known.file
+			file.Mode, file.UID, file.GID, file.Xattrs = mode, uid, gid, xattrs
+			f.index.set(root, &meta{inode: inode, file: &file, verified: known.verified, content: known.content})
+			f.events <- file
+		}
+		return
+	}
+
+	file := &fs.FileMeta{
+		Root:      root,
+		Path:      path,
+		Inode:     inode,
+		Links:     int(sys.Nlink),
+		Size:      size,
+		ModTime:   modTime,
+		Mode:      info.Mode() & preservedModeBits,
+		UID:       int(sys.Uid),
+		GID:       int(sys.Gid),
+		Xattrs:    f.xattrDigest(absPath),
+		HashMode:  f.opts.HashMode,
+		Algorithm: f.opts.Hasher,
+	}
+	f.events <- *file
+
+	file.Hash = f.hashFile(file)
+	if file.Hash == "" {
+		return
+	}
+	f.events <- fs.FileHashed{
+		Root:      root,
+		Path:      path,
+		Hash:      file.Hash,
+		HashMode:  file.HashMode,
+		Algorithm: file.Algorithm,
+	}
+
+	meta := &meta{inode: inode, file: file}
+	f.index.set(root, meta)
+	f.appendMeta(root, meta)
+}
+
+// rescanRoot catches up with the changes of a root the watcher lost track
+// of: files gone since are reported deleted and the rest rescanned.
+func (f *fsys) rescanRoot(root string) {
+	for _, path := range f.index.paths(root) {
+		if _, err := os.Lstat(filepath.Join(root, path)); err != nil {
+			f.fileDeleted(root, path)
+		}
+	}
+	entries, _ := os.ReadDir(root)
+	for _, entry := range entries {
+		if !f.ignored(root, entry.Name(), entry.IsDir()) {
+			f.rescanFile(root, entry.Name())
+		}
+	}
+}
+
+// rescanEntry reports a new or changed empty folder or symlink.
+func (f *fsys) rescanEntry(root, path string, info iofs.FileInfo) {
+	file := f.entryMeta(root, path, info)
+	if file == nil {
+		return
+	}
+	known := f.index.get(root, file.Path)
+	if known != nil && known.file.Hash == file.Hash {
+		return
+	}
+	f.events <- *file
+	f.index.set(root, &meta{inode: info.Sys().(*syscall.Stat_t).Ino, file: file})
+}
+
+// fileDeleted reports a file or a folder removed outside of arc.
+func (f *fsys) fileDeleted(root, path string) {
+	path = norm.NFC.String(path)
+	if !f.index.contains(root, path) {
+		return
+	}
+	f.index.remove(root, path)
+	f.events <- fs.Deleted{Root: root, Path: path}
+}
+
+// fileRenamed reports a file or a folder moved within the root outside of arc.
+func (f *fsys) fileRenamed(root, sourcePath, targetPath string) {
+	sourcePath = norm.NFC.String(sourcePath)
+	targetPath = norm.NFC.String(targetPath)
+	if !f.index.contains(root, sourcePath) {
+		f.rescanFile(root, targetPath)
+		return
+	}
+	if f.ignored(root, targetPath, false) {
+		f.fileDeleted(root, sourcePath)
+		return
+	}
+	f.fileDeleted(root, targetPath)
+	f.index.move(root, sourcePath, targetPath)
+	f.events <- fs.Renamed{
+		Root:       root,
+		SourcePath: sourcePath,
+		TargetPath: targetPath,
+	}
+}
@@ -0,0 +1,164 @@
+//go:build linux
+
+package filesys
+
+import (
+	"arc/fs"
+	iofs "io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const watchMask = unix.IN_CREATE | unix.IN_CLOSE_WRITE | unix.IN_ATTRIB | unix.IN_DELETE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO
+
+type watcher struct {
+	fsys *fsys
+	fd   int
+	root string
+	dirs map[int]string
+}
+
+func (f *fsys) watchArchive(root string) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		f.events <- fs.Error{Path: root, Error: err}
+		return
+	}
+	w := &watcher{
+		fsys: f,
+		fd:   fd,
+		root: root,
+		dirs: map[int]string{},
+	}
+	w.addDirs("")
+	go w.run()
+}
+
+func (w *watcher) addDirs(path string) {
+	_ = filepath.WalkDir(filepath.Join(w.root, path), func(dirPath string, d iofs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+		relPath, _ := filepath.Rel(w.root, dirPath)
+		if relPath == "." {
+			relPath = ""
+		} else if w.fsys.ignored(w.root, relPath, true) {
+			return iofs.SkipDir
+		}
+		wd, err := unix.InotifyAddWatch(w.fd, dirPath, watchMask)
+		if err != nil {
+			w.fsys.events <- fs.Error{Path: dirPath, Error: err}
+			return nil
+		}
+		w.dirs[wd] = relPath
+		return nil
+	})
+}
+
+func (w *watcher) run() {
+	defer unix.Close(w.fd)
+
+	buf := make([]byte, 64*1024)
+	pollFds := []unix.PollFd{{Fd: int32(w.fd), Events: unix.POLLIN}}
+	for !w.fsys.lc.ShoudStop() {
+		n, err := unix.Poll(pollFds, 500)
+		if n == 0 || err == unix.EINTR {
+			continue
+		}
+		n, err = unix.Read(w.fd, buf)
+		if err == unix.EAGAIN || err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			w.fsys.events <- fs.Error{Path: w.root, Error: err}
+			return
+		}
+		w.handle(buf[:n])
+	}
+}
+
+func (w *watcher) handle(buf []byte) {
+	movedFrom := map[uint32]string{}
+
+	for offset := 0; offset+unix.SizeofInotifyEvent <= len(buf); {
+		event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+		nameStart := offset + unix.SizeofInotifyEvent
+		offset = nameStart + int(event.Len)
+		name := strings.TrimRight(string(buf[nameStart:offset]), "\x00")
+
+		// The kernel dropped events, so the root has to be compared anew.
+		if event.Mask&unix.IN_Q_OVERFLOW != 0 {
+			w.addDirs("")
+			w.fsys.rescanRoot(w.root)
+			continue
+		}
+		dir, ok := w.dirs[int(event.Wd)]
+		if event.Mask&unix.IN_IGNORED != 0 {
+			delete(w.dirs, int(event.Wd))
+			continue
+		}
+		if !ok {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		isDir := event.Mask&unix.IN_ISDIR != 0
+
+		switch {
+		case event.Mask&unix.IN_CREATE != 0:
+			// New regular files are reported once they are closed after writing.
+			if isDir {
+				w.addDirs(path)
+				w.fsys.rescanFile(w.root, path)
+			} else if info, err := os.Lstat(filepath.Join(w.root, path)); err == nil && info.Mode()&iofs.ModeSymlink != 0 {
+				w.fsys.rescanFile(w.root, path)
+			}
+
+		case event.Mask&unix.IN_CLOSE_WRITE != 0:
+			w.fsys.rescanFile(w.root, path)
+
+		case event.Mask&unix.IN_ATTRIB != 0:
+			// Permissions or ownership changed; a folder's own don't matter.
+			if !isDir {
+				w.fsys.rescanFile(w.root, path)
+			}
+
+		case event.Mask&unix.IN_DELETE != 0:
+			w.fsys.fileDeleted(w.root, path)
+
+		case event.Mask&unix.IN_MOVED_FROM != 0:
+			movedFrom[event.Cookie] = path
+
+		case event.Mask&unix.IN_MOVED_TO != 0:
+			sourcePath, ok := movedFrom[event.Cookie]
+			if !ok {
+				if isDir {
+					w.addDirs(path)
+				}
+				w.fsys.rescanFile(w.root, path)
+				continue
+			}
+			delete(movedFrom, event.Cookie)
+			if isDir {
+				w.moveDirs(sourcePath, path)
+			}
+			w.fsys.fileRenamed(w.root, sourcePath, path)
+		}
+	}
+
+	// Whatever was moved from and not to a watched folder has left the root.
+	for _, path := range movedFrom {
+		w.fsys.fileDeleted(w.root, path)
+	}
+}
+
+func (w *watcher) moveDirs(sourcePath, targetPath string) {
+	for wd, path := range w.dirs {
+		if path == sourcePath || strings.HasPrefix(path, sourcePath+"/") {
+			w.dirs[wd] = targetPath + path[len(sourcePath):]
+		}
+	}
+}
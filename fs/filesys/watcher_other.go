@@ -0,0 +1,6 @@
+//go:build !linux
+
+package filesys
+
+// watchArchive is only supported on Linux for now.
+func (f *fsys) watchArchive(root string) {}
@@ -0,0 +1,64 @@
+//go:build linux
+
+package filesys
+
+import (
+	"bytes"
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// copyXattrs copies the extended attributes of source to target. Attributes
+// the target's filesystem or the process's privileges don't allow are
+// skipped.
+func copyXattrs(source, target string) error {
+	attrs, err := readXattrs(source)
+	if err != nil {
+		return err
+	}
+	for name, value := range attrs {
+		err = unix.Lsetxattr(target, name, value, 0)
+		if err := ignoreXattrError(err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readXattrs returns the extended attributes of path the process can read.
+func readXattrs(path string) (map[string][]byte, error) {
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil || size == 0 {
+		return nil, ignoreXattrError(err)
+	}
+	names := make([]byte, size)
+	size, err = unix.Llistxattr(path, names)
+	if err != nil {
+		return nil, ignoreXattrError(err)
+	}
+	attrs := map[string][]byte{}
+	for _, name := range bytes.Split(names[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		size, err := unix.Lgetxattr(path, string(name), nil)
+		if err != nil {
+			continue
+		}
+		value := make([]byte, size)
+		size, err = unix.Lgetxattr(path, string(name), value)
+		if err != nil {
+			continue
+		}
+		attrs[string(name)] = value[:size]
+	}
+	return attrs, nil
+}
+
+func ignoreXattrError(err error) error {
+	if errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EPERM) || errors.Is(err, unix.EACCES) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package filesys
+
+// copyXattrs is only supported on Linux for now.
+func copyXattrs(source, target string) error {
+	return nil
+}
+
+func readXattrs(path string) (map[string][]byte, error) {
+	return nil, nil
+}
@@ -2,6 +2,8 @@ package fs
 
 import (
 	"fmt"
+	"io"
+	"os"
 	"time"
 )
 
@@ -11,26 +13,67 @@ type (
 		Scan(root string)
 		Copy(path, hash, fromRoot string, toRoots ...string)
 		Rename(root, sourcePath, targetPath string)
-		Delete(path string)
+		Delete(root, path string)
+		Scrub(root string)
+		Verify(root, path string)
+		Trash(root string)
+		Restore(root, batch, path string)
+		Purge(root, batch, path string)
+		Batch()
+		Recover(root, batch string, forward bool)
 		Quit()
 	}
 
+	// Streamer is implemented by the backends that can hand out and take in
+	// file contents. Copies between roots of different backends go through it.
+	Streamer interface {
+		// Open returns the content of a regular file and what the backend
+		// knows about it.
+		Open(root, path string) (io.ReadCloser, FileMeta, error)
+		// Create starts writing the file the meta describes.
+		Create(meta FileMeta) (FileWriter, error)
+	}
+
+	FileWriter interface {
+		io.Writer
+		Commit() error // verifies what was written and puts the file in place
+		Abort()        // discards what was written
+	}
+
 	Event interface {
 		event()
 	}
 
+	HashMode int
+
+	EntryKind int
+
+	OperationKind int
+
 	FileMeta struct {
-		Root    string
-		Path    string
-		Size    int
-		ModTime time.Time
-		Hash    string
+		Root      string
+		Path      string
+		Kind      EntryKind
+		Target    string // symlink target
+		Inode     uint64
+		Links     int // number of hard links to the inode
+		Size      int
+		ModTime   time.Time
+		Mode      os.FileMode // permission, setuid, setgid and sticky bits
+		UID       int
+		GID       int
+		Xattrs    string // digest of the extended attributes, empty without any
+		Hash      string
+		HashMode  HashMode
+		Algorithm string
 	}
 
 	FileHashed struct {
-		Root string
-		Path string
-		Hash string
+		Root      string
+		Path      string
+		Hash      string
+		HashMode  HashMode
+		Algorithm string
 	}
 
 	CopyProgress struct {
@@ -49,6 +92,17 @@ type (
 		ToRoots  []string
 	}
 
+	CopyVerified struct {
+		Root string // the root the file was copied to
+		Path string
+	}
+
+	CopyFailed struct {
+		Root  string // the root the file was copied to
+		Path  string
+		Error error
+	}
+
 	Renamed struct {
 		Root       string
 		SourcePath string
@@ -56,28 +110,176 @@ type (
 	}
 
 	Deleted struct {
+		Root  string
+		Path  string
+		Batch string // trash batch holding the file, empty if deleted outside of arc
+	}
+
+	FileVerified struct {
+		Root string
 		Path string
 	}
 
+	Corrupted struct {
+		Root string
+		Path string
+		Hash string // the recorded hash the content no longer matches
+	}
+
+	ArchiveScrubbed struct {
+		Root string
+	}
+
+	// TrashEntry is a file, a symlink or an empty folder deleted into the
+	// root's trash. Entries deleted together share a batch.
+	TrashEntry struct {
+		Root    string
+		Batch   string
+		Path    string
+		Kind    EntryKind
+		Size    int
+		ModTime time.Time
+	}
+
+	TrashListed struct {
+		Root string
+	}
+
+	Restored struct {
+		Root  string
+		Batch string
+		Path  string
+	}
+
+	Purged struct {
+		Root  string
+		Batch string
+		Path  string // empty for the whole batch
+	}
+
+	// IncompleteBatch is a batch of operations logged in the root that was
+	// interrupted before all of them finished.
+	IncompleteBatch struct {
+		Root       string
+		Batch      string
+		Operations []LoggedOperation
+	}
+
+	LoggedOperation struct {
+		Kind       OperationKind
+		Path       string
+		TargetPath string // rename
+		FromRoot   string // copy
+		Finished   bool
+	}
+
+	BatchRecovered struct {
+		Root    string
+		Batch   string
+		Forward bool
+	}
+
+	DiskSpace struct {
+		Root string
+		Free int // bytes available to arc on the root's volume
+	}
+
 	Error struct {
 		Path  string
 		Error error
 	}
 )
 
-func (FileMeta) event()      {}
-func (FileHashed) event()    {}
-func (CopyProgress) event()  {}
-func (ArchiveHashed) event() {}
-func (Copied) event()        {}
-func (Renamed) event()       {}
-func (Deleted) event()       {}
-func (Error) event()         {}
+// ConflictsDir is the folder of an archive that files in the way of a
+// resolution can be moved to.
+const ConflictsDir = ".arc-conflicts"
+
+const (
+	SampledHash HashMode = iota
+	FullHash
+)
+
+const (
+	RegularFile EntryKind = iota
+	Directory
+	Symlink
+)
+
+const (
+	RenameOperation OperationKind = iota
+	CopyOperation
+	DeleteOperation
+)
+
+func (FileMeta) event()        {}
+func (FileHashed) event()      {}
+func (CopyProgress) event()    {}
+func (ArchiveHashed) event()   {}
+func (Copied) event()          {}
+func (CopyVerified) event()    {}
+func (CopyFailed) event()      {}
+func (Renamed) event()         {}
+func (Deleted) event()         {}
+func (FileVerified) event()    {}
+func (Corrupted) event()       {}
+func (ArchiveScrubbed) event() {}
+func (TrashEntry) event()      {}
+func (TrashListed) event()     {}
+func (Restored) event()        {}
+func (Purged) event()          {}
+func (IncompleteBatch) event() {}
+func (BatchRecovered) event()  {}
+func (DiskSpace) event()       {}
+func (Error) event()           {}
 
 func (event FileMeta) String() string {
-	return fmt.Sprintf("FileMeta{Root: %q, Path: %q, Size: %d, ModTime: %s}", event.Root, event.Path, event.Size, event.ModTime.Format("2006-01-02 15:04:05"))
+	return fmt.Sprintf("FileMeta{Root: %q, Path: %q, Kind: %s, Size: %d, ModTime: %s, HashMode: %s}", event.Root, event.Path, event.Kind, event.Size, event.ModTime.Format("2006-01-02 15:04:05"), event.HashMode)
 }
 
 func (event FileHashed) String() string {
-	return fmt.Sprintf("FileHashed{Root: %q, Path: %q, Hash: %q}", event.Root, event.Path, event.Hash)
+	return fmt.Sprintf("FileHashed{Root: %q, Path: %q, Hash: %q, HashMode: %s, Algorithm: %s}", event.Root, event.Path, event.Hash, event.HashMode, event.Algorithm)
+}
+
+func (mode HashMode) String() string {
+	switch mode {
+	case SampledHash:
+		return "sampled"
+	case FullHash:
+		return "full"
+	}
+	return fmt.Sprintf("HashMode(%d)", int(mode))
+}
+
+func (kind EntryKind) String() string {
+	switch kind {
+	case RegularFile:
+		return "file"
+	case Directory:
+		return "directory"
+	case Symlink:
+		return "symlink"
+	}
+	return fmt.Sprintf("EntryKind(%d)", int(kind))
+}
+
+func ParseHashMode(name string) (HashMode, error) {
+	switch name {
+	case "sampled":
+		return SampledHash, nil
+	case "full":
+		return FullHash, nil
+	}
+	return SampledHash, fmt.Errorf("unknown hash mode %q", name)
+}
+
+func (kind OperationKind) String() string {
+	switch kind {
+	case RenameOperation:
+		return "rename"
+	case CopyOperation:
+		return "copy"
+	case DeleteOperation:
+		return "delete"
+	}
+	return fmt.Sprintf("OperationKind(%d)", int(kind))
 }
@@ -0,0 +1,406 @@
+// Package memfs keeps archives in memory. They start empty and are gone when
+// arc quits, which makes them a scratch space to stage files in and a
+// backend to try things on.
+package memfs
+
+import (
+	"arc/fs"
+	"arc/fs/filesys"
+	"arc/lifecycle"
+	"arc/log"
+	"arc/stream"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errHashMismatch = errors.New("the content does not match its hash")
+
+type fsys struct {
+	lc       *lifecycle.Lifecycle
+	commands *stream.Stream[command]
+	events   chan fs.Event
+
+	sync.Mutex // guards roots and trash
+	roots      map[string]map[string]*file
+	trash      map[string][]trashed
+}
+
+type file struct {
+	meta fs.FileMeta
+	data []byte // never changes once the file is in place
+}
+
+type trashed struct {
+	batch string
+	file  *file
+}
+
+type command interface {
+	command()
+}
+
+type (
+	scan struct{ root string }
+	copy struct {
+		path     string
+		fromRoot string
+		toRoots  []string
+	}
+	rename struct {
+		root       string
+		sourcePath string
+		targetPath string
+	}
+	deleteCmd struct {
+		root string
+		path string
+	}
+	scrub  struct{ root string }
+	verify struct {
+		root string
+		path string
+	}
+	trash   struct{ root string }
+	restore struct {
+		root  string
+		batch string
+		path  string
+	}
+	purge struct {
+		root  string
+		batch string
+		path  string
+	}
+	recovery struct {
+		root    string
+		batch   string
+		forward bool
+	}
+)
+
+func (scan) command()      {}
+func (copy) command()      {}
+func (rename) command()    {}
+func (deleteCmd) command() {}
+func (scrub) command()     {}
+func (verify) command()    {}
+func (trash) command()     {}
+func (restore) command()   {}
+func (purge) command()     {}
+func (recovery) command()  {}
+
+func NewFS(lc *lifecycle.Lifecycle) fs.FS {
+	fs := &fsys{
+		lc:       lc,
+		commands: stream.NewStream[command]("commands"),
+		events:   make(chan fs.Event, 256),
+		roots:    map[string]map[string]*file{},
+		trash:    map[string][]trashed{},
+	}
+	go fs.run()
+	return fs
+}
+
+func (fs *fsys) Events() <-chan fs.Event {
+	return fs.events
+}
+
+func (fs *fsys) Scan(root string) {
+	fs.commands.Push(scan{root: root})
+}
+
+func (fs *fsys) Copy(path, hash, fromRoot string, toRoots ...string) {
+	fs.commands.Push(copy{path: path, fromRoot: fromRoot, toRoots: toRoots})
+}
+
+func (fs *fsys) Rename(root, sourcePath, targetPath string) {
+	fs.commands.Push(rename{root: root, sourcePath: sourcePath, targetPath: targetPath})
+}
+
+func (fs *fsys) Delete(root, path string) {
+	fs.commands.Push(deleteCmd{root: root, path: path})
+}
+
+func (fs *fsys) Scrub(root string) {
+	fs.commands.Push(scrub{root: root})
+}
+
+func (fs *fsys) Verify(root, path string) {
+	fs.commands.Push(verify{root: root, path: path})
+}
+
+func (fs *fsys) Trash(root string) {
+	fs.commands.Push(trash{root: root})
+}
+
+func (fs *fsys) Restore(root, batch, path string) {
+	fs.commands.Push(restore{root: root, batch: batch, path: path})
+}
+
+func (fs *fsys) Purge(root, batch, path string) {
+	fs.commands.Push(purge{root: root, batch: batch, path: path})
+}
+
+// Batch does nothing: operations in memory cannot be interrupted halfway.
+func (fs *fsys) Batch() {}
+
+func (fs *fsys) Recover(root, batch string, forward bool) {
+	fs.commands.Push(recovery{root: root, batch: batch, forward: forward})
+}
+
+func (f *fsys) Quit() {
+	f.commands.Close()
+	f.lc.Stop()
+}
+
+// Open returns the content of a file.
+func (f *fsys) Open(root, path string) (io.ReadCloser, fs.FileMeta, error) {
+	f.Lock()
+	defer f.Unlock()
+	file := f.roots[root][path]
+	if file == nil {
+		return nil, fs.FileMeta{}, &os.PathError{Op: "open", Path: filepath.Join(root, path), Err: os.ErrNotExist}
+	}
+	return io.NopCloser(bytes.NewReader(file.data)), file.meta, nil
+}
+
+// Create collects the content of a file and puts it in place on commit.
+func (f *fsys) Create(meta fs.FileMeta) (fs.FileWriter, error) {
+	return &upload{fsys: f, meta: meta}, nil
+}
+
+type upload struct {
+	bytes.Buffer
+	fsys *fsys
+	meta fs.FileMeta
+}
+
+// Commit checks the content against the hash of the meta, in the meta's mode
+// and algorithm, before putting the file in place.
+func (u *upload) Commit() error {
+	if u.meta.Hash != "" {
+		hash, err := filesys.HashStream(bytes.NewReader(u.Bytes()), u.Len(), u.meta.HashMode, u.meta.Algorithm)
+		if err != nil {
+			return err
+		}
+		if hash != u.meta.Hash {
+			return errHashMismatch
+		}
+	}
+	u.meta.Kind = fs.RegularFile
+	u.meta.Size = u.Len()
+	u.fsys.put(&file{meta: u.meta, data: u.Bytes()})
+	return nil
+}
+
+func (u *upload) Abort() {}
+
+func (f *fsys) run() {
+	// A closed stream returns at once, so the loop ends with the quit.
+	for !f.lc.ShoudStop() {
+		for _, command := range f.commands.Pull() {
+			if f.lc.ShoudStop() {
+				return
+			}
+			switch cmd := command.(type) {
+			case scan:
+				f.scanArchive(cmd)
+			case copy:
+				f.copyFile(cmd)
+			case rename:
+				f.renameFile(cmd)
+			case deleteCmd:
+				f.deleteFile(cmd)
+			case scrub:
+				f.scrubArchive(cmd)
+			case verify:
+				f.verifyFile(cmd)
+			case trash:
+				f.listTrash(cmd)
+			case restore:
+				f.restoreFile(cmd)
+			case purge:
+				f.purgeTrash(cmd)
+			case recovery:
+				f.events <- fs.BatchRecovered{Root: cmd.root, Batch: cmd.batch, Forward: cmd.forward}
+			}
+		}
+	}
+}
+
+func (f *fsys) scanArchive(scan scan) {
+	for _, file := range f.files(scan.root) {
+		f.events <- file.meta
+	}
+	f.events <- fs.ArchiveHashed{Root: scan.root}
+}
+
+func (f *fsys) copyFile(copy copy) {
+	log.Debug("copy", "path", copy.path, "from", copy.fromRoot, "to", copy.toRoots)
+	f.Lock()
+	source := f.roots[copy.fromRoot][copy.path]
+	f.Unlock()
+	for _, root := range copy.toRoots {
+		if source == nil {
+			f.events <- fs.CopyFailed{Root: root, Path: copy.path, Error: os.ErrNotExist}
+			continue
+		}
+		clone := *source
+		clone.meta.Root = root
+		f.put(&clone)
+		f.events <- fs.CopyVerified{Root: root, Path: copy.path}
+	}
+	f.events <- fs.Copied{Path: copy.path, FromRoot: copy.fromRoot, ToRoots: copy.toRoots}
+}
+
+func (f *fsys) renameFile(rename rename) {
+	log.Debug("rename", "root", rename.root, "source", rename.sourcePath, "target", rename.targetPath)
+	f.Lock()
+	files := f.roots[rename.root]
+	var moved []*file
+	for path, file := range files {
+		if path == rename.sourcePath || strings.HasPrefix(path, rename.sourcePath+"/") {
+			moved = append(moved, file)
+		}
+	}
+	for _, file := range moved {
+		f.forget(rename.root, file.meta.Path)
+	}
+	for _, file := range moved {
+		clone := *file
+		clone.meta.Path = rename.targetPath + file.meta.Path[len(rename.sourcePath):]
+		files[clone.meta.Path] = &clone
+	}
+	f.Unlock()
+	if len(moved) == 0 {
+		f.events <- fs.Error{Path: filepath.Join(rename.root, rename.sourcePath), Error: os.ErrNotExist}
+		return
+	}
+	f.events <- fs.Renamed{Root: rename.root, SourcePath: rename.sourcePath, TargetPath: rename.targetPath}
+}
+
+func (f *fsys) deleteFile(delete deleteCmd) {
+	log.Debug("delete", "root", delete.root, "path", delete.path)
+	batch := time.Now().UTC().Format("2006-01-02T15-04-05.000")
+	f.Lock()
+	file := f.roots[delete.root][delete.path]
+	if file != nil {
+		f.forget(delete.root, delete.path)
+		f.trash[delete.root] = append(f.trash[delete.root], trashed{batch: batch, file: file})
+	}
+	f.Unlock()
+	if file == nil {
+		f.events <- fs.Error{Path: filepath.Join(delete.root, delete.path), Error: os.ErrNotExist}
+		return
+	}
+	f.events <- fs.Deleted{Root: delete.root, Path: delete.path, Batch: batch}
+}
+
+func (f *fsys) listTrash(trash trash) {
+	f.Lock()
+	entries := slices.Clone(f.trash[trash.root])
+	f.Unlock()
+	for _, entry := range entries {
+		f.events <- fs.TrashEntry{
+			Root:    trash.root,
+			Batch:   entry.batch,
+			Path:    entry.file.meta.Path,
+			Kind:    entry.file.meta.Kind,
+			Size:    entry.file.meta.Size,
+			ModTime: entry.file.meta.ModTime,
+		}
+	}
+	f.events <- fs.TrashListed{Root: trash.root}
+}
+
+func (f *fsys) restoreFile(restore restore) {
+	log.Debug("restore", "root", restore.root, "batch", restore.batch, "path", restore.path)
+	path := filepath.Join(restore.root, restore.path)
+	f.Lock()
+	idx := slices.IndexFunc(f.trash[restore.root], func(entry trashed) bool {
+		return entry.batch == restore.batch && entry.file.meta.Path == restore.path
+	})
+	var err error
+	var restored *file
+	switch {
+	case idx < 0:
+		err = os.ErrNotExist
+	case f.roots[restore.root][restore.path] != nil:
+		err = os.ErrExist
+	default:
+		restored = f.trash[restore.root][idx].file
+		f.trash[restore.root] = slices.Delete(f.trash[restore.root], idx, idx+1)
+	}
+	f.Unlock()
+	if err != nil {
+		f.events <- fs.Error{Path: path, Error: err}
+		return
+	}
+	f.put(restored)
+	f.events <- fs.Restored{Root: restore.root, Batch: restore.batch, Path: restore.path}
+	f.events <- restored.meta
+}
+
+func (f *fsys) purgeTrash(purge purge) {
+	log.Debug("purge", "root", purge.root, "batch", purge.batch, "path", purge.path)
+	f.Lock()
+	f.trash[purge.root] = slices.DeleteFunc(f.trash[purge.root], func(entry trashed) bool {
+		return entry.batch == purge.batch && (purge.path == "" || entry.file.meta.Path == purge.path)
+	})
+	f.Unlock()
+	f.events <- fs.Purged{Root: purge.root, Batch: purge.batch, Path: purge.path}
+}
+
+// scrubArchive verifies every file; memory does not rot.
+func (f *fsys) scrubArchive(scrub scrub) {
+	for _, file := range f.files(scrub.root) {
+		f.events <- fs.FileVerified{Root: scrub.root, Path: file.meta.Path}
+	}
+	f.events <- fs.ArchiveScrubbed{Root: scrub.root}
+}
+
+func (f *fsys) verifyFile(verify verify) {
+	f.Lock()
+	file := f.roots[verify.root][verify.path]
+	f.Unlock()
+	if file == nil {
+		f.events <- fs.Error{Path: filepath.Join(verify.root, verify.path), Error: os.ErrNotExist}
+		return
+	}
+	f.events <- fs.FileVerified{Root: verify.root, Path: verify.path}
+}
+
+// files returns the files of the root sorted by path.
+func (f *fsys) files(root string) []*file {
+	f.Lock()
+	defer f.Unlock()
+	files := make([]*file, 0, len(f.roots[root]))
+	for _, file := range f.roots[root] {
+		files = append(files, file)
+	}
+	slices.SortFunc(files, func(a, b *file) int { return strings.Compare(a.meta.Path, b.meta.Path) })
+	return files
+}
+
+func (f *fsys) put(added *file) {
+	f.Lock()
+	defer f.Unlock()
+	files := f.roots[added.meta.Root]
+	if files == nil {
+		files = map[string]*file{}
+		f.roots[added.meta.Root] = files
+	}
+	files[added.meta.Path] = added
+}
+
+// forget removes the file from its root. The lock must be held.
+func (f *fsys) forget(root, path string) {
+	delete(f.roots[root], path)
+}
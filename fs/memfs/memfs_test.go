@@ -0,0 +1,40 @@
+package memfs
+
+import (
+	"arc/fs"
+	"arc/fs/filesys"
+	"arc/lifecycle"
+	"bytes"
+	"testing"
+)
+
+func TestCommitUpload(t *testing.T) {
+	content := []byte("uploaded content")
+	sampled, _ := filesys.HashStream(bytes.NewReader(content), len(content), fs.SampledHash, filesys.DefaultHasher)
+	tests := []struct {
+		name      string
+		meta      fs.FileMeta
+		committed bool
+	}{
+		{"no hash", fs.FileMeta{}, true},
+		{"matching hash", fs.FileMeta{Hash: sampled, HashMode: fs.SampledHash, Algorithm: filesys.DefaultHasher}, true},
+		{"hash of other content", fs.FileMeta{Hash: "other", HashMode: fs.SampledHash, Algorithm: filesys.DefaultHasher}, false},
+		{"unknown algorithm", fs.FileMeta{Hash: sampled, HashMode: fs.SampledHash, Algorithm: "unknown"}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := NewFS(lifecycle.New()).(*fsys)
+			defer f.Quit()
+			meta := test.meta
+			meta.Root, meta.Path = "/a", "x"
+			writer, _ := f.Create(meta)
+			writer.Write(content)
+			if err := writer.Commit(); (err == nil) != test.committed {
+				t.Fatalf("commit error %v, expected committed %v", err, test.committed)
+			}
+			if _, _, err := f.Open("/a", "x"); (err == nil) != test.committed {
+				t.Errorf("open error %v, expected committed %v", err, test.committed)
+			}
+		})
+	}
+}
@@ -18,6 +18,13 @@ type fsys struct {
 	scan     bool
 	commands *stream.Stream[command]
 	events   chan fs.Event
+	trash    map[string][]trashed
+}
+
+// trashed keeps what a restore reports back about a deleted file.
+type trashed struct {
+	batch string
+	meta  fs.FileMeta
 }
 
 type command interface {
@@ -38,14 +45,42 @@ type (
 		targetPath string
 	}
 	delete struct {
+		root string
+		path string
+	}
+	scrub  struct{ root string }
+	verify struct {
+		root string
 		path string
 	}
+	trash   struct{ root string }
+	restore struct {
+		root  string
+		batch string
+		path  string
+	}
+	purge struct {
+		root  string
+		batch string
+		path  string
+	}
+	recovery struct {
+		root    string
+		batch   string
+		forward bool
+	}
 )
 
-func (scan) command()   {}
-func (copy) command()   {}
-func (rename) command() {}
-func (delete) command() {}
+func (scan) command()     {}
+func (copy) command()     {}
+func (rename) command()   {}
+func (delete) command()   {}
+func (scrub) command()    {}
+func (verify) command()   {}
+func (trash) command()    {}
+func (restore) command()  {}
+func (purge) command()    {}
+func (recovery) command() {}
 
 func NewFS(lc *lifecycle.Lifecycle, scan bool) fs.FS {
 	fs := &fsys{
@@ -53,6 +88,7 @@ func NewFS(lc *lifecycle.Lifecycle, scan bool) fs.FS {
 		scan:     scan,
 		commands: stream.NewStream[command]("commands"),
 		events:   make(chan fs.Event, 256),
+		trash:    map[string][]trashed{},
 	}
 	go fs.run()
 	return fs
@@ -74,8 +110,34 @@ func (fs *fsys) Rename(root, sourcePath, targetPath string) {
 	fs.commands.Push(rename{root: root, sourcePath: sourcePath, targetPath: targetPath})
 }
 
-func (fs *fsys) Delete(path string) {
-	fs.commands.Push(delete{path: path})
+func (fs *fsys) Delete(root, path string) {
+	fs.commands.Push(delete{root: root, path: path})
+}
+
+func (fs *fsys) Scrub(root string) {
+	fs.commands.Push(scrub{root: root})
+}
+
+func (fs *fsys) Verify(root, path string) {
+	fs.commands.Push(verify{root: root, path: path})
+}
+
+func (fs *fsys) Trash(root string) {
+	fs.commands.Push(trash{root: root})
+}
+
+func (fs *fsys) Restore(root, batch, path string) {
+	fs.commands.Push(restore{root: root, batch: batch, path: path})
+}
+
+func (fs *fsys) Purge(root, batch, path string) {
+	fs.commands.Push(purge{root: root, batch: batch, path: path})
+}
+
+func (fs *fsys) Batch() {}
+
+func (fs *fsys) Recover(root, batch string, forward bool) {
+	fs.commands.Push(recovery{root: root, batch: batch, forward: forward})
 }
 
 func (f *fsys) Quit() {
@@ -98,6 +160,18 @@ func (f *fsys) run() {
 				f.renameFile(cmd)
 			case delete:
 				f.deleteFile(cmd)
+			case scrub:
+				go f.scrubArchive(cmd)
+			case verify:
+				f.verifyFile(cmd)
+			case trash:
+				f.listTrash(cmd)
+			case restore:
+				f.restoreFile(cmd)
+			case purge:
+				f.purgeTrash(cmd)
+			case recovery:
+				f.events <- fs.BatchRecovered{Root: cmd.root, Batch: cmd.batch, Forward: cmd.forward}
 			}
 		}
 	}
@@ -121,6 +195,7 @@ func (f *fsys) scanArchive(scan scan) {
 		}
 	}
 
+	f.events <- fs.DiskSpace{Root: scan.root, Free: 1 << 40}
 	f.events <- fs.ArchiveHashed{Root: scan.root}
 }
 
@@ -144,6 +219,9 @@ func (f *fsys) copyFile(copy copy) {
 		}
 		time.Sleep(time.Millisecond)
 	}
+	for _, root := range copy.toRoots {
+		f.events <- fs.CopyVerified{Root: root, Path: copy.path}
+	}
 	f.events <- fs.Copied{Path: copy.path, FromRoot: copy.fromRoot, ToRoots: copy.toRoots}
 }
 
@@ -153,8 +231,68 @@ func (f *fsys) renameFile(rename rename) {
 }
 
 func (f *fsys) deleteFile(delete delete) {
-	log.Debug("delete", "path", delete.path)
-	f.events <- fs.Deleted{Path: delete.path}
+	log.Debug("delete", "root", delete.root, "path", delete.path)
+	batch := time.Now().UTC().Format("2006-01-02T15-04-05.000")
+	for _, meta := range archives[delete.root] {
+		if meta.Path == delete.path {
+			meta.Root = delete.root
+			f.trash[delete.root] = append(f.trash[delete.root], trashed{batch: batch, meta: meta})
+			break
+		}
+	}
+	f.events <- fs.Deleted{Root: delete.root, Path: delete.path, Batch: batch}
+}
+
+func (f *fsys) listTrash(trash trash) {
+	for _, entry := range f.trash[trash.root] {
+		f.events <- fs.TrashEntry{
+			Root:    trash.root,
+			Batch:   entry.batch,
+			Path:    entry.meta.Path,
+			Kind:    entry.meta.Kind,
+			Size:    entry.meta.Size,
+			ModTime: entry.meta.ModTime,
+		}
+	}
+	f.events <- fs.TrashListed{Root: trash.root}
+}
+
+func (f *fsys) restoreFile(restore restore) {
+	log.Debug("restore", "root", restore.root, "batch", restore.batch, "path", restore.path)
+	idx := slices.IndexFunc(f.trash[restore.root], func(entry trashed) bool {
+		return entry.batch == restore.batch && entry.meta.Path == restore.path
+	})
+	if idx < 0 {
+		return
+	}
+	meta := f.trash[restore.root][idx].meta
+	f.trash[restore.root] = slices.Delete(f.trash[restore.root], idx, idx+1)
+	f.events <- fs.Restored{Root: restore.root, Batch: restore.batch, Path: restore.path}
+	hash := meta.Hash
+	meta.Hash = ""
+	f.events <- meta
+	f.events <- fs.FileHashed{Root: restore.root, Path: restore.path, Hash: hash}
+}
+
+func (f *fsys) purgeTrash(purge purge) {
+	log.Debug("purge", "root", purge.root, "batch", purge.batch, "path", purge.path)
+	f.trash[purge.root] = slices.DeleteFunc(f.trash[purge.root], func(entry trashed) bool {
+		return entry.batch == purge.batch && (purge.path == "" || entry.meta.Path == purge.path)
+	})
+	f.events <- fs.Purged{Root: purge.root, Batch: purge.batch, Path: purge.path}
+}
+
+func (f *fsys) scrubArchive(scrub scrub) {
+	log.Debug("scrub", "root", scrub.root)
+	for _, file := range archives[scrub.root] {
+		f.events <- fs.FileVerified{Root: scrub.root, Path: file.Path}
+	}
+	f.events <- fs.ArchiveScrubbed{Root: scrub.root}
+}
+
+func (f *fsys) verifyFile(verify verify) {
+	log.Debug("verify", "root", verify.root, "path", verify.path)
+	f.events <- fs.FileVerified{Root: verify.root, Path: verify.path}
 }
 
 var archives = map[string][]fs.FileMeta{}
@@ -331,13 +469,18 @@ func readMeta() []fs.FileMeta {
 	}
 	defer hashInfoFile.Close()
 
-	records, err := csv.NewReader(hashInfoFile).ReadAll()
+	csvReader := csv.NewReader(hashInfoFile)
+	csvReader.FieldsPerRecord = -1
+	records, err := csvReader.ReadAll()
 	if err != nil || len(records) == 0 {
 		return nil
 	}
+	if records[0][0] == "arc-meta" {
+		records = records[1:]
+	}
 
 	for _, record := range records[1:] {
-		if len(record) == 5 {
+		if len(record) >= 5 {
 			name := record[1]
 			size, er2 := strconv.ParseUint(record[2], 10, 64)
 			modTime, er3 := time.Parse(time.RFC3339, record[3])
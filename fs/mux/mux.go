@@ -0,0 +1,512 @@
+// Package mux serves every root from its own backend. Copies between roots of
+// the same backend stay with it; copies to the roots of other backends go
+// through a bridge that streams the file from one backend to the others.
+//
+// The bridge runs its copies one at a time, beside the copies the backends
+// schedule themselves. The target backends treat what the bridge writes like
+// their own copies: filesys logs it in the current batch of the target's
+// operation log and reports the space left once it is in place.
+package mux
+
+import (
+	"arc/fs"
+	"arc/lifecycle"
+	"arc/log"
+	"arc/stream"
+	"errors"
+	"io"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+var (
+	errUnknownRoot = errors.New("no backend serves the root")
+	errNoStreaming = errors.New("the backend cannot stream files")
+	errSizeChanged = errors.New("the source changed size while it was copied")
+)
+
+const (
+	chunkSize        = 256 * 1024
+	progressInterval = 100 * time.Millisecond
+)
+
+// Route serves the root the app knows as Root from the backend, which knows
+// it as BackendRoot.
+type Route struct {
+	Root        string
+	BackendRoot string
+	FS          fs.FS
+}
+
+type fsys struct {
+	lc       *lifecycle.Lifecycle
+	routes   map[string]Route
+	backends []*backend
+	bridges  *stream.Stream[bridged]
+	events   chan fs.Event
+	quit     chan struct{}
+	quitOnce sync.Once
+
+	sync.Mutex // guards pending, which keeps the copies in the order issued
+	pending    map[copyKey][]*pendingCopy
+}
+
+// backend knows which app root each of its roots is.
+type backend struct {
+	fs    fs.FS
+	roots map[string]string
+}
+
+// bridged is a copy to the roots of backends other than the source's.
+type bridged struct {
+	path string
+	hash string
+	from Route
+	to   []Route
+}
+
+type copyKey struct {
+	fromRoot string
+	path     string
+}
+
+// pendingCopy is a copy split between its source backend and the bridge. It
+// is reported copied once both parts are done. The source backend reports
+// its part with the local roots, which tells apart copies of the same file
+// to other roots; the bridge runs its parts in order.
+type pendingCopy struct {
+	toRoots    []string // the roots of both parts
+	localRoots []string // the source backend's part, nil once done
+	bridged    bool     // the bridge's part is not done yet
+}
+
+func NewFS(lc *lifecycle.Lifecycle, routes []Route) fs.FS {
+	fs := &fsys{
+		lc:      lc,
+		routes:  map[string]Route{},
+		bridges: stream.NewStream[bridged]("bridges"),
+		events:  make(chan fs.Event, 256),
+		quit:    make(chan struct{}),
+		pending: map[copyKey][]*pendingCopy{},
+	}
+	for _, route := range routes {
+		fs.routes[route.Root] = route
+		idx := slices.IndexFunc(fs.backends, func(b *backend) bool { return b.fs == route.FS })
+		if idx < 0 {
+			idx = len(fs.backends)
+			fs.backends = append(fs.backends, &backend{fs: route.FS, roots: map[string]string{}})
+		}
+		fs.backends[idx].roots[route.BackendRoot] = route.Root
+	}
+	for _, backend := range fs.backends {
+		go fs.forward(backend)
+	}
+	lc.Started()
+	go fs.bridge()
+	return fs
+}
+
+func (f *fsys) Events() <-chan fs.Event {
+	return f.events
+}
+
+func (f *fsys) Scan(root string) {
+	if route, ok := f.route(root); ok {
+		route.FS.Scan(route.BackendRoot)
+	}
+}
+
+// Copy hands the targets on the source's backend to it and the others to the
+// bridge.
+func (f *fsys) Copy(path, hash, fromRoot string, toRoots ...string) {
+	from, ok := f.route(fromRoot)
+	if !ok {
+		return
+	}
+	var local, routed, localRoots []string
+	var remote []Route
+	for _, root := range toRoots {
+		to, ok := f.route(root)
+		switch {
+		case !ok:
+			continue
+		case to.FS == from.FS:
+			local = append(local, to.BackendRoot)
+			localRoots = append(localRoots, root)
+		default:
+			remote = append(remote, to)
+		}
+		routed = append(routed, root)
+	}
+	if len(remote) > 0 {
+		f.Lock()
+		key := copyKey{fromRoot: fromRoot, path: path}
+		f.pending[key] = append(f.pending[key], &pendingCopy{toRoots: routed, localRoots: localRoots, bridged: true})
+		f.Unlock()
+		f.bridges.Push(bridged{path: path, hash: hash, from: from, to: remote})
+	}
+	if len(local) > 0 {
+		from.FS.Copy(path, hash, from.BackendRoot, local...)
+	}
+}
+
+func (f *fsys) Rename(root, sourcePath, targetPath string) {
+	if route, ok := f.route(root); ok {
+		route.FS.Rename(route.BackendRoot, sourcePath, targetPath)
+	}
+}
+
+func (f *fsys) Delete(root, path string) {
+	if route, ok := f.route(root); ok {
+		route.FS.Delete(route.BackendRoot, path)
+	}
+}
+
+func (f *fsys) Scrub(root string) {
+	if route, ok := f.route(root); ok {
+		route.FS.Scrub(route.BackendRoot)
+	}
+}
+
+func (f *fsys) Verify(root, path string) {
+	if route, ok := f.route(root); ok {
+		route.FS.Verify(route.BackendRoot, path)
+	}
+}
+
+func (f *fsys) Trash(root string) {
+	if route, ok := f.route(root); ok {
+		route.FS.Trash(route.BackendRoot)
+	}
+}
+
+func (f *fsys) Restore(root, batch, path string) {
+	if route, ok := f.route(root); ok {
+		route.FS.Restore(route.BackendRoot, batch, path)
+	}
+}
+
+func (f *fsys) Purge(root, batch, path string) {
+	if route, ok := f.route(root); ok {
+		route.FS.Purge(route.BackendRoot, batch, path)
+	}
+}
+
+func (f *fsys) Batch() {
+	for _, backend := range f.backends {
+		backend.fs.Batch()
+	}
+}
+
+func (f *fsys) Recover(root, batch string, forward bool) {
+	if route, ok := f.route(root); ok {
+		route.FS.Recover(route.BackendRoot, batch, forward)
+	}
+}
+
+// Quit quits the backends together: they share the lifecycle, so each one
+// waits for the others to stop. Calls after the first do nothing.
+func (f *fsys) Quit() {
+	f.quitOnce.Do(func() {
+		close(f.quit)
+		f.bridges.Close()
+		wg := sync.WaitGroup{}
+		for _, backend := range f.backends {
+			wg.Add(1)
+			go func(backend fs.FS) {
+				defer wg.Done()
+				backend.Quit()
+			}(backend.fs)
+		}
+		wg.Wait()
+	})
+}
+
+func (f *fsys) route(root string) (Route, bool) {
+	route, ok := f.routes[root]
+	if !ok {
+		// The caller may be the reader of the events.
+		go f.emit(fs.Error{Path: root, Error: errUnknownRoot})
+	}
+	return route, ok
+}
+
+// emit drops the event once the mux quits, when nobody reads them any more.
+func (f *fsys) emit(event fs.Event) {
+	select {
+	case f.events <- event:
+	case <-f.quit:
+	}
+}
+
+// forward passes the backend's events on with the roots the app knows.
+func (f *fsys) forward(backend *backend) {
+	root := func(backendRoot string) string {
+		if root, ok := backend.roots[backendRoot]; ok {
+			return root
+		}
+		return backendRoot
+	}
+	for event := range backend.fs.Events() {
+		event = translate(event, root)
+		if copied, ok := event.(fs.Copied); ok {
+			var done bool
+			if copied, done = f.copied(copied, false); !done {
+				continue
+			}
+			event = copied
+		}
+		f.emit(event)
+	}
+}
+
+// copied counts a part of a split copy done, the bridge's or the source
+// backend's, and reports whether the whole copy is.
+func (f *fsys) copied(event fs.Copied, bridged bool) (fs.Copied, bool) {
+	f.Lock()
+	defer f.Unlock()
+	key := copyKey{fromRoot: event.FromRoot, path: event.Path}
+	copies := f.pending[key]
+	idx := slices.IndexFunc(copies, func(pending *pendingCopy) bool {
+		if bridged {
+			return pending.bridged
+		}
+		return pending.localRoots != nil && slices.Equal(pending.localRoots, event.ToRoots)
+	})
+	if idx < 0 {
+		return event, true
+	}
+	pending := copies[idx]
+	if bridged {
+		pending.bridged = false
+	} else {
+		pending.localRoots = nil
+	}
+	if pending.bridged || pending.localRoots != nil {
+		return event, false
+	}
+	if copies = slices.Delete(copies, idx, idx+1); len(copies) == 0 {
+		delete(f.pending, key)
+	} else {
+		f.pending[key] = copies
+	}
+	return fs.Copied{Path: event.Path, FromRoot: event.FromRoot, ToRoots: pending.toRoots}, true
+}
+
+func translate(event fs.Event, root func(string) string) fs.Event {
+	switch event := event.(type) {
+	case fs.FileMeta:
+		event.Root = root(event.Root)
+		return event
+	case fs.FileHashed:
+		event.Root = root(event.Root)
+		return event
+	case fs.CopyProgress:
+		event.Root = root(event.Root)
+		return event
+	case fs.ArchiveHashed:
+		event.Root = root(event.Root)
+		return event
+	case fs.Copied:
+		event.FromRoot = root(event.FromRoot)
+		toRoots := make([]string, len(event.ToRoots))
+		for i, toRoot := range event.ToRoots {
+			toRoots[i] = root(toRoot)
+		}
+		event.ToRoots = toRoots
+		return event
+	case fs.CopyVerified:
+		event.Root = root(event.Root)
+		return event
+	case fs.CopyFailed:
+		event.Root = root(event.Root)
+		return event
+	case fs.Renamed:
+		event.Root = root(event.Root)
+		return event
+	case fs.Deleted:
+		event.Root = root(event.Root)
+		return event
+	case fs.FileVerified:
+		event.Root = root(event.Root)
+		return event
+	case fs.Corrupted:
+		event.Root = root(event.Root)
+		return event
+	case fs.ArchiveScrubbed:
+		event.Root = root(event.Root)
+		return event
+	case fs.TrashEntry:
+		event.Root = root(event.Root)
+		return event
+	case fs.TrashListed:
+		event.Root = root(event.Root)
+		return event
+	case fs.Restored:
+		event.Root = root(event.Root)
+		return event
+	case fs.Purged:
+		event.Root = root(event.Root)
+		return event
+	case fs.IncompleteBatch:
+		event.Root = root(event.Root)
+		operations := slices.Clone(event.Operations)
+		for i := range operations {
+			if operations[i].FromRoot != "" {
+				operations[i].FromRoot = root(operations[i].FromRoot)
+			}
+		}
+		event.Operations = operations
+		return event
+	case fs.BatchRecovered:
+		event.Root = root(event.Root)
+		return event
+	case fs.DiskSpace:
+		event.Root = root(event.Root)
+		return event
+	}
+	return event
+}
+
+// bridge runs the bridged copies one at a time.
+func (f *fsys) bridge() {
+	defer f.lc.Done()
+	for {
+		for _, copy := range f.bridges.Pull() {
+			if f.lc.ShoudStop() {
+				return
+			}
+			f.bridgeCopy(copy)
+		}
+		if f.bridges.Closed() {
+			return
+		}
+	}
+}
+
+// target is a root a bridged copy writes to.
+type target struct {
+	route  Route
+	writer fs.FileWriter // nil until created and once committed or failed
+	failed bool
+}
+
+// bridgeCopy streams the file from its source to every target at once.
+// Only regular files can be streamed.
+func (f *fsys) bridgeCopy(copy bridged) {
+	log.Debug("bridge", "path", copy.path, "from", copy.from.Root, "to", len(copy.to))
+	defer func() {
+		if copied, done := f.copied(fs.Copied{Path: copy.path, FromRoot: copy.from.Root}, true); done {
+			f.emit(copied)
+		}
+	}()
+
+	targets := make([]*target, len(copy.to))
+	for i, route := range copy.to {
+		targets[i] = &target{route: route}
+	}
+	failAll := func(err error) {
+		for _, target := range targets {
+			f.fail(copy, target, err)
+		}
+	}
+
+	source, ok := copy.from.FS.(fs.Streamer)
+	if !ok {
+		failAll(errNoStreaming)
+		return
+	}
+	reader, meta, err := source.Open(copy.from.BackendRoot, copy.path)
+	if err != nil {
+		failAll(err)
+		return
+	}
+	defer reader.Close()
+	if copy.hash != "" {
+		meta.Hash = copy.hash
+	}
+
+	for _, target := range targets {
+		streamer, ok := target.route.FS.(fs.Streamer)
+		if !ok {
+			f.fail(copy, target, errNoStreaming)
+			continue
+		}
+		targetMeta := meta
+		targetMeta.Root = target.route.BackendRoot
+		targetMeta.Inode = 0
+		targetMeta.Links = 1
+		target.writer, err = streamer.Create(targetMeta)
+		if err != nil {
+			f.fail(copy, target, err)
+		}
+	}
+
+	buf := make([]byte, chunkSize)
+	copied := 0
+	reported := time.Now()
+	for live(targets) {
+		if f.lc.ShoudStop() {
+			failAll(errors.New("arc quit"))
+			return
+		}
+		n, err := io.ReadFull(reader, buf)
+		for _, target := range targets {
+			if target.writer == nil || n == 0 {
+				continue
+			}
+			if _, err := target.writer.Write(buf[:n]); err != nil {
+				f.fail(copy, target, err)
+			}
+		}
+		copied += n
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			failAll(err)
+			return
+		}
+		if time.Since(reported) >= progressInterval {
+			reported = time.Now()
+			f.emit(fs.CopyProgress{Root: copy.from.Root, Path: copy.path, Copyed: copied})
+		}
+	}
+	if copied != meta.Size {
+		failAll(errSizeChanged)
+		return
+	}
+
+	for _, target := range targets {
+		if target.writer == nil {
+			continue
+		}
+		err := target.writer.Commit()
+		target.writer = nil
+		if err != nil {
+			f.fail(copy, target, err)
+			continue
+		}
+		f.emit(fs.CopyVerified{Root: target.route.Root, Path: copy.path})
+	}
+}
+
+// fail aborts the copy to the target unless it already failed.
+func (f *fsys) fail(copy bridged, target *target, err error) {
+	if target.failed {
+		return
+	}
+	target.failed = true
+	if target.writer != nil {
+		target.writer.Abort()
+		target.writer = nil
+	}
+	log.Debug("bridge failed", "path", filepath.Join(target.route.Root, copy.path), "error", err)
+	f.emit(fs.CopyFailed{Root: target.route.Root, Path: copy.path, Error: err})
+}
+
+func live(targets []*target) bool {
+	return slices.ContainsFunc(targets, func(target *target) bool { return target.writer != nil })
+}
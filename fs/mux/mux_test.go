@@ -0,0 +1,189 @@
+package mux
+
+import (
+	"arc/fs"
+	"arc/fs/filesys"
+	"arc/fs/memfs"
+	"arc/lifecycle"
+	"arc/log"
+	"encoding/csv"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	log.SetLogger(filepath.Join(os.TempDir(), "arc-test-mux.log"))
+	os.Exit(m.Run())
+}
+
+func TestBridge(t *testing.T) {
+	origin, local := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(origin, "a"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	lc := lifecycle.New()
+	disk := filesys.NewFS(lc, filesys.Options{Watch: false})
+	mem := memfs.NewFS(lc)
+	f := NewFS(lc, []Route{
+		{Root: origin, BackendRoot: origin, FS: disk},
+		{Root: local, BackendRoot: local, FS: disk},
+		{Root: "mem://copy", BackendRoot: "copy", FS: mem},
+	})
+	defer f.Quit()
+
+	next := func() fs.Event {
+		select {
+		case event := <-f.Events():
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+		return nil
+	}
+
+	f.Scan(origin)
+	hash := ""
+	for done := false; !done; {
+		switch event := next().(type) {
+		case fs.FileHashed:
+			hash = event.Hash
+		case fs.ArchiveHashed:
+			done = true
+		case fs.Error:
+			t.Fatal(event.Error)
+		}
+	}
+
+	// One copy goes to a root of the same backend and to one of another.
+	f.Copy("a", hash, origin, local, "mem://copy")
+	verified := map[string]bool{}
+	for done := false; !done; {
+		switch event := next().(type) {
+		case fs.CopyVerified:
+			verified[event.Root] = true
+		case fs.CopyFailed:
+			t.Fatal(event.Root, event.Error)
+		case fs.Copied:
+			if event.FromRoot != origin || !slices.Equal(event.ToRoots, []string{local, "mem://copy"}) {
+				t.Fatalf("unexpected %#v", event)
+			}
+			done = true
+		}
+	}
+	if !verified[local] || !verified["mem://copy"] {
+		t.Fatalf("unexpected verified roots %v", verified)
+	}
+
+	reader, meta, err := mem.(fs.Streamer).Open("copy", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := io.ReadAll(reader)
+	if string(content) != "content" || meta.Hash != hash {
+		t.Fatalf("unexpected %q %#v", content, meta)
+	}
+
+	// The copy in memory scans as the same file.
+	f.Scan("mem://copy")
+	for done := false; !done; {
+		switch event := next().(type) {
+		case fs.FileMeta:
+			if event.Root != "mem://copy" || event.Path != "a" || event.Hash != hash {
+				t.Fatalf("unexpected %#v", event)
+			}
+		case fs.ArchiveHashed:
+			done = event.Root == "mem://copy"
+		}
+	}
+}
+
+func TestBridgeBatch(t *testing.T) {
+	target := t.TempDir()
+	lc := lifecycle.New()
+	disk := filesys.NewFS(lc, filesys.Options{Watch: false})
+	mem := memfs.NewFS(lc)
+	writer, _ := mem.(fs.Streamer).Create(fs.FileMeta{Root: "source", Path: "a"})
+	writer.Write([]byte("content"))
+	if err := writer.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	f := NewFS(lc, []Route{
+		{Root: "mem://source", BackendRoot: "source", FS: mem},
+		{Root: target, BackendRoot: target, FS: disk},
+	})
+	defer f.Quit()
+
+	f.Batch()
+	f.Copy("a", "", "mem://source", target)
+	for done := false; !done; {
+		select {
+		case event := <-f.Events():
+			switch event := event.(type) {
+			case fs.CopyFailed:
+				t.Fatal(event.Error)
+			case fs.Copied:
+				done = true
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+
+	// The bridged copy is logged in the target like a copy of its own.
+	file, err := os.Open(filepath.Join(target, ".arc-oplog.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var states []string
+	for _, record := range records[1:] {
+		if record[3] != fs.CopyOperation.String() || record[4] != "a" {
+			t.Errorf("unexpected record %q", record)
+		}
+		states = append(states, record[2])
+	}
+	if !slices.Equal(states, []string{"started", "finished"}) {
+		t.Errorf("logged %q", states)
+	}
+}
+
+func TestPendingCopies(t *testing.T) {
+	f := &fsys{pending: map[copyKey][]*pendingCopy{}}
+	key := copyKey{fromRoot: "/a", path: "x"}
+	// Two copies of the same file are in flight at once.
+	f.pending[key] = []*pendingCopy{
+		{toRoots: []string{"/b", "mem://c"}, localRoots: []string{"/b"}, bridged: true},
+		{toRoots: []string{"/d", "mem://e"}, localRoots: []string{"/d"}, bridged: true},
+	}
+
+	steps := []struct {
+		event   fs.Copied
+		bridged bool
+		done    []string // the roots of the copy reported done
+	}{
+		{fs.Copied{Path: "x", FromRoot: "/a", ToRoots: []string{"/d"}}, false, nil},
+		{fs.Copied{Path: "x", FromRoot: "/a"}, true, nil},
+		{fs.Copied{Path: "x", FromRoot: "/a", ToRoots: []string{"/b"}}, false, []string{"/b", "mem://c"}},
+		{fs.Copied{Path: "x", FromRoot: "/a"}, true, []string{"/d", "mem://e"}},
+	}
+	for i, step := range steps {
+		copied, done := f.copied(step.event, step.bridged)
+		if done != (step.done != nil) || done && !slices.Equal(copied.ToRoots, step.done) {
+			t.Errorf("step %d: done %v with %q, expected %q", i, done, copied.ToRoots, step.done)
+		}
+	}
+	if len(f.pending) > 0 {
+		t.Errorf("copies left pending: %v", f.pending)
+	}
+}
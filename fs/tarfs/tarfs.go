@@ -0,0 +1,391 @@
+// Package tarfs reads archives kept as tar files, plain or gzipped. They are
+// read-only: files can be copied out of them, but nothing changes them.
+package tarfs
+
+import (
+	"arc/fs"
+	"arc/fs/filesys"
+	"arc/lifecycle"
+	"arc/log"
+	"arc/stream"
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	pathpkg "path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+var errReadOnly = errors.New("tar archives are read-only")
+
+type Options struct {
+	HashMode fs.HashMode
+	Hasher   string
+}
+
+type fsys struct {
+	lc       *lifecycle.Lifecycle
+	opts     Options
+	commands *stream.Stream[command]
+	events   chan fs.Event
+
+	sync.Mutex                              // guards hashes
+	hashes     map[string]map[string]string // the hashes of the last scan, for scrubs
+}
+
+type command interface {
+	command()
+}
+
+type (
+	scan struct{ root string }
+	copy struct {
+		path     string
+		fromRoot string
+		toRoots  []string
+	}
+	change struct { // renames, deletes, restores and purges, all refused
+		root string
+		path string
+	}
+	scrub  struct{ root string }
+	verify struct {
+		root string
+		path string
+	}
+	trash    struct{ root string }
+	recovery struct {
+		root    string
+		batch   string
+		forward bool
+	}
+)
+
+func (scan) command()     {}
+func (copy) command()     {}
+func (change) command()   {}
+func (scrub) command()    {}
+func (verify) command()   {}
+func (trash) command()    {}
+func (recovery) command() {}
+
+func NewFS(lc *lifecycle.Lifecycle, opts Options) fs.FS {
+	if opts.Hasher == "" {
+		opts.Hasher = filesys.DefaultHasher
+	}
+	fs := &fsys{
+		lc:       lc,
+		opts:     opts,
+		commands: stream.NewStream[command]("commands"),
+		events:   make(chan fs.Event, 256),
+		hashes:   map[string]map[string]string{},
+	}
+	go fs.run()
+	return fs
+}
+
+func (fs *fsys) Events() <-chan fs.Event {
+	return fs.events
+}
+
+func (fs *fsys) Scan(root string) {
+	fs.commands.Push(scan{root: root})
+}
+
+func (fs *fsys) Copy(path, hash, fromRoot string, toRoots ...string) {
+	fs.commands.Push(copy{path: path, fromRoot: fromRoot, toRoots: toRoots})
+}
+
+func (fs *fsys) Rename(root, sourcePath, targetPath string) {
+	fs.commands.Push(change{root: root, path: sourcePath})
+}
+
+func (fs *fsys) Delete(root, path string) {
+	fs.commands.Push(change{root: root, path: path})
+}
+
+func (fs *fsys) Scrub(root string) {
+	fs.commands.Push(scrub{root: root})
+}
+
+func (fs *fsys) Verify(root, path string) {
+	fs.commands.Push(verify{root: root, path: path})
+}
+
+// Trash lists nothing: nothing is ever deleted from a tar archive.
+func (fs *fsys) Trash(root string) {
+	fs.commands.Push(trash{root: root})
+}
+
+func (fs *fsys) Restore(root, batch, path string) {
+	fs.commands.Push(change{root: root, path: path})
+}
+
+func (fs *fsys) Purge(root, batch, path string) {
+	fs.commands.Push(change{root: root, path: path})
+}
+
+func (fs *fsys) Batch() {}
+
+func (fs *fsys) Recover(root, batch string, forward bool) {
+	fs.commands.Push(recovery{root: root, batch: batch, forward: forward})
+}
+
+func (f *fsys) Quit() {
+	f.commands.Close()
+	f.lc.Stop()
+}
+
+// Open returns the content of a regular file in the tar file.
+func (f *fsys) Open(root, path string) (io.ReadCloser, fs.FileMeta, error) {
+	file, reader, err := openTar(root)
+	if err != nil {
+		return nil, fs.FileMeta{}, err
+	}
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			err = &os.PathError{Op: "open", Path: filepath.Join(root, path), Err: os.ErrNotExist}
+		}
+		if err != nil {
+			file.Close()
+			return nil, fs.FileMeta{}, err
+		}
+		if header.Typeflag == tar.TypeReg && entryPath(header) == path {
+			meta := f.entryMeta(root, header)
+			return struct {
+				io.Reader
+				io.Closer
+			}{reader, file}, *meta, nil
+		}
+	}
+}
+
+func (f *fsys) Create(meta fs.FileMeta) (fs.FileWriter, error) {
+	return nil, errReadOnly
+}
+
+func (f *fsys) run() {
+	// A closed stream returns at once, so the loop ends with the quit.
+	for !f.lc.ShoudStop() {
+		for _, command := range f.commands.Pull() {
+			if f.lc.ShoudStop() {
+				return
+			}
+			switch cmd := command.(type) {
+			case scan:
+				go f.scanArchive(cmd)
+			case copy:
+				for _, root := range cmd.toRoots {
+					f.events <- fs.CopyFailed{Root: root, Path: cmd.path, Error: errReadOnly}
+				}
+				f.events <- fs.Copied{Path: cmd.path, FromRoot: cmd.fromRoot, ToRoots: cmd.toRoots}
+			case change:
+				f.events <- fs.Error{Path: filepath.Join(cmd.root, cmd.path), Error: errReadOnly}
+			case scrub:
+				go f.scrubArchive(cmd)
+			case verify:
+				go f.verifyFile(cmd)
+			case trash:
+				f.events <- fs.TrashListed{Root: cmd.root}
+			case recovery:
+				f.events <- fs.BatchRecovered{Root: cmd.root, Batch: cmd.batch, Forward: cmd.forward}
+			}
+		}
+	}
+}
+
+// scanArchive reads the tar file once, hashing the files as they go by.
+// Folders are reported only when empty, as filesys does.
+func (f *fsys) scanArchive(scan scan) {
+	f.lc.Started()
+	defer f.lc.Done()
+	defer func() {
+		f.events <- fs.ArchiveHashed{Root: scan.root}
+	}()
+
+	hashes := map[string]string{}
+	var dirs []*fs.FileMeta
+	nonEmptyDirs := map[string]bool{}
+	err := f.walk(scan.root, func(meta *fs.FileMeta) {
+		nonEmptyDirs[pathpkg.Dir(meta.Path)] = true
+		if meta.Kind == fs.Directory {
+			dirs = append(dirs, meta)
+			return
+		}
+		hashes[meta.Path] = meta.Hash
+		f.events <- *meta
+	})
+	if err != nil {
+		f.events <- fs.Error{Path: scan.root, Error: err}
+		return
+	}
+	for _, dir := range dirs {
+		if !nonEmptyDirs[dir.Path] {
+			f.events <- *dir
+		}
+	}
+	f.Lock()
+	f.hashes[scan.root] = hashes
+	f.Unlock()
+}
+
+// scrubArchive hashes every file again and compares it with the last scan.
+func (f *fsys) scrubArchive(scrub scrub) {
+	f.lc.Started()
+	defer f.lc.Done()
+	defer func() {
+		f.events <- fs.ArchiveScrubbed{Root: scrub.root}
+	}()
+
+	err := f.walk(scrub.root, func(meta *fs.FileMeta) {
+		if meta.Kind != fs.Directory {
+			f.check(meta)
+		}
+	})
+	if err != nil {
+		f.events <- fs.Error{Path: scrub.root, Error: err}
+	}
+}
+
+func (f *fsys) verifyFile(verify verify) {
+	f.lc.Started()
+	defer f.lc.Done()
+
+	found := false
+	err := f.walk(verify.root, func(meta *fs.FileMeta) {
+		if meta.Path == verify.path {
+			found = true
+			f.check(meta)
+		}
+	})
+	if err == nil && !found {
+		err = os.ErrNotExist
+	}
+	if err != nil {
+		f.events <- fs.Error{Path: filepath.Join(verify.root, verify.path), Error: err}
+	}
+}
+
+// check compares a freshly hashed entry with the hash of the last scan.
+func (f *fsys) check(meta *fs.FileMeta) {
+	f.Lock()
+	recorded, ok := f.hashes[meta.Root][meta.Path]
+	f.Unlock()
+	if ok && recorded != meta.Hash {
+		f.events <- fs.Corrupted{Root: meta.Root, Path: meta.Path, Hash: recorded}
+		return
+	}
+	f.events <- fs.FileVerified{Root: meta.Root, Path: meta.Path}
+}
+
+// walk hashes the regular files and symlinks of the tar file and hands them
+// with its folders to handle, in the order they are stored.
+func (f *fsys) walk(root string, handle func(meta *fs.FileMeta)) error {
+	file, reader, err := openTar(root)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	for !f.lc.ShoudStop() {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		meta := f.entryMeta(root, header)
+		if meta == nil {
+			continue
+		}
+		if meta.Kind == fs.RegularFile {
+			meta.Hash, err = filesys.HashStream(reader, meta.Size, f.opts.HashMode, f.opts.Hasher)
+			if err != nil {
+				return err
+			}
+		}
+		handle(meta)
+	}
+	return nil
+}
+
+// entryMeta describes a regular file, a symlink or a folder. Hashes of files
+// are left to the caller.
+func (f *fsys) entryMeta(root string, header *tar.Header) *fs.FileMeta {
+	meta := &fs.FileMeta{
+		Root:      root,
+		Path:      entryPath(header),
+		Links:     1,
+		Size:      int(header.Size),
+		ModTime:   header.ModTime.UTC().Round(time.Second),
+		Mode:      header.FileInfo().Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky),
+		UID:       header.Uid,
+		GID:       header.Gid,
+		Xattrs:    filesys.HashXattrs(f.opts.Hasher, xattrs(header)),
+		HashMode:  f.opts.HashMode,
+		Algorithm: f.opts.Hasher,
+	}
+	switch header.Typeflag {
+	case tar.TypeReg:
+		meta.Kind = fs.RegularFile
+	case tar.TypeSymlink:
+		meta.Kind = fs.Symlink
+		meta.Target = header.Linkname
+		meta.Size = 0
+		meta.Hash = filesys.HashString(f.opts.Hasher, "symlink:"+header.Linkname)
+	case tar.TypeDir:
+		meta.Kind = fs.Directory
+		meta.Size = 0
+		meta.Hash = filesys.HashString(f.opts.Hasher, "directory")
+	default:
+		return nil
+	}
+	if meta.Path == "." {
+		return nil
+	}
+	return meta
+}
+
+// xattrs returns the extended attributes stored in the PAX records.
+func xattrs(header *tar.Header) map[string][]byte {
+	attrs := map[string][]byte{}
+	for key, value := range header.PAXRecords {
+		if name, ok := strings.CutPrefix(key, "SCHILY.xattr."); ok {
+			attrs[name] = []byte(value)
+		}
+	}
+	return attrs
+}
+
+func entryPath(header *tar.Header) string {
+	return norm.NFC.String(strings.TrimPrefix(pathpkg.Clean("/"+header.Name), "/"))
+}
+
+// openTar opens the tar file, unzipping it if it is gzipped.
+func openTar(root string) (io.Closer, *tar.Reader, error) {
+	file, err := os.Open(root)
+	if err != nil {
+		return nil, nil, err
+	}
+	buffered := bufio.NewReader(file)
+	var reader io.Reader = buffered
+	if magic, err := buffered.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		zipped, err := gzip.NewReader(buffered)
+		if err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+		reader = zipped
+	}
+	log.Debug("open tar", "root", root)
+	return file, tar.NewReader(reader), nil
+}
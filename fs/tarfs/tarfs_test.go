@@ -0,0 +1,90 @@
+package tarfs
+
+import (
+	"arc/fs"
+	"arc/fs/filesys"
+	"arc/lifecycle"
+	"arc/log"
+	"archive/tar"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	log.SetLogger(filepath.Join(os.TempDir(), "arc-test-tarfs.log"))
+	os.Exit(m.Run())
+}
+
+// TestScan checks that a gzipped tar file hashes like the same files on disk.
+func TestScan(t *testing.T) {
+	content := strings.Repeat("content", 100000)
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(t.TempDir(), "archive.tar.gz")
+	file, err := os.Create(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zipped := gzip.NewWriter(file)
+	writer := tar.NewWriter(zipped)
+	writer.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "./dir/", Mode: 0755, ModTime: time.Now()})
+	writer.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "./empty/", Mode: 0755, ModTime: time.Now()})
+	writer.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "./dir/a", Mode: 0644, Size: int64(len(content)), ModTime: time.Now()})
+	writer.Write([]byte(content))
+	writer.Close()
+	zipped.Close()
+	file.Close()
+
+	lc := lifecycle.New()
+	disk := filesys.NewFS(lc, filesys.Options{Watch: false})
+	tarFS := NewFS(lc, Options{})
+	defer tarFS.Quit()
+	defer disk.Quit()
+
+	diskHash := ""
+	disk.Scan(dir)
+	for event := range disk.Events() {
+		if hashed, ok := event.(fs.FileHashed); ok {
+			diskHash = hashed.Hash
+		}
+		if _, ok := event.(fs.ArchiveHashed); ok {
+			break
+		}
+	}
+
+	metas := map[string]fs.FileMeta{}
+	tarFS.Scan(archive)
+	for event := range tarFS.Events() {
+		if meta, ok := event.(fs.FileMeta); ok {
+			metas[meta.Path] = meta
+		}
+		if _, ok := event.(fs.ArchiveHashed); ok {
+			break
+		}
+		if err, ok := event.(fs.Error); ok {
+			t.Fatal(err.Error)
+		}
+	}
+	if len(metas) != 2 || metas["empty"].Kind != fs.Directory {
+		t.Fatalf("unexpected metas %v", metas)
+	}
+	if meta := metas["dir/a"]; meta.Size != len(content) || meta.Hash == "" || meta.Hash != diskHash {
+		t.Fatalf("unexpected %#v, want hash %q", meta, diskHash)
+	}
+
+	tarFS.Scrub(archive)
+	for event := range tarFS.Events() {
+		if corrupted, ok := event.(fs.Corrupted); ok {
+			t.Fatalf("unexpected %#v", corrupted)
+		}
+		if _, ok := event.(fs.ArchiveScrubbed); ok {
+			break
+		}
+	}
+}
@@ -4,6 +4,7 @@ go 1.21
 
 require (
 	github.com/gdamore/tcell/v2 v2.6.0
+	golang.org/x/sys v0.5.0
 	golang.org/x/text v0.14.0
 )
 
@@ -12,6 +13,5 @@ require (
 	github.com/lucasb-eyer/go-colorful v1.2.0 // indirect
 	github.com/mattn/go-runewidth v0.0.14 // indirect
 	github.com/rivo/uniseg v0.4.3 // indirect
-	golang.org/x/sys v0.5.0 // indirect
 	golang.org/x/term v0.5.0 // indirect
 )